@@ -0,0 +1,166 @@
+package unpack
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The aes128gcm coding is specified in RFC 8188.
+const (
+	aesgcmHeaderLen  = 21 // Salt, record size and key ID length.
+	aesgcmTagLen     = 16
+	aesgcmMinRecord  = aesgcmTagLen + 2 // A delimiter and a tag at least.
+	aesgcmDelimiter  = 1                // Ends the plaintext of a record.
+	aesgcmFinalDelim = 2                // Ends that of the last record.
+)
+
+var (
+	errAESGCMHeader  = errors.New("aes128gcm: invalid header")
+	errAESGCMRecord  = errors.New("aes128gcm: invalid record")
+	errAESGCMTrailer = errors.New("aes128gcm: data after the last record")
+	errAESGCMAuth    = errors.New("aes128gcm: record failed authentication")
+)
+
+// aesgcmReader decrypts data in the aes128gcm coding record by record.
+// Records are authenticated as a whole, so each one is buffered, which
+// takes as much memory as the record size the sender chose, up to the
+// size of the body.
+type aesgcmReader struct {
+	r     io.Reader
+	rs    int64 // Record size.
+	aead  cipher.AEAD
+	nonce [12]byte // Nonce of the first record.
+	seq   uint64   // Sequence number of the next record.
+	last  bool     // Whether the last record has been read.
+	buf   bytes.Buffer
+	out   []byte // What is left to return of the current record.
+	err   error
+}
+
+// newAESGCMReader reads the header of the aes128gcm data in r and looks up
+// the input keying material for its key ID with keys.
+func newAESGCMReader(r io.Reader, keys func(keyID string) ([]byte, error)) (*aesgcmReader, error) {
+	var hdr [aesgcmHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, unexpected(err)
+	}
+
+	rs := int64(binary.BigEndian.Uint32(hdr[16:20]))
+	if rs < aesgcmMinRecord {
+		return nil, errAESGCMHeader
+	}
+
+	keyID := make([]byte, hdr[20])
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return nil, unexpected(err)
+	}
+
+	ikm, err := keys(string(keyID))
+	if err != nil {
+		return nil, err
+	}
+
+	prk := hkdfExtract(hdr[:16], ikm)
+	block, err := aes.NewCipher(hkdfExpand(prk, "Content-Encoding: aes128gcm\x00", 16))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	z := &aesgcmReader{r: r, rs: rs, aead: aead}
+	copy(z.nonce[:], hkdfExpand(prk, "Content-Encoding: nonce\x00", len(z.nonce)))
+	return z, nil
+}
+
+func (z *aesgcmReader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+
+		z.err = z.next()
+	}
+
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+	return n, nil
+}
+
+// next reads and decrypts the next record, returning io.EOF once the data
+// ends after the last record.
+func (z *aesgcmReader) next() error {
+	z.buf.Reset()
+	n, err := z.buf.ReadFrom(io.LimitReader(z.r, z.rs))
+	if err != nil {
+		return err
+	}
+
+	if z.last {
+		if n > 0 {
+			return errAESGCMTrailer
+		}
+
+		return io.EOF
+	}
+
+	if n == 0 {
+		return io.ErrUnexpectedEOF
+	}
+
+	// Each record is encrypted with the nonce of the first one XORed with
+	// its sequence number.
+	nonce := z.nonce
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(z.seq >> (8 * uint(i)))
+	}
+
+	z.seq++
+	plain, err := z.aead.Open(z.buf.Bytes()[:0], nonce[:], z.buf.Bytes(), nil)
+	if err != nil {
+		return errAESGCMAuth
+	}
+
+	// The plaintext is followed by a delimiter and any number of zeros
+	// of padding. All but the last record fill up the record size.
+	i := len(plain) - 1
+	for i >= 0 && plain[i] == 0 {
+		i--
+	}
+
+	switch {
+	case i < 0:
+		return errAESGCMRecord
+	case plain[i] == aesgcmFinalDelim:
+		z.last = true
+	case plain[i] != aesgcmDelimiter || n < z.rs:
+		return errAESGCMRecord
+	}
+
+	z.out = plain[:i]
+	return nil
+}
+
+// hkdfExtract and hkdfExpand implement HKDF with SHA-256 (RFC 5869), with
+// output of at most one hash in length, which is all aes128gcm needs.
+func hkdfExtract(salt, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+func hkdfExpand(prk []byte, info string, n int) []byte {
+	mac := hmac.New(sha256.New, prk)
+	mac.Write([]byte(info))
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:n]
+}
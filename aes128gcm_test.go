@@ -0,0 +1,90 @@
+package unpack
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// The examples of RFC 8188 section 3.
+var aesgcmExamples = []struct {
+	name  string
+	key   string
+	keyID string
+	data  string
+}{
+	{name: "single record", key: "yqdlZ-tYemfogSmv7Ws5PQ", data: "I1BsxtFttlv3u_Oo94xnmwAAEAAA-NAVub2qFgBEuQKRapoZu-IxkIva3MEB1PD-ly8Thjg"},
+	{name: "multiple records", key: "BO3ZVPxUlnLORbVGMpbT1Q", keyID: "a1", data: "uNCkWiNYzKTnBN9ji3-qWAAAABkCYTHOG8chz_gnvgOqdGYovxyjuqRyJFjEDyoF1Fvkj6hQPdPHI51OEUKEpgz3SsLWIqS_uA"},
+}
+
+var errUnknownKey = errors.New("unknown key ID")
+
+// exampleKeys returns the key of the example with the given key ID.
+func exampleKeys(keyID string) ([]byte, error) {
+	for _, ex := range aesgcmExamples {
+		if ex.keyID == keyID {
+			return base64.RawURLEncoding.DecodeString(ex.key)
+		}
+	}
+
+	return nil, errUnknownKey
+}
+
+func exampleData(t *testing.T, i int) []byte {
+	data, err := base64.RawURLEncoding.DecodeString(aesgcmExamples[i].data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestAESGCMReader(t *testing.T) {
+	for i, ex := range aesgcmExamples {
+		zr, err := newAESGCMReader(bytes.NewReader(exampleData(t, i)), exampleKeys)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", ex.name, err)
+		}
+
+		got, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", ex.name, err)
+		}
+
+		if want := "I am the walrus"; string(got) != want {
+			t.Fatalf("%s: got %q want %q", ex.name, got, want)
+		}
+	}
+}
+
+func TestAESGCMReaderInvalid(t *testing.T) {
+	// The second example has a 23 byte header and two 25 byte records.
+	multi := exampleData(t, 1)
+	corrupt := append([]byte(nil), multi...)
+	corrupt[30] ^= 1
+
+	salt := string(multi[:16])
+	for _, tt := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{name: "truncated", data: multi[:23+25], err: io.ErrUnexpectedEOF},
+		{name: "trailing data", data: append(multi[:len(multi):len(multi)], 0), err: errAESGCMTrailer},
+		{name: "corrupt", data: corrupt, err: errAESGCMAuth},
+		{name: "unknown key", data: []byte(salt + "\x00\x00\x10\x00\x01x"), err: errUnknownKey},
+		{name: "record size", data: []byte(salt + "\x00\x00\x00\x11\x00"), err: errAESGCMHeader},
+	} {
+		zr, err := newAESGCMReader(bytes.NewReader(tt.data), exampleKeys)
+		if err == nil {
+			_, err = ioutil.ReadAll(zr)
+		}
+
+		if err != tt.err {
+			t.Fatalf("%s: got error %v want %v", tt.name, err, tt.err)
+		}
+	}
+}
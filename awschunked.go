@@ -0,0 +1,120 @@
+package unpack
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// errAWSChunked is returned for aws-chunked data whose framing is invalid.
+var errAWSChunked = errors.New("aws-chunked: invalid chunk framing")
+
+// awsChunkedReader strips the framing of aws-chunked data, as sent by S3
+// clients which sign or checksum their uploads as they stream them, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-streaming.html.
+// Each chunk is a line with its size in hex, optionally followed by
+// extensions such as its signature, then the data and a CRLF. The last
+// chunk is empty and may be followed by trailers, such as checksums, up to
+// an empty line. Neither signatures nor checksums are verified, and the
+// trailers are discarded.
+type awsChunkedReader struct {
+	r       *bufio.Reader
+	n       int64 // Bytes left of the current chunk.
+	started bool  // Whether a chunk has been read, whose CRLF is next.
+	err     error
+}
+
+func newAWSChunkedReader(r io.Reader) *awsChunkedReader {
+	return &awsChunkedReader{r: bufio.NewReader(r)}
+}
+
+func (z *awsChunkedReader) Read(p []byte) (int, error) {
+	for z.n == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+
+		z.err = z.next()
+	}
+
+	if int64(len(p)) > z.n {
+		p = p[:z.n]
+	}
+
+	n, err := z.r.Read(p)
+	z.n -= int64(n)
+	if err != nil {
+		z.n = 0
+		z.err = unexpected(err)
+	}
+
+	return n, nil
+}
+
+// next reads the end of the current chunk and the header of the next one,
+// returning io.EOF once the last chunk and any trailers have been read.
+func (z *awsChunkedReader) next() error {
+	if z.started {
+		line, err := z.readLine()
+		if err != nil {
+			return unexpected(err)
+		}
+
+		if len(line) > 0 {
+			return errAWSChunked
+		}
+	}
+
+	line, err := z.readLine()
+	if err != nil {
+		return unexpected(err)
+	}
+
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+
+	n, err := strconv.ParseInt(string(bytes.TrimSpace(line)), 16, 64)
+	if err != nil || n < 0 {
+		return errAWSChunked
+	}
+
+	z.started = true
+	if n > 0 {
+		z.n = n
+		return nil
+	}
+
+	for {
+		line, err := z.readLine()
+		if err == io.EOF || err == nil && len(line) == 0 {
+			return io.EOF
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readLine reads a line, of at most the size of the buffer of z.r, and
+// returns it without its line ending. The slice is only valid until the
+// next read.
+func (z *awsChunkedReader) readLine() ([]byte, error) {
+	line, err := z.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errAWSChunked
+	}
+
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(line[:len(line)-1], []byte("\r")), nil
+}
@@ -0,0 +1,37 @@
+package unpack
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestAWSChunkedReader(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		data string
+		want string
+		err  error
+	}{
+		{name: "signed", data: "5;chunk-signature=aa\r\nhello\r\n6;chunk-signature=bb\r\n world\r\n0;chunk-signature=cc\r\n\r\n", want: "hello world"},
+		{name: "trailers", data: "b\r\nhello world\r\n0\r\nx-amz-checksum-crc32:DUoRhQ==\r\nx-amz-trailer-signature:dd\r\n\r\n", want: "hello world"},
+		{name: "no final line", data: "5\r\nhello\r\n0\r\n", want: "hello"},
+		{name: "bare newlines", data: "5\nhello\n0\n\n", want: "hello"},
+		{name: "truncated data", data: "5\r\nhel", want: "hel", err: io.ErrUnexpectedEOF},
+		{name: "missing final chunk", data: "5\r\nhello\r\n", want: "hello", err: io.ErrUnexpectedEOF},
+		{name: "bad size", data: "x\r\nhello\r\n0\r\n\r\n", err: errAWSChunked},
+		{name: "negative size", data: "-5\r\nhello\r\n0\r\n\r\n", err: errAWSChunked},
+		{name: "long chunk", data: "3\r\nhello\r\n0\r\n\r\n", want: "hel", err: errAWSChunked},
+		{name: "long line", data: strings.Repeat("0", 5000) + "5\r\nhello\r\n0\r\n\r\n", err: errAWSChunked},
+	} {
+		got, err := ioutil.ReadAll(newAWSChunkedReader(strings.NewReader(tt.data)))
+		if err != tt.err {
+			t.Fatalf("%s: got error %v want %v", tt.name, err, tt.err)
+		}
+
+		if string(got) != tt.want {
+			t.Fatalf("%s: got %q want %q", tt.name, got, tt.want)
+		}
+	}
+}
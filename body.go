@@ -0,0 +1,484 @@
+package unpack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime/pprof"
+	"time"
+)
+
+// ErrLimitExceeded is returned when reading from an unpacked request body
+// which decodes to more bytes than the handler allows. The errors returned
+// are not ErrLimitExceeded itself, so use errors.Is to check for it. They
+// also match an *http.MaxBytesError with errors.As, whose Limit is the
+// limit which was exceeded.
+var ErrLimitExceeded = errors.New("unpack: decoded request body too large")
+
+// limitError is the error returned for bodies which exceed a limit. It is
+// ErrLimitExceeded, and it wraps an *http.MaxBytesError, as returned by
+// http.MaxBytesReader, so that handlers which check for either keep
+// working when a Handler enforces the limit.
+type limitError struct {
+	limit int64
+}
+
+func (e *limitError) Error() string {
+	return ErrLimitExceeded.Error()
+}
+
+func (e *limitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// Unwrap returns an *http.MaxBytesError for the limit which was exceeded.
+func (e *limitError) Unwrap() error {
+	return &http.MaxBytesError{Limit: e.limit}
+}
+
+// ErrDecodeTimeout is returned when reading from an unpacked request body
+// after the time the handler allows for decoding it has passed.
+var ErrDecodeTimeout = errors.New("unpack: decoding request body timed out")
+
+// errDecoderPanic is returned for bodies whose decoders panicked, which
+// crafted data may make buggy decoders do.
+var errDecoderPanic = errors.New("decoder panicked")
+
+// errClosed is returned when reading from a body which has been closed.
+var errClosed = errors.New("unpack: read on closed body")
+
+// maxDrain is the largest amount of decoded data drained from a body which
+// the handler did not read to the end.
+const maxDrain = 1 << 20
+
+// body replaces the body of a request which is being unpacked. It reads
+// the decoded data from the last decoder in the chain, keeps its stats up
+// to date and closes all of the decoders once it is closed itself. Errors
+// returned by the decoders are wrapped in a *DecompressionError.
+type body struct {
+	r       io.Reader
+	encoded *countingReader // The encoded data, as read by the decoders.
+	closers []io.Closer
+	stats   Stats
+	eof     bool // Whether the whole body has been read.
+	closed  bool
+
+	// limits are those set for the request of the body, see
+	// WithLimitResolver and WithLimitOverride.
+	limits Limits
+
+	// open, if not nil, sets up the decoders of a body which is decoded
+	// lazily, see WithLazyDecoding. It is called by the first Read, and
+	// openErr is what it returned if it failed.
+	open    func() error
+	openErr error
+
+	// replay, if true, means that the body was decoded into memory up
+	// front, see buffer, and that r replays the decoded data.
+	replay bool
+
+	// rejected is set once the request of the body has been rejected
+	// after it was passed on, see Error.
+	rejected bool
+
+	// failed, if not nil, is called with the first error encountered
+	// while decoding the body, see WithFailureCapture.
+	failed func(error)
+
+	// release, if not nil, is called once the body is closed to release
+	// the resources reserved for it.
+	release func()
+
+	// deadline, if not zero, is when reading the body fails with
+	// ErrDecodeTimeout. clearDeadline, if not nil, clears the read
+	// deadline of the connection once the body has been read or closed.
+	deadline      time.Time
+	clearDeadline func()
+
+	// tee, if not nil, receives the decoded data as it is read, until
+	// writing to it fails, see WithTee.
+	tee       io.Writer
+	teeFailed bool
+
+	// labels, if not nil, holds the pprof labels which decoding runs
+	// with, see WithPprofLabels, and ctx those to restore afterwards.
+	labels context.Context
+	ctx    context.Context
+
+	// trial is set for bodies which are only decoded to pick a fallback,
+	// see decodes, whose decoding is not reported to any hooks.
+	trial bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, errClosed
+	}
+
+	if b.timedOut() {
+		return 0, b.timeout()
+	}
+
+	if b.open != nil {
+		if err := b.start(); err != nil {
+			return 0, err
+		}
+	}
+
+	if b.replay {
+		return b.r.Read(p)
+	}
+
+	start := time.Now()
+	var n int
+	var err error
+	if b.labels != nil {
+		pprof.SetGoroutineLabels(b.labels)
+		n, err = safeRead(b.r, p)
+		pprof.SetGoroutineLabels(b.ctx)
+	} else {
+		n, err = safeRead(b.r, p)
+	}
+
+	b.stats.DecodeDuration += time.Since(start)
+	b.stats.DecodedBytes += int64(n)
+	if b.tee != nil && !b.teeFailed && n > 0 {
+		if _, err := b.tee.Write(p[:n]); err != nil {
+			b.teeFailed = true
+		}
+	}
+
+	if b.encoded != nil {
+		b.stats.EncodedBytes = b.encoded.n
+	}
+
+	if err == io.EOF {
+		b.eof = true
+		b.clear()
+	} else if err != nil {
+		// Reads from the connection fail once its deadline has passed.
+		if b.timedOut() {
+			return n, b.timeout()
+		}
+
+		if !errors.Is(err, ErrLimitExceeded) {
+			err = &DecompressionError{Encoding: b.stats.Encoding, Err: err}
+		}
+
+		b.setErr(err)
+	}
+
+	return n, err
+}
+
+// safeRead reads from r, the decoders of a body, turning a panic of theirs
+// into an error wrapping errDecoderPanic.
+func safeRead(r io.Reader, p []byte) (n int, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			n, err = 0, fmt.Errorf("%w: %v", errDecoderPanic, v)
+		}
+	}()
+
+	return r.Read(p)
+}
+
+// labeled calls f, which decodes the body, with the pprof labels of the
+// body set, if it has any.
+func (b *body) labeled(f func() error) error {
+	if b.labels == nil {
+		return f()
+	}
+
+	pprof.SetGoroutineLabels(b.labels)
+	defer pprof.SetGoroutineLabels(b.ctx)
+	return f()
+}
+
+// start sets up the decoders of a body which is decoded lazily. A body
+// whose decoders cannot be set up keeps failing with the same error.
+func (b *body) start() error {
+	if b.openErr != nil {
+		return b.openErr
+	}
+
+	err := b.labeled(b.open)
+	if err == nil {
+		b.open = nil
+		return nil
+	}
+
+	if b.timedOut() {
+		err = ErrDecodeTimeout
+	}
+
+	b.openErr = err
+	b.setErr(err)
+	return err
+}
+
+// Close closes the decoders of the body. It returns the first error
+// encountered while reading the body, if any, since decoders such as the
+// gzip one only report corrupt data while being read.
+func (b *body) Close() error {
+	if b.closed {
+		return b.stats.Err
+	}
+
+	b.closed = true
+	b.clear()
+	if b.release != nil {
+		b.release()
+	}
+
+	for _, c := range b.closers {
+		if err := c.Close(); err != nil {
+			b.setErr(&DecompressionError{Encoding: b.stats.Encoding, Err: err})
+		}
+	}
+
+	if c, ok := b.tee.(io.Closer); ok {
+		c.Close()
+	}
+
+	return b.stats.Err
+}
+
+// timedOut reports whether the deadline of the body has passed.
+func (b *body) timedOut() bool {
+	return !b.deadline.IsZero() && time.Now().After(b.deadline)
+}
+
+// timeout records that reading the body timed out and returns the error
+// to fail the read with.
+func (b *body) timeout() error {
+	b.setErr(ErrDecodeTimeout)
+	return ErrDecodeTimeout
+}
+
+// setErr records err as the first error encountered while decoding the
+// body, unless there was one before, and passes it on to failed.
+func (b *body) setErr(err error) {
+	if b.stats.Err != nil {
+		return
+	}
+
+	b.stats.Err = err
+	if b.failed != nil {
+		b.failed(err)
+	}
+}
+
+// clear clears the read deadline of the connection, if the body set one,
+// so that it does not affect what the connection reads after the body.
+func (b *body) clear() {
+	if b.clearDeadline != nil {
+		b.clearDeadline()
+		b.clearDeadline = nil
+	}
+}
+
+// buffer decodes the whole body into memory, up to max bytes, and makes it
+// replay the decoded data from there. Decoded data beyond the spill
+// threshold of h, if any, is written to a temporary file instead, see
+// WithSpillToDisk. buffer fails with ErrLimitExceeded if the body decodes
+// to more than max bytes, or with the error hit while reading it. The
+// part of the body in memory counts towards the in-flight budget of h
+// until the body is closed.
+func (h *Handler) buffer(b *body, max int64) (*io.SectionReader, error) {
+	inMemory := max
+	if h.spillThreshold > 0 && h.spillThreshold < max {
+		inMemory = h.spillThreshold
+	}
+
+	buf, err := h.readBuffered(b, inMemory+1)
+	if err != nil {
+		return nil, err
+	}
+
+	var data io.ReaderAt = bytes.NewReader(buf)
+	size := int64(len(buf))
+	if size > inMemory {
+		if inMemory == max {
+			h.inflight.release(size)
+			return nil, &limitError{limit: max}
+		}
+
+		f, n, err := h.spill(buf, &limitedReader{r: b, max: max - size})
+		h.inflight.release(size)
+		if err != nil {
+			return nil, err
+		}
+
+		b.closers = append(b.closers, f)
+		data, size = f, n
+	} else {
+		release := b.release
+		b.release = func() {
+			h.inflight.release(size)
+			if release != nil {
+				release()
+			}
+		}
+	}
+
+	sr := io.NewSectionReader(data, 0, size)
+	b.r = sr
+	b.replay = true
+	return sr, nil
+}
+
+// seekableBody is a body which was buffered, see WithBuffering, so that
+// handlers can seek in it.
+type seekableBody struct {
+	*body
+	s io.Seeker
+}
+
+func (s *seekableBody) Seek(offset int64, whence int) (int64, error) {
+	return s.s.Seek(offset, whence)
+}
+
+// drain reads the rest of the body, up to maxDrain bytes, so that the
+// decoders get to verify the checksums at the end of the encoded data. It
+// returns the first error encountered while reading the body, if any.
+func (b *body) drain() error {
+	// Lazily decoded bodies which were never read have nothing to verify.
+	if !b.closed && (b.open == nil || b.openErr != nil) {
+		io.CopyN(ioutil.Discard, b, maxDrain)
+	}
+
+	return b.stats.Err
+}
+
+// CloseBody drains what is left of the body of r, up to 1MB, and closes it.
+// For bodies decoded by a Handler, draining lets the decoders verify the
+// checksums at the end of the data, and CloseBody returns the first error
+// encountered while reading the body, such as a *DecompressionError for
+// corrupt data or ErrLimitExceeded. Handlers which are done with a body
+// before reading it to the end can call CloseBody to make sure it was
+// intact and to free the decoders early.
+func CloseBody(r *http.Request) error {
+	b, ok := r.Body.(*body)
+	if sb, isSeekable := r.Body.(*seekableBody); isSeekable {
+		b, ok = sb.body, true
+	}
+
+	if ok {
+		b.drain()
+		return b.Close()
+	}
+
+	io.CopyN(ioutil.Discard, r.Body, maxDrain)
+	return r.Body.Close()
+}
+
+// limitedReader reads from r but fails with ErrLimitExceeded once more
+// than max bytes have been read from it. All counts are int64 so that
+// bodies larger than 2GB are handled correctly on 32-bit platforms too.
+type limitedReader struct {
+	r   io.Reader
+	n   int64 // Number of bytes read from r so far.
+	max int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n > l.max {
+		return 0, &limitError{limit: l.max}
+	}
+
+	// Read at most one byte more than allowed, which is enough to tell
+	// that the limit was exceeded. remaining+1 cannot overflow since
+	// remaining is smaller than len(p) when it is computed.
+	if remaining := l.max - l.n; int64(len(p)) > remaining {
+		p = p[:remaining+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		return n - int(l.n-l.max), &limitError{limit: l.max}
+	}
+
+	return n, err
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// minRatioDecoded is the number of decoded bytes from which on the ratio
+// of decoded to encoded bytes is checked. Before that, the few bytes which
+// decoders read ahead make for ratios which are way off.
+const minRatioDecoded = 64 << 10
+
+// ratioReader reads decoded data from r but fails with ErrLimitExceeded
+// once it has read more than max times as many bytes as the decoders have
+// read from encoded, calling exceeded, if set, the first time.
+type ratioReader struct {
+	r        io.Reader
+	encoded  *countingReader
+	n        int64 // Number of bytes read from r so far.
+	max      float64
+	exceeded func()
+	err      error
+}
+
+func (r *ratioReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if r.n >= minRatioDecoded && float64(r.n) > r.max*float64(r.encoded.n) {
+		r.err = &limitError{limit: int64(r.max * float64(r.encoded.n))}
+		if r.exceeded != nil {
+			r.exceeded()
+		}
+
+		return 0, r.err
+	}
+
+	return n, err
+}
+
+// pump sends the decoded body on ch in chunks of up to chunk bytes until
+// the body has been read, reading it fails or ctx is done. Each chunk is a
+// newly allocated slice which the receiver may keep. pump closes ch when
+// it returns.
+func (b *body) pump(ctx context.Context, ch chan<- []byte, chunk int) error {
+	defer close(ch)
+
+	for {
+		p := make([]byte, chunk)
+		n, err := io.ReadFull(b, p)
+		if n > 0 {
+			select {
+			case ch <- p[:n]:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package unpack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// zeroReader is an endless stream of zeroes, which lets tests push a
+// limitedReader past large counts without allocating real bodies.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
+
+func TestLimitedReaderLargeCounts(t *testing.T) {
+	// Pretend most of the body has been read already so that crossing
+	// math.MaxInt32 only takes a few reads.
+	for _, max := range []int64{math.MaxInt32 + 20, math.MaxInt64} {
+		l := &limitedReader{r: zeroReader{}, n: math.MaxInt32 - 5, max: max}
+
+		buf := make([]byte, 8)
+		var total int64
+		for i := 0; i < 3; i++ {
+			n, err := l.Read(buf)
+			if err != nil {
+				t.Fatalf("max %d: unexpected error after %d bytes: %v", max, total, err)
+			}
+
+			total += int64(n)
+		}
+
+		if l.n != math.MaxInt32-5+total || l.n <= math.MaxInt32 {
+			t.Fatalf("max %d: count overflowed: got %d", max, l.n)
+		}
+	}
+
+	l := &limitedReader{r: zeroReader{}, n: math.MaxInt32 - 5, max: math.MaxInt32 + 10}
+	var total int64
+	buf := make([]byte, 8)
+	for {
+		n, err := l.Read(buf)
+		total += int64(n)
+		if errors.Is(err, ErrLimitExceeded) {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if total != 15 {
+		t.Fatalf("read %d bytes before hitting the limit, want 15", total)
+	}
+}
+
+func TestMaxBytesError(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		opts  []Option
+		limit int64
+	}{
+		{name: "decoded", opts: []Option{WithMaxDecodedBytes(3)}, limit: 3},
+		{name: "encoded", opts: []Option{WithMaxEncodedBytes(20)}, limit: 20},
+	} {
+		var readErr error
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, readErr = ioutil.ReadAll(r.Body)
+		})
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.ContentLength = -1
+		req.Header.Set("Content-Encoding", "gzip")
+		New(inner, tt.opts...).ServeHTTP(httptest.NewRecorder(), req)
+
+		if !errors.Is(readErr, ErrLimitExceeded) {
+			t.Fatalf("%s: unexpected read error: got %v want %v", tt.name, readErr, ErrLimitExceeded)
+		}
+
+		var mbe *http.MaxBytesError
+		if !errors.As(readErr, &mbe) {
+			t.Fatalf("%s: read error %v is not an *http.MaxBytesError", tt.name, readErr)
+		}
+
+		if mbe.Limit != tt.limit {
+			t.Fatalf("%s: wrong limit: got %d want %d", tt.name, mbe.Limit, tt.limit)
+		}
+	}
+}
+
+func TestChannelSink(t *testing.T) {
+	want := strings.Repeat("hello, world\n", 1000)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(want))
+	zw.Close()
+
+	// Each request gets its own channel, drained by its own goroutine.
+	var got bytes.Buffer
+	var chunks int
+	done := make(chan struct{})
+	sink := func(r *http.Request) chan<- []byte {
+		ch := make(chan []byte, 1)
+		go func() {
+			defer close(done)
+			for p := range ch {
+				got.Write(p)
+				chunks++
+			}
+		}()
+
+		return ch
+	}
+
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n, _ := ioutil.ReadAll(r.Body); len(n) != 0 {
+			t.Fatalf("handler got %d bytes of body, want none", len(n))
+		}
+	}), WithChannelSink(sink, 1024))
+
+	req := httptest.NewRequest("POST", "/test", &buf)
+	req.Header.Set("Content-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	<-done
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	if got.String() != want {
+		t.Fatalf("channel got %d bytes, want %d", got.Len(), len(want))
+	}
+
+	if wantChunks := (len(want) + 1023) / 1024; chunks != wantChunks {
+		t.Fatalf("channel got %d chunks, want %d", chunks, wantChunks)
+	}
+}
+
+func TestCloseBody(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		body []byte
+		ok   bool
+	}{
+		{body: buf, ok: true},
+		{body: buf[:len(buf)-8], ok: false}, // Without the gzip trailer.
+	} {
+		var closeErr error
+		handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			closeErr = CloseBody(r)
+		}))
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", "gzip")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if tt.ok {
+			if closeErr != nil {
+				t.Fatalf("CloseBody returned unexpected error: %v", closeErr)
+			}
+
+			continue
+		}
+
+		if _, ok := closeErr.(*DecompressionError); !ok {
+			t.Fatalf("CloseBody returned %v, want a *DecompressionError", closeErr)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package unpack
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errBreakerOpen is returned for requests from clients whose bodies failed
+// to decode too often, see WithDecodeBreaker.
+var errBreakerOpen = errors.New("unpack: too many undecodable request bodies from client")
+
+// breakerError is the error for requests which a breaker short-circuits.
+type breakerError struct {
+	// retry is how long until the breaker lets requests through again.
+	retry time.Duration
+}
+
+func (e *breakerError) Error() string {
+	return errBreakerOpen.Error()
+}
+
+func (e *breakerError) Is(target error) bool {
+	return target == errBreakerOpen
+}
+
+// minBreakerSweep is the number of keys a breaker tracks before it first
+// sweeps out those which are no longer of interest.
+const minBreakerSweep = 1024
+
+// A breaker counts the decode failures of requests by key and trips for
+// keys with too many of them, see WithDecodeBreaker.
+type breaker struct {
+	key       func(*http.Request) string
+	threshold int
+	window    time.Duration
+	now       func() time.Time // For tests.
+
+	mu      sync.Mutex
+	keys    map[string]*breakerState
+	sweepAt int
+}
+
+// breakerState is the state of a breaker for a key.
+type breakerState struct {
+	start     time.Time // Start of the window failures are counted in.
+	failures  int
+	openUntil time.Time // Until when requests are short-circuited.
+}
+
+func newBreaker(key func(*http.Request) string, threshold int, window time.Duration) *breaker {
+	if key == nil {
+		key = clientAddr
+	}
+
+	return &breaker{
+		key:       key,
+		threshold: threshold,
+		window:    window,
+		now:       time.Now,
+		keys:      map[string]*breakerState{},
+		sweepAt:   minBreakerSweep,
+	}
+}
+
+// clientAddr returns the IP address of the client which sent r.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// allow returns nil if the body of r may be decoded, or a *breakerError if
+// the breaker is open for the key of r.
+func (b *breaker) allow(r *http.Request) error {
+	key := b.key(r)
+	if key == "" {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.keys[key]
+	if !ok {
+		return nil
+	}
+
+	if now := b.now(); now.Before(s.openUntil) {
+		return &breakerError{retry: s.openUntil.Sub(now)}
+	}
+
+	return nil
+}
+
+// failed counts a decode failure for the key of r, tripping the breaker
+// for it if that makes too many within the window.
+func (b *breaker) failed(r *http.Request) {
+	key := b.key(r)
+	if key == "" {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	s, ok := b.keys[key]
+	if !ok {
+		if len(b.keys) >= b.sweepAt {
+			b.sweep(now)
+		}
+
+		s = &breakerState{start: now}
+		b.keys[key] = s
+	}
+
+	if now.Sub(s.start) > b.window {
+		s.start, s.failures = now, 0
+	}
+
+	s.failures++
+	if s.failures >= b.threshold {
+		s.openUntil = now.Add(b.window)
+		s.start, s.failures = now, 0
+	}
+}
+
+// sweep forgets the keys whose failures are too old to count and whose
+// breaker is not open, so that clients cannot make b grow at will.
+func (b *breaker) sweep(now time.Time) {
+	for key, s := range b.keys {
+		if now.Sub(s.start) > b.window && !now.Before(s.openUntil) {
+			delete(b.keys, key)
+		}
+	}
+
+	b.sweepAt = 2 * len(b.keys)
+	if b.sweepAt < minBreakerSweep {
+		b.sweepAt = minBreakerSweep
+	}
+}
+
+// done counts the failure of a body which a Handler passed on, if it was
+// one, see WithOnDone.
+func (b *breaker) done(r *http.Request, s Stats) {
+	if s.Err != nil && ClassifyError(s.Err) == ClassMalformed {
+		b.failed(r)
+	}
+}
+
+// rejected counts the failure of a request which a Handler rejected, if
+// it was a decode failure, see WithOnError.
+func (b *breaker) rejected(r *http.Request, info ErrorInfo) {
+	if info.Class == ClassMalformed {
+		b.failed(r)
+	}
+}
@@ -0,0 +1,116 @@
+package unpack
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDecodeBreaker(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	handler := New(errorBodyWriter{}, WithDecodeBreaker(nil, 2, time.Minute))
+	handler.breaker.now = func() time.Time { return now }
+
+	for i, tt := range []struct {
+		client   string
+		body     []byte
+		encoding string
+		wait     time.Duration
+		code     int
+		retry    string
+	}{
+		{client: "192.0.2.1:1234", body: []byte("hello"), encoding: "gzip", code: http.StatusBadRequest},
+		{client: "192.0.2.1:1234", body: buf, encoding: "gzip", code: http.StatusOK},
+		{client: "192.0.2.1:1235", body: []byte("hello"), encoding: "gzip", code: http.StatusBadRequest},
+		{client: "192.0.2.1:1234", body: buf, encoding: "gzip", code: http.StatusTooManyRequests, retry: "60"},
+		{client: "192.0.2.1:1234", body: []byte("hello"), code: http.StatusOK},
+		{client: "192.0.2.2:1234", body: buf, encoding: "gzip", code: http.StatusOK},
+		{client: "192.0.2.1:1234", body: buf, encoding: "gzip", wait: 30 * time.Second, code: http.StatusTooManyRequests, retry: "30"},
+		{client: "192.0.2.1:1234", body: buf, encoding: "gzip", wait: 30 * time.Second, code: http.StatusOK},
+	} {
+		now = now.Add(tt.wait)
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.RemoteAddr = tt.client
+		if tt.encoding != "" {
+			req.Header.Set("Content-Encoding", tt.encoding)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%d: handler returned wrong status code: got %v want %v", i, rr.Code, tt.code)
+		}
+
+		if retry := rr.Result().Header.Get("Retry-After"); retry != tt.retry {
+			t.Fatalf("%d: wrong Retry-After: got %q want %q", i, retry, tt.retry)
+		}
+	}
+}
+
+func TestDecodeBreakerOff(t *testing.T) {
+	plain := New(errorBodyWriter{})
+	for _, tt := range []struct {
+		opts  []Option
+		hooks int // Hooks added to those of a plain Handler.
+	}{
+		{opts: []Option{WithDecodeBreaker(nil, 1, time.Minute)}, hooks: 1},
+		{opts: []Option{WithDecodeBreaker(nil, 1, time.Minute), WithDecodeBreaker(nil, 0, time.Minute)}},
+		{opts: []Option{WithDecodeBreaker(nil, 1, time.Minute), WithDecodeBreaker(nil, 1, 0)}},
+		{opts: []Option{WithDecodeBreaker(nil, 1, time.Minute), WithDecodeBreaker(nil, 2, time.Minute)}, hooks: 1},
+	} {
+		handler := New(errorBodyWriter{}, tt.opts...)
+		if got, want := len(handler.onDone), len(plain.onDone)+tt.hooks; got != want {
+			t.Fatalf("%d options: got %d done hooks want %d", len(tt.opts), got, want)
+		}
+
+		if got, want := len(handler.onError), len(plain.onError)+tt.hooks; got != want {
+			t.Fatalf("%d options: got %d error hooks want %d", len(tt.opts), got, want)
+		}
+
+		if (handler.breaker != nil) != (tt.hooks > 0) {
+			t.Fatalf("%d options: got breaker %v", len(tt.opts), handler.breaker)
+		}
+
+		if tt.hooks > 0 {
+			continue
+		}
+
+		for i := 0; i < 3; i++ {
+			req := httptest.NewRequest("POST", "/test", bytes.NewBufferString("hello"))
+			req.Header.Set("Content-Encoding", "gzip")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("%d options, request %d: handler returned wrong status code: got %v want %v", len(tt.opts), i, rr.Code, http.StatusBadRequest)
+			}
+		}
+	}
+}
+
+func TestBreakerSweep(t *testing.T) {
+	now := time.Now()
+	b := newBreaker(func(r *http.Request) string { return r.RemoteAddr }, 1, time.Minute)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < minBreakerSweep; i++ {
+		b.failed(&http.Request{RemoteAddr: fmt.Sprint(i)})
+	}
+
+	now = now.Add(2 * time.Minute)
+	b.failed(&http.Request{RemoteAddr: "new"})
+
+	if len(b.keys) != 1 {
+		t.Fatalf("want 1 key after sweeping, got %d", len(b.keys))
+	}
+}
@@ -0,0 +1,45 @@
+package unpack
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+)
+
+// maxCaptureBytes is the largest prefix of a body which is captured, see
+// WithFailureCapture.
+const maxCaptureBytes = 4 << 10
+
+// prefixReader keeps a copy of the first max bytes read from r.
+type prefixReader struct {
+	r   io.Reader
+	buf []byte
+	max int
+}
+
+func (pr *prefixReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if keep := pr.max - len(pr.buf); keep > 0 {
+		if keep > n {
+			keep = n
+		}
+
+		pr.buf = append(pr.buf, p[:keep]...)
+	}
+
+	return n, err
+}
+
+// capturePrefix returns a reader of src, the encoded data of b, the body of
+// r, which keeps its first bytes so that they can be passed to the capture
+// function of h should b turn out to be corrupt, see WithFailureCapture.
+func (h *Handler) capturePrefix(r *http.Request, b *body, src io.Reader) io.Reader {
+	pr := &prefixReader{r: src, max: h.captureBytes}
+	b.failed = func(err error) {
+		if ClassifyError(err) == ClassMalformed {
+			h.capture(r, err, hex.EncodeToString(pr.buf))
+		}
+	}
+
+	return pr
+}
@@ -0,0 +1,60 @@
+package unpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFailureCapture(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		body   []byte
+		n      int
+		opts   []Option
+		called bool
+		prefix string
+	}{
+		{name: "ok", body: buf, n: 16},
+		{name: "corrupt", body: []byte("hello"), n: 16, called: true, prefix: "68656c6c6f"},
+		{name: "capped", body: []byte("hello"), n: 3, called: true, prefix: "68656c"},
+		{name: "truncated", body: buf[:len(buf)-4], n: 4, called: true, prefix: hex.EncodeToString(buf[:4])},
+		{name: "lazy", body: []byte("hello"), n: 16, opts: []Option{WithLazyDecoding(true)}, called: true, prefix: "68656c6c6f"},
+		{name: "too large", body: buf, n: 16, opts: []Option{WithMaxDecodedBytes(1)}},
+	} {
+		var called bool
+		var prefix string
+		opts := append([]Option{WithFailureCapture(tt.n, func(r *http.Request, err error, p string) {
+			if called {
+				t.Fatalf("%s: capture called twice", tt.name)
+			}
+
+			called, prefix = true, p
+		})}, tt.opts...)
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, opts...).ServeHTTP(rr, req)
+
+		if called != tt.called {
+			t.Fatalf("%s: capture called: got %v want %v", tt.name, called, tt.called)
+		}
+
+		if prefix != tt.prefix {
+			t.Fatalf("%s: wrong prefix: got %q want %q", tt.name, prefix, tt.prefix)
+		}
+
+		if bytes.Contains(rr.Body.Bytes(), []byte(tt.prefix)) && tt.prefix != "" {
+			t.Fatalf("%s: prefix leaked into the response: %q", tt.name, rr.Body.String())
+		}
+	}
+}
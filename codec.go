@@ -0,0 +1,94 @@
+package unpack
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// A Codec decodes request bodies in a content coding. Codecs are used for
+// many requests at once, so they have to be safe for concurrent use.
+type Codec interface {
+	// NewReader returns a reader of the decoded data of body, which is the
+	// body of r in the coding of the Codec, or an error if it cannot be
+	// decoded. The reader is closed once the body has been read or the
+	// handler is done with the request. Errors returned by NewReader and
+	// by the reader are wrapped in a *DecompressionError, and so are
+	// panics of theirs, which fail the body like corrupt data does.
+	NewReader(r *http.Request, body io.Reader) (io.ReadCloser, error)
+}
+
+// CodecFunc adapts a function to a Codec.
+type CodecFunc func(r *http.Request, body io.Reader) (io.ReadCloser, error)
+
+// NewReader calls f(r, body).
+func (f CodecFunc) NewReader(r *http.Request, body io.Reader) (io.ReadCloser, error) {
+	return f(r, body)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Codec{}
+)
+
+// RegisterCodec makes all Handlers created afterwards decode bodies in the
+// content coding name with c, e.g. for proprietary codings, or replaces the
+// built-in codec for name. Names are case-insensitive. RegisterCodec is
+// meant to be called from init functions. WithCodec adds or replaces a
+// codec for a single Handler instead.
+func RegisterCodec(name string, c Codec) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[strings.ToLower(name)] = c
+}
+
+// newCodecs returns the codecs of h, which are the built-in ones its
+// options enable, then those registered with RegisterCodec and finally
+// those set with WithCodec, each replacing any codec of the same name
+// before it.
+func (h *Handler) newCodecs() map[string]Codec {
+	codecs := make(map[string]Codec, len(decoders)+len(h.extraCodecs))
+	for name, dec := range decoders {
+		if h.enables(name) {
+			dec := dec
+			codecs[name] = CodecFunc(func(r *http.Request, body io.Reader) (io.ReadCloser, error) {
+				return dec(h, r, body)
+			})
+		}
+	}
+
+	registryMu.RLock()
+	for name, c := range registry {
+		codecs[name] = c
+	}
+	registryMu.RUnlock()
+
+	for name, c := range h.extraCodecs {
+		codecs[name] = c
+	}
+
+	return codecs
+}
+
+// enables reports whether the options of h enable the built-in codec for
+// the given coding. Codecs which need configuration or a lot of memory, or
+// which decode codings that are not registered, are opt-in.
+func (h *Handler) enables(coding string) bool {
+	switch coding {
+	case EncodingXZ:
+		return h.xzDictMax > 0
+	case EncodingCompress:
+		return !h.noCompress
+	case EncodingAES128GCM:
+		return h.aesgcmKeys != nil
+	case EncodingDCZ:
+		return h.dictionaries != nil
+	case EncodingDCB:
+		return h.dictionaries != nil && h.dcbDecode != nil
+	case EncodingBase64:
+		return h.base64
+	}
+
+	return true
+}
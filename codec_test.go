@@ -0,0 +1,122 @@
+package unpack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// rot13 is a Codec for a made up coding which rotates letters by 13.
+var rot13 = CodecFunc(func(r *http.Request, body io.Reader) (io.ReadCloser, error) {
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(bytes.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z':
+			return 'a' + (c-'a'+13)%26
+		case c >= 'A' && c <= 'Z':
+			return 'A' + (c-'A'+13)%26
+		}
+
+		return c
+	}, buf))), nil
+})
+
+// identityCodec is a Codec which passes bodies on as they are.
+var identityCodec = CodecFunc(func(r *http.Request, body io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(body), nil
+})
+
+func TestCodecs(t *testing.T) {
+	RegisterCodec("ROT13", rot13)
+	defer func() {
+		registryMu.Lock()
+		delete(registry, "rot13")
+		registryMu.Unlock()
+	}()
+
+	gz, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		body     string
+		encoding string
+		opts     []Option
+		content  string
+	}{
+		{name: "registered", body: "uryyb", encoding: "rot13", content: "hello"},
+		{name: "chained", body: string(gz), encoding: "rot13, gzip", content: "uryyb"},
+		{name: "per handler", body: "uryyb", encoding: "Rot-13", opts: []Option{WithCodec("rot-13", rot13)}, content: "hello"},
+		{name: "replaced", body: "hello", encoding: "gzip", opts: []Option{WithCodec(EncodingGzip, identityCodec)}, content: "hello"},
+		{name: "not allowed", body: "uryyb", encoding: "rot13", opts: []Option{WithAllowedEncodings(EncodingGzip)}, content: "uryyb"},
+	} {
+		req := httptest.NewRequest("POST", "/test", strings.NewReader(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, tt.opts...).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, http.StatusOK)
+		}
+
+		if body := rr.Body.String(); body != tt.content {
+			t.Fatalf("%s: handler returned unexpected body: got '%v' want '%v'", tt.name, body, tt.content)
+		}
+	}
+}
+
+// panicReader panics when read, like a buggy decoder fed crafted data.
+type panicReader struct{}
+
+func (panicReader) Read(p []byte) (int, error) {
+	panic("index out of range")
+}
+
+func TestDecoderPanic(t *testing.T) {
+	panicky := CodecFunc(func(r *http.Request, body io.Reader) (io.ReadCloser, error) {
+		panic("index out of range")
+	})
+
+	panickyReader := CodecFunc(func(r *http.Request, body io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(panicReader{}), nil
+	})
+
+	for _, tt := range []struct {
+		name string
+		opts []Option
+	}{
+		{name: "NewReader", opts: []Option{WithCodec("boom", panicky)}},
+		{name: "Read", opts: []Option{WithCodec("boom", panickyReader)}},
+		{name: "lazy NewReader", opts: []Option{WithCodec("boom", panicky), WithLazyDecoding(true)}},
+		{name: "buffered Read", opts: []Option{WithCodec("boom", panickyReader), WithBuffering(1 << 10)}},
+	} {
+		var info ErrorInfo
+		opts := append([]Option{WithOnError(func(r *http.Request, i ErrorInfo) {
+			info = i
+		})}, tt.opts...)
+
+		req := httptest.NewRequest("POST", "/test", strings.NewReader("hello"))
+		req.Header.Set("Content-Encoding", "boom")
+		rr := httptest.NewRecorder()
+		New(errorBodyWriter{}, opts...).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, http.StatusBadRequest)
+		}
+
+		if !errors.Is(info.Err, errDecoderPanic) || !errors.Is(info.Err, ErrMalformedBody) {
+			t.Fatalf("%s: unexpected error: %v", tt.name, info.Err)
+		}
+	}
+}
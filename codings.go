@@ -0,0 +1,137 @@
+package unpack
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Canonical names of the content codings known to this package, for use
+// with options such as WithAllowedEncodings. Options accept any string,
+// so these are a convenience to avoid typos rather than a requirement.
+const (
+	EncodingIdentity   = "identity"
+	EncodingGzip       = "gzip"
+	EncodingDeflate    = "deflate"
+	EncodingDeflateRaw = "deflate-raw"
+	EncodingBrotli     = "br"
+	EncodingLZ4        = "lz4"
+	EncodingSnappy     = "snappy"
+	EncodingBzip2      = "bzip2"
+	EncodingZstd       = "zstd"
+	EncodingXZ         = "xz"
+	EncodingCompress   = "compress"
+	EncodingAWSChunked = "aws-chunked"
+	EncodingAES128GCM  = "aes128gcm"
+	EncodingDCZ        = "dcz"
+	EncodingDCB        = "dcb"
+	EncodingBase64     = "base64"
+)
+
+// codingAliases maps the aliases of content codings which RFC 9110 section
+// 8.4.1 requires recipients to accept to their canonical names.
+var codingAliases = map[string]string{
+	"x-gzip":     EncodingGzip,
+	"x-compress": EncodingCompress,
+}
+
+// ErrInvalidCoding is returned by ParseCodings for Content-Encoding header
+// values with an element which is not a valid content coding name.
+var ErrInvalidCoding = errors.New("unpack: invalid content coding")
+
+// A Coding is a content coding listed in a Content-Encoding header.
+type Coding struct {
+	// Name is the canonical name of the coding, lowercased and with
+	// aliases such as x-gzip replaced, e.g. "gzip".
+	Name string
+
+	// Raw is the list element which named the coding, as it was sent
+	// but without surrounding whitespace.
+	Raw string
+}
+
+// ParseCodings parses a Content-Encoding header value into the content
+// codings it lists, in the order they were applied, exactly like a
+// Handler does. The value is a comma-separated list (RFC 9110 section
+// 5.6.1) whose empty elements and surrounding whitespace are ignored.
+// Coding names are case-insensitive, and identity codings, which are
+// no-ops, are dropped. If an element is not a valid token, ParseCodings
+// returns an error wrapping ErrInvalidCoding, along with the codings as a
+// Handler reads them: it strips bytes which cannot be part of a token,
+// such as a UTF-8 byte order mark, from both ends of each element. A
+// Handler parses the values of all Content-Encoding header lines of a
+// request, joined by commas.
+func ParseCodings(header string) ([]Coding, error) {
+	var codings []Coding
+	var err error
+	for _, element := range strings.Split(header, ",") {
+		raw := strings.Trim(element, " \t")
+		if err == nil && raw != "" && !isToken(raw) {
+			err = fmt.Errorf("%w: %q", ErrInvalidCoding, raw)
+		}
+
+		name := strings.ToLower(trimToken(raw))
+		if name == "" || name == EncodingIdentity {
+			continue
+		}
+
+		if alias, ok := codingAliases[name]; ok {
+			name = alias
+		}
+
+		codings = append(codings, Coding{Name: name, Raw: raw})
+	}
+
+	return codings, err
+}
+
+// parseCodings returns the names of the codings ParseCodings finds in
+// header, ignoring any error.
+func parseCodings(header string) []string {
+	parsed, _ := ParseCodings(header)
+	var codings []string
+	for _, c := range parsed {
+		codings = append(codings, c.Name)
+	}
+
+	return codings
+}
+
+// trimToken strips all bytes which cannot be part of a token, as defined
+// by RFC 9110 section 5.6.2, from both ends of s. Besides whitespace this
+// removes control characters and any non-ASCII bytes, such as a UTF-8
+// byte order mark, which clients or header libraries sometimes inject.
+// Bytes in the middle of s are left alone.
+func trimToken(s string) string {
+	start, end := 0, len(s)
+	for start < end && !isTokenByte(s[start]) {
+		start++
+	}
+
+	for end > start && !isTokenByte(s[end-1]) {
+		end--
+	}
+
+	return s[start:end]
+}
+
+// isToken reports whether s is a token as defined by RFC 9110.
+func isToken(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isTokenByte(s[i]) {
+			return false
+		}
+	}
+
+	return s != ""
+}
+
+// isTokenByte reports whether c is a tchar as defined by RFC 9110.
+func isTokenByte(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
@@ -0,0 +1,49 @@
+package unpack
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var parseCodingsTests = []struct {
+	header  string
+	codings []string
+	invalid bool
+}{
+	{header: "", codings: nil},
+	{header: "gzip", codings: []string{"gzip"}},
+	{header: "\tgzip", codings: []string{"gzip"}},
+	{header: "\xef\xbb\xbfgzip", codings: []string{"gzip"}, invalid: true},
+	{header: " gzip\r\n", codings: []string{"gzip"}, invalid: true},
+	{header: "\x00gzip,\tDeflate ", codings: []string{"gzip", "deflate"}, invalid: true},
+	{header: "g zip", codings: []string{"g zip"}, invalid: true},
+	{header: "identity, x-gzip", codings: []string{"gzip"}},
+	{header: "X-Compress, x-gzip", codings: []string{"compress", "gzip"}},
+	{header: "gzip, identity", codings: []string{"gzip"}},
+	{header: "identity", codings: nil},
+	{header: "gzip,, ,deflate", codings: []string{"gzip", "deflate"}},
+	{header: "gzip;q=1", codings: []string{"gzip;q=1"}, invalid: true},
+}
+
+func TestParseCodings(t *testing.T) {
+	for _, tt := range parseCodingsTests {
+		if codings := parseCodings(tt.header); !reflect.DeepEqual(codings, tt.codings) {
+			t.Fatalf("parseCodings(%q): got %q want %q", tt.header, codings, tt.codings)
+		}
+
+		parsed, err := ParseCodings(tt.header)
+		if invalid := errors.Is(err, ErrInvalidCoding); invalid != tt.invalid {
+			t.Fatalf("ParseCodings(%q): got error %v, want invalid %v", tt.header, err, tt.invalid)
+		}
+
+		var codings []string
+		for _, c := range parsed {
+			codings = append(codings, c.Name)
+		}
+
+		if !reflect.DeepEqual(codings, tt.codings) {
+			t.Fatalf("ParseCodings(%q): got %q want %q", tt.header, codings, tt.codings)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package unpack
+
+import (
+	"errors"
+	"io"
+)
+
+// The compress format, as written by the Unix compress tool, is LZW with
+// codes of 9 up to 16 bits, packed least significant bit first in groups
+// of eight codes. Whenever the code width changes, the rest of the current
+// group is padding. The decoder matches ncompress and gzip, see
+// https://github.com/vapier/ncompress.
+const (
+	lzwMagic   = "\x1f\x9d"
+	lzwClear   = 256 // Clears the table in block mode.
+	lzwMinBits = 9
+	lzwMaxBits = 16
+	lzwChunk   = 32 << 10 // Decoded bytes returned at most per read.
+)
+
+var (
+	errLZWHeader  = errors.New("compress: invalid header")
+	errLZWCorrupt = errors.New("compress: corrupt data")
+)
+
+// lzwReader decodes data in the compress format. Its table takes 192KB
+// for the largest code width.
+type lzwReader struct {
+	r   io.Reader
+	err error
+
+	maxCode int  // Number of table entries.
+	maxBits uint // Largest code width.
+	block   bool // Whether lzwClear clears the table.
+
+	width uint // Current code width.
+	limit int  // Code width grows once the table grows past this.
+	free  int  // Next table entry.
+	prev  int  // Previous code, or -1 at the start and after a clear.
+	first byte // First byte of the string of the previous code.
+
+	prefix []uint16
+	suffix []byte
+	stack  []byte
+	dec    []byte // Decoded data.
+	out    []byte // What is left to return of dec.
+
+	buf   [lzwMaxBits]byte
+	group []byte // Current group of codes, as read.
+	bit   uint   // Number of bits of group already read.
+}
+
+func newLZWReader(r io.Reader) (*lzwReader, error) {
+	var hdr [3]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, unexpected(err)
+	}
+
+	maxBits := uint(hdr[2] & 0x1f)
+	if string(hdr[:2]) != lzwMagic || maxBits < lzwMinBits || maxBits > lzwMaxBits {
+		return nil, errLZWHeader
+	}
+
+	z := &lzwReader{
+		r:       r,
+		maxCode: 1 << maxBits,
+		maxBits: maxBits,
+		block:   hdr[2]&0x80 != 0,
+		prefix:  make([]uint16, 1<<maxBits),
+		suffix:  make([]byte, 1<<maxBits),
+	}
+
+	z.reset()
+	return z, nil
+}
+
+// reset starts over with an empty table, as at the start of the data.
+func (z *lzwReader) reset() {
+	z.group = nil
+	z.width = lzwMinBits
+	z.limit = 1<<lzwMinBits - 1
+	z.free = 256
+	if z.block {
+		z.free = lzwClear + 1
+	}
+
+	z.prev = -1
+}
+
+func (z *lzwReader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+
+		z.err = z.next()
+	}
+
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+	return n, nil
+}
+
+// next decodes codes until it has at least lzwChunk bytes of decoded data
+// or the data ends, returning io.EOF in the latter case.
+func (z *lzwReader) next() error {
+	z.dec = z.dec[:0]
+	defer func() { z.out = z.dec }()
+
+	for len(z.dec) < lzwChunk {
+		code, err := z.readCode()
+		if err != nil {
+			return err
+		}
+
+		if z.prev < 0 {
+			if code >= 256 {
+				return errLZWCorrupt
+			}
+
+			z.dec = append(z.dec, byte(code))
+			z.prev = code
+			z.first = byte(code)
+			continue
+		}
+
+		if code == lzwClear && z.block {
+			z.reset()
+			continue
+		}
+
+		in := code
+		z.stack = z.stack[:0]
+
+		// A code may refer to the entry which it adds itself, whose string
+		// is that of the previous code followed by its first byte.
+		if code >= z.free {
+			if code > z.free {
+				return errLZWCorrupt
+			}
+
+			z.stack = append(z.stack, z.first)
+			code = z.prev
+		}
+
+		for code >= 256 {
+			z.stack = append(z.stack, z.suffix[code])
+			code = int(z.prefix[code])
+		}
+
+		z.first = byte(code)
+		z.stack = append(z.stack, z.first)
+		for i := len(z.stack) - 1; i >= 0; i-- {
+			z.dec = append(z.dec, z.stack[i])
+		}
+
+		if z.free < z.maxCode {
+			z.prefix[z.free] = uint16(z.prev)
+			z.suffix[z.free] = z.first
+			z.free++
+		}
+
+		z.prev = in
+	}
+
+	return nil
+}
+
+// readCode reads the next code, returning io.EOF once there are not enough
+// bits left for one.
+func (z *lzwReader) readCode() (int, error) {
+	if z.free > z.limit {
+		// The rest of the group is padding. As in ncompress, 9 bit data
+		// still grows to 10 bits once, since the width starts out below
+		// the largest one as far as growing is concerned.
+		z.group = nil
+		z.width++
+		z.limit = 1<<z.width - 1
+		if z.width == z.maxBits {
+			z.limit = z.maxCode
+		}
+	}
+
+	if z.bit+z.width > uint(len(z.group))*8 {
+		n, err := io.ReadFull(z.r, z.buf[:z.width])
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+
+		// The last group may be short, with bits left over which are
+		// not enough for a code.
+		z.group = z.buf[:n]
+		z.bit = 0
+		if uint(n)*8 < z.width {
+			return 0, io.EOF
+		}
+	}
+
+	var v uint32
+	for i, pos := uint(0), z.bit/8; i < 3 && int(pos+i) < len(z.group); i++ {
+		v |= uint32(z.group[pos+i]) << (8 * i)
+	}
+
+	code := int(v >> (z.bit % 8) & (1<<z.width - 1))
+	z.bit += z.width
+	return code, nil
+}
@@ -0,0 +1,62 @@
+package unpack
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestLZWReader(t *testing.T) {
+	// The files were written with 9 and 16 bit codes, so decoding them
+	// covers code width changes as well as clearing the table.
+	var want bytes.Buffer
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&want, "%d %x ", i*i%9973, i)
+	}
+
+	for _, file := range []string{"testdata/squares-9.Z", "testdata/squares-16.Z"} {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		zr, err := newLZWReader(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", file, err)
+		}
+
+		got, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", file, err)
+		}
+
+		if !bytes.Equal(got, want.Bytes()) {
+			t.Fatalf("%s: decoded %d bytes which differ from the %d expected", file, len(got), want.Len())
+		}
+	}
+}
+
+func TestLZWReaderCorrupt(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		data string
+		err  error
+	}{
+		{name: "magic", data: "\x1f\x8b\x90hello", err: errLZWHeader},
+		{name: "max bits", data: "\x1f\x9d\x91hello", err: errLZWHeader},
+		// The first code, 0x1ff, is not a literal.
+		{name: "first code", data: "\x1f\x9d\x90\xff\x01", err: errLZWCorrupt},
+		// 'h' followed by 0x102, which is past the next table entry.
+		{name: "future code", data: "\x1f\x9d\x90\x68\x04\x02", err: errLZWCorrupt},
+	} {
+		zr, err := newLZWReader(bytes.NewReader([]byte(tt.data)))
+		if err == nil {
+			_, err = ioutil.ReadAll(zr)
+		}
+
+		if err != tt.err {
+			t.Fatalf("%s: got error %v want %v", tt.name, err, tt.err)
+		}
+	}
+}
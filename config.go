@@ -0,0 +1,262 @@
+package unpack
+
+import (
+	"encoding"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings of a Handler which can be written down, e.g.
+// in a JSON or YAML file or in environment variables, see LoadEnv. Each
+// field stands for the option of the same name, see FromConfig. Options
+// which take functions or other values which cannot be written down, such
+// as WithErrorHandler, have no field.
+type Config struct {
+	Methods                []string          `json:"methods,omitempty" yaml:"methods,omitempty"`
+	PathPrefixes           []string          `json:"path_prefixes,omitempty" yaml:"path_prefixes,omitempty"`
+	SetVaryOnDecode        bool              `json:"set_vary_on_decode,omitempty" yaml:"set_vary_on_decode,omitempty"`
+	MaxDecodedBytes        int64             `json:"max_decoded_bytes,omitempty" yaml:"max_decoded_bytes,omitempty"`
+	LimitsFor              map[string]int64  `json:"limits_for,omitempty" yaml:"limits_for,omitempty"`
+	MaxEncodedBytes        int64             `json:"max_encoded_bytes,omitempty" yaml:"max_encoded_bytes,omitempty"`
+	MaxRatio               float64           `json:"max_ratio,omitempty" yaml:"max_ratio,omitempty"`
+	DecodeTimeout          Duration          `json:"decode_timeout,omitempty" yaml:"decode_timeout,omitempty"`
+	DecodeContentTypes     []string          `json:"decode_content_types,omitempty" yaml:"decode_content_types,omitempty"`
+	SkipContentTypes       []string          `json:"skip_content_types,omitempty" yaml:"skip_content_types,omitempty"`
+	DecodeFallbacks        []string          `json:"decode_fallbacks,omitempty" yaml:"decode_fallbacks,omitempty"`
+	AllowedEncodings       []string          `json:"allowed_encodings,omitempty" yaml:"allowed_encodings,omitempty"`
+	DeniedEncodings        []string          `json:"denied_encodings,omitempty" yaml:"denied_encodings,omitempty"`
+	ProblemDetails         bool              `json:"problem_details,omitempty" yaml:"problem_details,omitempty"`
+	EncodingsDocument      bool              `json:"encodings_document,omitempty" yaml:"encodings_document,omitempty"`
+	Expvar                 string            `json:"expvar,omitempty" yaml:"expvar,omitempty"`
+	HeaderMode             HeaderMode        `json:"header_mode,omitempty" yaml:"header_mode,omitempty"`
+	Buffering              int64             `json:"buffering,omitempty" yaml:"buffering,omitempty"`
+	SpillThreshold         int64             `json:"spill_threshold,omitempty" yaml:"spill_threshold,omitempty"`
+	SpillDir               string            `json:"spill_dir,omitempty" yaml:"spill_dir,omitempty"`
+	LazyDecoding           bool              `json:"lazy_decoding,omitempty" yaml:"lazy_decoding,omitempty"`
+	ValidateOnly           bool              `json:"validate_only,omitempty" yaml:"validate_only,omitempty"`
+	FailOpen               bool              `json:"fail_open,omitempty" yaml:"fail_open,omitempty"`
+	UnknownEncodingWarning bool              `json:"unknown_encoding_warning,omitempty" yaml:"unknown_encoding_warning,omitempty"`
+	VerifyChecksum         bool              `json:"verify_checksum,omitempty" yaml:"verify_checksum,omitempty"`
+	DecodedSizeHeader      string            `json:"decoded_size_header,omitempty" yaml:"decoded_size_header,omitempty"`
+	ServerTiming           bool              `json:"server_timing,omitempty" yaml:"server_timing,omitempty"`
+	DebugHeaders           bool              `json:"debug_headers,omitempty" yaml:"debug_headers,omitempty"`
+	DebugCounters          bool              `json:"debug_counters,omitempty" yaml:"debug_counters,omitempty"`
+	PprofLabels            bool              `json:"pprof_labels,omitempty" yaml:"pprof_labels,omitempty"`
+	DecodeBreakerThreshold int               `json:"decode_breaker_threshold,omitempty" yaml:"decode_breaker_threshold,omitempty"`
+	DecodeBreakerWindow    Duration          `json:"decode_breaker_window,omitempty" yaml:"decode_breaker_window,omitempty"`
+	GzipMaxMembers         int               `json:"gzip_max_members,omitempty" yaml:"gzip_max_members,omitempty"`
+	MaxCodings             int               `json:"max_codings,omitempty" yaml:"max_codings,omitempty"`
+	StrictContentEncoding  bool              `json:"strict_content_encoding,omitempty" yaml:"strict_content_encoding,omitempty"`
+	Sniffing               bool              `json:"sniffing,omitempty" yaml:"sniffing,omitempty"`
+	MismatchMode           MismatchMode      `json:"mismatch_mode,omitempty" yaml:"mismatch_mode,omitempty"`
+	DoubleGzip             bool              `json:"double_gzip,omitempty" yaml:"double_gzip,omitempty"`
+	RejectTrailingData     bool              `json:"reject_trailing_data,omitempty" yaml:"reject_trailing_data,omitempty"`
+	StrictDeflateZlibOnly  bool              `json:"strict_deflate_zlib_only,omitempty" yaml:"strict_deflate_zlib_only,omitempty"`
+	ZlibDictionary         []byte            `json:"zlib_dictionary,omitempty" yaml:"zlib_dictionary,omitempty"`
+	MaxInflightBytes       int64             `json:"max_inflight_bytes,omitempty" yaml:"max_inflight_bytes,omitempty"`
+	RetryAfter             Duration          `json:"retry_after,omitempty" yaml:"retry_after,omitempty"`
+	XZ                     int64             `json:"xz,omitempty" yaml:"xz,omitempty"`
+	NoLegacyCompress       bool              `json:"no_legacy_compress,omitempty" yaml:"no_legacy_compress,omitempty"`
+	ZstdDictionaries       map[string][]byte `json:"zstd_dictionaries,omitempty" yaml:"zstd_dictionaries,omitempty"`
+	ZstdDictionaryHeader   string            `json:"zstd_dictionary_header,omitempty" yaml:"zstd_dictionary_header,omitempty"`
+	Base64                 bool              `json:"base64,omitempty" yaml:"base64,omitempty"`
+	SnappyBlockFormat      int64             `json:"snappy_block_format,omitempty" yaml:"snappy_block_format,omitempty"`
+}
+
+// FromConfig returns an Option which configures a Handler as cfg says.
+// Fields left zero leave the defaults alone, so FromConfig(Config{})
+// changes nothing. NoLegacyCompress turns off the compress coding, which
+// is on by default. Options given after it override cfg, e.g.
+// New(next, FromConfig(cfg), WithErrorHandler(f)).
+func FromConfig(cfg Config) Option {
+	var opts []Option
+	add := func(set bool, opt Option) {
+		if set {
+			opts = append(opts, opt)
+		}
+	}
+
+	add(cfg.Methods != nil, WithMethods(cfg.Methods...))
+	add(cfg.PathPrefixes != nil, WithPathPrefix(cfg.PathPrefixes...))
+	add(cfg.SetVaryOnDecode, WithSetVaryOnDecode(true))
+	add(cfg.MaxDecodedBytes != 0, WithMaxDecodedBytes(cfg.MaxDecodedBytes))
+	for coding, n := range cfg.LimitsFor {
+		add(true, WithLimitFor(coding, n))
+	}
+
+	add(cfg.MaxEncodedBytes != 0, WithMaxEncodedBytes(cfg.MaxEncodedBytes))
+	add(cfg.MaxRatio != 0, WithMaxRatio(cfg.MaxRatio, nil))
+	add(cfg.DecodeTimeout != 0, WithDecodeTimeout(time.Duration(cfg.DecodeTimeout)))
+	add(cfg.DecodeContentTypes != nil, WithDecodeContentTypes(cfg.DecodeContentTypes...))
+	add(cfg.SkipContentTypes != nil, WithSkipContentTypes(cfg.SkipContentTypes...))
+	add(cfg.DecodeFallbacks != nil, WithDecodeFallbacks(cfg.DecodeFallbacks...))
+	add(cfg.AllowedEncodings != nil, WithAllowedEncodings(cfg.AllowedEncodings...))
+	add(cfg.DeniedEncodings != nil, WithDeniedEncodings(cfg.DeniedEncodings...))
+	add(cfg.ProblemDetails, WithProblemDetails(true))
+	add(cfg.EncodingsDocument, WithEncodingsDocument(true))
+	add(cfg.Expvar != "", WithExpvar(cfg.Expvar))
+	add(cfg.HeaderMode != HeaderIdentity, WithHeaderMode(cfg.HeaderMode))
+	add(cfg.Buffering != 0, WithBuffering(cfg.Buffering))
+	add(cfg.SpillThreshold != 0 || cfg.SpillDir != "", WithSpillToDisk(cfg.SpillThreshold, cfg.SpillDir))
+	add(cfg.LazyDecoding, WithLazyDecoding(true))
+	add(cfg.ValidateOnly, WithValidateOnly(true))
+	add(cfg.FailOpen, WithFailOpen(true))
+	add(cfg.UnknownEncodingWarning, WithUnknownEncodingWarning(true, nil))
+	add(cfg.VerifyChecksum, WithVerifyChecksum(true))
+	add(cfg.DecodedSizeHeader != "", WithDecodedSizeHeader(cfg.DecodedSizeHeader))
+	add(cfg.ServerTiming, WithServerTiming(true))
+	add(cfg.DebugHeaders, WithDebugHeaders(true))
+	add(cfg.DebugCounters, WithDebugCounters(true))
+	add(cfg.PprofLabels, WithPprofLabels(nil))
+	add(cfg.DecodeBreakerThreshold != 0, WithDecodeBreaker(nil, cfg.DecodeBreakerThreshold, time.Duration(cfg.DecodeBreakerWindow)))
+	add(cfg.GzipMaxMembers != 0, WithGzipMaxMembers(cfg.GzipMaxMembers))
+	add(cfg.MaxCodings != 0, WithMaxCodings(cfg.MaxCodings))
+	add(cfg.StrictContentEncoding, WithStrictContentEncoding(true))
+	add(cfg.Sniffing, WithSniffing(true))
+	add(cfg.MismatchMode != MismatchIgnore, WithMismatchMode(cfg.MismatchMode))
+	add(cfg.DoubleGzip, WithDoubleGzip(true))
+	add(cfg.RejectTrailingData, WithRejectTrailingData(true))
+	add(cfg.StrictDeflateZlibOnly, WithStrictDeflateZlibOnly(true))
+	add(cfg.ZlibDictionary != nil, WithZlibDictionary(cfg.ZlibDictionary))
+	add(cfg.MaxInflightBytes != 0, WithMaxInflightBytes(cfg.MaxInflightBytes))
+	add(cfg.RetryAfter != 0, WithRetryAfter(time.Duration(cfg.RetryAfter)))
+	add(cfg.XZ != 0, WithXZ(cfg.XZ))
+	add(cfg.NoLegacyCompress, WithLegacyCompress(false))
+	add(cfg.ZstdDictionaries != nil, WithZstdDictionaries(cfg.ZstdDictionaries))
+	add(cfg.ZstdDictionaryHeader != "", WithZstdDictionaryHeader(cfg.ZstdDictionaryHeader))
+	add(cfg.Base64, WithBase64(true))
+	add(cfg.SnappyBlockFormat != 0, WithSnappyBlockFormat(cfg.SnappyBlockFormat))
+
+	return func(h *Handler) {
+		for _, opt := range opts {
+			opt(h)
+		}
+	}
+}
+
+// LoadEnv sets the fields of c from the environment variables named after
+// their JSON keys, upper-cased and prefixed with prefix, e.g.
+// UNPACK_MAX_DECODED_BYTES for MaxDecodedBytes with the prefix "UNPACK_".
+// Fields whose variable is not set are left alone. Lists are separated by
+// commas, maps are lists of key=value pairs, byte slices are base64 and
+// durations are written like "30s".
+func (c *Config) LoadEnv(prefix string) error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.SplitN(t.Field(i).Tag.Get("json"), ",", 2)[0]
+		name := prefix + strings.ToUpper(key)
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		if err := setField(v.Field(i), s); err != nil {
+			return fmt.Errorf("unpack: invalid %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// setField sets f, a field of a Config, to the value written as s.
+func setField(f reflect.Value, s string) error {
+	if u, ok := f.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+
+		f.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		f.SetInt(n)
+	case reflect.Float64:
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+
+		f.SetFloat(x)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() == reflect.Uint8 {
+			p, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return err
+			}
+
+			f.SetBytes(p)
+			return nil
+		}
+
+		f.Set(reflect.ValueOf(splitList(s)))
+	case reflect.Map:
+		m := reflect.MakeMap(f.Type())
+		for _, pair := range splitList(s) {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("%q is not a key=value pair", pair)
+			}
+
+			val := reflect.New(f.Type().Elem()).Elem()
+			if err := setField(val, kv[1]); err != nil {
+				return err
+			}
+
+			m.SetMapIndex(reflect.ValueOf(strings.TrimSpace(kv[0])), val)
+		}
+
+		f.Set(m)
+	}
+
+	return nil
+}
+
+// splitList splits a comma-separated list, dropping surrounding whitespace
+// and empty elements.
+func splitList(s string) []string {
+	list := []string{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+
+	return list
+}
+
+// Duration is a time.Duration which is written like "30s" in Configs, see
+// time.ParseDuration.
+type Duration time.Duration
+
+// MarshalText writes d like "30s".
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText reads a duration written like "30s".
+func (d *Duration) UnmarshalText(text []byte) error {
+	x, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(x)
+	return nil
+}
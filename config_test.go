@@ -0,0 +1,107 @@
+package unpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFromConfig(t *testing.T) {
+	var cfg Config
+	err := json.Unmarshal([]byte(`{
+		"methods": ["PUT"],
+		"max_decoded_bytes": 4,
+		"limits_for": {"zstd": 5},
+		"decode_timeout": "30s",
+		"header_mode": "keep",
+		"mismatch_mode": "reject"
+	}`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.DecodeTimeout != Duration(30*time.Second) || cfg.HeaderMode != HeaderKeep || cfg.MismatchMode != MismatchReject {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+
+	h := New(requestBodyWriter{}, FromConfig(cfg))
+	if h.decodeTimeout != 30*time.Second || h.maxCodings != defaultMaxCodings || h.noCompress {
+		t.Fatalf("unexpected handler: %+v", h)
+	}
+
+	for _, tt := range []struct {
+		file     string
+		encoding string
+		method   string
+		code     int
+	}{
+		{file: "testdata/hello.txt.gz", encoding: "gzip", method: "PUT", code: http.StatusInternalServerError},
+		{file: "testdata/hello.txt.zst", encoding: "zstd", method: "PUT", code: http.StatusOK},
+		{file: "testdata/hello.txt.zst", encoding: "gzip", method: "PUT", code: http.StatusBadRequest},
+		{file: "testdata/hello.txt.gz", encoding: "gzip", method: "POST", code: http.StatusOK},
+	} {
+		buf, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(tt.method, "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s %s as %s: handler returned wrong status code: got %v want %v", tt.method, tt.file, tt.encoding, rr.Code, tt.code)
+		}
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	t.Setenv("UNPACK_ALLOWED_ENCODINGS", "gzip, zstd,")
+	t.Setenv("UNPACK_MAX_RATIO", "100.5")
+	t.Setenv("UNPACK_LIMITS_FOR", "gzip=10, zstd=20")
+	t.Setenv("UNPACK_DECODE_TIMEOUT", "1m")
+	t.Setenv("UNPACK_STRICT_CONTENT_ENCODING", "true")
+	t.Setenv("UNPACK_ZLIB_DICTIONARY", "aGVsbG8=")
+	t.Setenv("UNPACK_HEADER_MODE", "Delete")
+	t.Setenv("OTHER_MAX_CODINGS", "9")
+
+	cfg := Config{MaxCodings: 2}
+	if err := cfg.LoadEnv("UNPACK_"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Config{
+		AllowedEncodings:      []string{"gzip", "zstd"},
+		MaxRatio:              100.5,
+		LimitsFor:             map[string]int64{"gzip": 10, "zstd": 20},
+		DecodeTimeout:         Duration(time.Minute),
+		StrictContentEncoding: true,
+		ZlibDictionary:        []byte("hello"),
+		HeaderMode:            HeaderDelete,
+		MaxCodings:            2,
+	}
+
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("got config %+v, want %+v", cfg, want)
+	}
+
+	for name, value := range map[string]string{
+		"UNPACK_MAX_DECODED_BYTES": "lots",
+		"UNPACK_LIMITS_FOR":        "gzip",
+		"UNPACK_MISMATCH_MODE":     "maybe",
+	} {
+		t.Setenv(name, value)
+		if err := new(Config).LoadEnv("UNPACK_"); err == nil {
+			t.Fatalf("%s=%s: no error", name, value)
+		}
+
+		os.Unsetenv(name)
+	}
+}
@@ -0,0 +1,67 @@
+package unpack
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// debugDocument describes the effective configuration and the counters of
+// a Handler, see DebugHandler.
+type debugDocument struct {
+	Encodings     []string          `json:"encodings"`
+	Fallbacks     []string          `json:"fallbacks,omitempty"`
+	Limits        *limitsDocument   `json:"limits"`
+	CodingLimits  map[string]int64  `json:"coding_limits,omitempty"`
+	DecodeTimeout string            `json:"decode_timeout,omitempty"`
+	Inflight      *inflightDocument `json:"inflight,omitempty"`
+	Counters      json.RawMessage   `json:"counters,omitempty"`
+}
+
+// inflightDocument describes the in-flight budget of a Handler, see
+// WithMaxInflightBytes.
+type inflightDocument struct {
+	MaxBytes  int64 `json:"max_bytes"`
+	UsedBytes int64 `json:"used_bytes"`
+}
+
+// DebugHandler returns an http.Handler which renders the effective
+// configuration of h and the counters it keeps as JSON, for mounting under
+// an internal debug mux, e.g. at /debug/unpack:
+//
+//	mux.Handle("/debug/unpack", handler.DebugHandler())
+//
+// The configuration lists the content codings h decodes, its fallbacks,
+// the limits it enforces on requests which do not set their own, its
+// decode timeout and the size and usage of its in-flight budget. If h was
+// created with WithDebugCounters, the counters count requests, encoded and
+// decoded bytes by encoding and errors by class since h was created. They
+// tell how the service handles request bodies, so the handler must not be
+// exposed to clients.
+func (h *Handler) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc := &debugDocument{
+			Encodings:    h.supportedCodings(),
+			Fallbacks:    h.fallbacks,
+			Limits:       h.limitsDocumentFor(Limits{}),
+			CodingLimits: h.codingLimits,
+		}
+
+		if h.vars != nil {
+			doc.Counters = json.RawMessage(h.vars.String())
+		}
+
+		if h.decodeTimeout > 0 {
+			doc.DecodeTimeout = h.decodeTimeout.String()
+		}
+
+		if h.inflight != nil {
+			doc.Inflight = &inflightDocument{
+				MaxBytes:  h.inflight.max,
+				UsedBytes: atomic.LoadInt64(&h.inflight.used),
+			}
+		}
+
+		writeJSON(w, "application/json", http.StatusOK, doc)
+	})
+}
@@ -0,0 +1,82 @@
+package unpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDebugHandler(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := New(errorBodyWriter{}, WithMaxDecodedBytes(1<<20), WithDecodeTimeout(time.Second),
+		WithMaxInflightBytes(1<<10), WithAllowedEncodings("gzip", "deflate"), WithDebugCounters(true))
+	for _, body := range [][]byte{buf, buf, []byte("hello")} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(body))
+		req.Header.Set("Content-Encoding", "gzip")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.DebugHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/debug/unpack", nil))
+
+	if ct := rr.Result().Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("wrong content type: got %q want application/json", ct)
+	}
+
+	var doc struct {
+		Encodings     []string `json:"encodings"`
+		DecodeTimeout string   `json:"decode_timeout"`
+		Limits        struct {
+			MaxDecodedBytes int64 `json:"max_decoded_bytes"`
+		} `json:"limits"`
+		Inflight struct {
+			MaxBytes int64 `json:"max_bytes"`
+		} `json:"inflight"`
+		Counters struct {
+			Requests     map[string]int64 `json:"requests"`
+			DecodedBytes map[string]int64 `json:"decoded_bytes"`
+			Errors       map[string]int64 `json:"errors"`
+		} `json:"counters"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(doc.Encodings) != 2 || doc.Encodings[0] != "deflate" || doc.Encodings[1] != "gzip" {
+		t.Fatalf("wrong encodings: %q", doc.Encodings)
+	}
+
+	if doc.DecodeTimeout != "1s" || doc.Limits.MaxDecodedBytes != 1<<20 || doc.Inflight.MaxBytes != 1<<10 {
+		t.Fatalf("wrong configuration: %s", rr.Body.String())
+	}
+
+	if doc.Counters.Requests["gzip"] != 3 || doc.Counters.DecodedBytes["gzip"] != 10 || doc.Counters.Errors["malformed"] != 1 {
+		t.Fatalf("wrong counters: %s", rr.Body.String())
+	}
+}
+
+func TestDebugHandlerWithoutCounters(t *testing.T) {
+	handler := New(errorBodyWriter{})
+	if handler.vars != nil || len(handler.onDone) != 0 || len(handler.onError) != 0 {
+		t.Fatalf("counters wired up without WithDebugCounters: %d done and %d error hooks", len(handler.onDone), len(handler.onError))
+	}
+
+	rr := httptest.NewRecorder()
+	handler.DebugHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/debug/unpack", nil))
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := doc["counters"]; ok {
+		t.Fatalf("unexpected counters: %s", rr.Body.String())
+	}
+}
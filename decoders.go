@@ -0,0 +1,494 @@
+package unpack
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// zstdMaxWindow is the largest window zstd bodies may use, which is what
+// RFC 8878 has HTTP clients stay within.
+const zstdMaxWindow = 8 << 20
+
+// zstdDictMagic starts dictionaries in the zstd format.
+const zstdDictMagic = "\x37\xa4\x30\xec"
+
+// errZstdDictionary is returned for zstd bodies whose dictionary header
+// names a dictionary which the Handler does not have.
+var errZstdDictionary = errors.New("zstd: unknown dictionary")
+
+// errGzipMembers is returned for gzip data with more members than the
+// Handler allows.
+var errGzipMembers = errors.New("gzip: too many members")
+
+// errNotZlib is returned for deflate bodies which lack the zlib wrapper
+// when the Handler is set to only accept zlib-wrapped ones.
+var errNotZlib = errors.New("body is not zlib-wrapped")
+
+// errUnsupportedCoding is returned for bodies in a chain of content codings
+// of which only some are supported.
+var errUnsupportedCoding = errors.New("content coding is not supported")
+
+// errEmptyHeader is returned for requests whose Content-Encoding header is
+// set but empty when the Handler is strict about the header.
+var errEmptyHeader = errors.New("empty Content-Encoding header")
+
+// errDisallowedCoding is returned for bodies in a coding which the Handler
+// supports but does not allow, when it is strict about the header.
+var errDisallowedCoding = errors.New("content coding is not allowed")
+
+// errTooManyCodings is returned for bodies with more content codings than
+// the Handler allows.
+var errTooManyCodings = errors.New("too many content codings")
+
+// decoders maps each content coding with a built-in Codec to a function
+// which wraps a reader of data in that coding with a reader of the decoded
+// data, configured according to the Handler and the request being decoded.
+var decoders = map[string]func(*Handler, *http.Request, io.Reader) (io.ReadCloser, error){
+	EncodingGzip:       (*Handler).newGzipReader,
+	EncodingDeflate:    (*Handler).newDeflateReader,
+	EncodingDeflateRaw: (*Handler).newDeflateRawReader,
+	EncodingBrotli:     (*Handler).newBrotliReader,
+	EncodingLZ4:        (*Handler).newLZ4Reader,
+	EncodingSnappy:     (*Handler).newSnappyReader,
+	EncodingBzip2:      (*Handler).newBzip2Reader,
+	EncodingZstd:       (*Handler).newZstdReader,
+	EncodingXZ:         (*Handler).newXZReader,
+	EncodingCompress:   (*Handler).newCompressReader,
+	EncodingAWSChunked: (*Handler).newAWSChunkedReader,
+	EncodingAES128GCM:  (*Handler).newAES128GCMReader,
+	EncodingDCZ:        (*Handler).newDCZReader,
+	EncodingDCB:        (*Handler).newDCBReader,
+	EncodingBase64:     (*Handler).newBase64Reader,
+}
+
+// newGzipReader decodes gzip data, which may consist of several members,
+// up to as many as the Handler allows.
+func (h *Handler) newGzipReader(req *http.Request, r io.Reader) (io.ReadCloser, error) {
+	// The gzip reader only reads as much as it needs from readers which
+	// are io.ByteReaders, so the next member can be read from br.
+	br := getBufReader(r)
+	zr, ok := gzipReaders.Get().(*gzip.Reader)
+	var err error
+	if ok {
+		err = zr.Reset(br)
+	} else {
+		zr, err = gzip.NewReader(br)
+	}
+
+	if err != nil {
+		if zr != nil {
+			gzipReaders.Put(zr)
+		}
+
+		putBufReader(br)
+		return nil, err
+	}
+
+	zr.Multistream(false)
+	return &gzipMembersReader{
+		Reader:   zr,
+		r:        br,
+		members:  1,
+		max:      h.gzipMaxMembers,
+		trailing: func() error { return h.trailingData(req) },
+	}, nil
+}
+
+// gzipMembersReader reads gzip data member by member, failing once it has
+// more than max members, unless max is zero or less. Data after the last
+// member which does not start like another one is trailing data.
+type gzipMembersReader struct {
+	*gzip.Reader
+	r        *bufio.Reader
+	members  int
+	max      int
+	trailing func() error
+}
+
+func (z *gzipMembersReader) Read(p []byte) (int, error) {
+	for {
+		n, err := z.Reader.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+
+		hdr, err := z.r.Peek(2)
+		if len(hdr) == 0 && err == io.EOF {
+			return n, io.EOF
+		}
+
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+
+		if string(hdr) != gzipMagic[:2] {
+			return n, z.trailing()
+		}
+
+		if err := z.Reader.Reset(z.r); err != nil {
+			return n, err
+		}
+
+		z.members++
+		if z.max > 0 && z.members > z.max {
+			return n, errGzipMembers
+		}
+
+		z.Reader.Multistream(false)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Close returns the readers of z to their pools. z must not be used after.
+func (z *gzipMembersReader) Close() error {
+	if z.Reader == nil {
+		return nil
+	}
+
+	err := z.Reader.Close()
+	gzipReaders.Put(z.Reader)
+	putBufReader(z.r)
+	z.Reader, z.r = nil, nil
+	return err
+}
+
+// newDeflateReader decodes deflate data, which HTTP defines as a zlib
+// stream (RFC 1950). Since many clients send raw DEFLATE data (RFC 1951)
+// instead, data without a zlib header is decoded as such unless the
+// Handler is set to be strict. zlib streams which need a preset dictionary
+// are decoded with the one set with WithZlibDictionary.
+func (h *Handler) newDeflateReader(req *http.Request, r io.Reader) (io.ReadCloser, error) {
+	br := getBufReader(r)
+	hdr, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		putBufReader(br)
+		return nil, err
+	}
+
+	trailing := func() error { return h.trailingData(req) }
+	if isZlibHeader(hdr) {
+		zr, err := newZlibReader(br, h.zlibDict)
+		if err != nil {
+			putBufReader(br)
+			return nil, err
+		}
+
+		return &trailingReader{ReadCloser: zr, r: br, trailing: trailing}, nil
+	}
+
+	if h.strictDeflate {
+		putBufReader(br)
+		return nil, errNotZlib
+	}
+
+	return peekFlateReader(br, trailing)
+}
+
+// newDeflateRawReader decodes raw DEFLATE data, which is what clients
+// using the deflate-raw format of the Compression Streams API send.
+func (h *Handler) newDeflateRawReader(req *http.Request, r io.Reader) (io.ReadCloser, error) {
+	return peekFlateReader(getBufReader(r), func() error { return h.trailingData(req) })
+}
+
+// peekFlateReader decodes the raw DEFLATE data in br with a reader from
+// the pool, see peekReader, which is returned to the pool along with br
+// once it is closed.
+func peekFlateReader(br *bufio.Reader, trailing func() error) (io.ReadCloser, error) {
+	fr := newFlateReader(br)
+	pr, err := peekReader(&trailingReader{ReadCloser: fr, r: br, trailing: trailing})
+	if err != nil {
+		fr.Close()
+		return nil, err
+	}
+
+	return readCloser{Reader: pr, Closer: fr}, nil
+}
+
+// isZlibHeader reports whether hdr starts with a zlib header, which
+// declares the DEFLATE method and has a valid check sum. Raw DEFLATE data
+// could only pass for one if it started with a stored block which is not
+// the last one, and then only by chance, which compressors hardly produce.
+func isZlibHeader(hdr []byte) bool {
+	return len(hdr) >= 2 && hdr[0]&0x0f == 8 && (uint(hdr[0])<<8|uint(hdr[1]))%31 == 0
+}
+
+// newBrotliReader decodes br data (RFC 7932).
+func (h *Handler) newBrotliReader(req *http.Request, r io.Reader) (io.ReadCloser, error) {
+	return peekReader(brotli.NewReader(r))
+}
+
+// peekReader buffers r and makes sure that it yields at least one byte or
+// a clean EOF. Decoders which read nothing until they are first read from
+// are wrapped with it to reject corrupt bodies before the handler runs,
+// just like decoders which read a header when they are created.
+func peekReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if _, err := br.Peek(1); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(br), nil
+}
+
+// unexpected turns io.EOF, which is only expected where the data may end,
+// into io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// newLZ4Reader decodes LZ4 frames. Frames declare the size of their blocks,
+// up to 4MB, which bounds the memory used on top of the decoded size cap.
+func (h *Handler) newLZ4Reader(req *http.Request, r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if _, err := br.Peek(1); err != nil {
+		return nil, unexpected(err)
+	}
+
+	return peekReader(&lz4Frames{r: br, zr: lz4.NewReader(br)})
+}
+
+// lz4Frames decodes a stream of LZ4 frames, which may be concatenated like
+// those written by the lz4 tool, while lz4.Reader stops after the first.
+type lz4Frames struct {
+	r  *bufio.Reader
+	zr *lz4.Reader
+}
+
+func (z *lz4Frames) Read(p []byte) (int, error) {
+	for {
+		n, err := z.zr.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+
+		if _, err := z.r.Peek(1); err != nil {
+			return n, err
+		}
+
+		z.zr.Reset(z.r)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// newSnappyReader decodes data in the snappy framing format, which is what
+// streaming snappy clients send, or in the snappy block format if the
+// Handler is set to.
+func (h *Handler) newSnappyReader(req *http.Request, r io.Reader) (io.ReadCloser, error) {
+	if h.snappyBlockMax <= 0 {
+		return peekReader(snappy.NewReader(r))
+	}
+
+	// A block has no framing, so it can only be decoded as a whole. Its
+	// encoded size is bounded by that of the largest allowed block, which
+	// snappy limits to 4GB.
+	blockMax := h.snappyBlockMax
+	if blockMax > math.MaxUint32 || int64(int(blockMax)) != blockMax {
+		blockMax = int64(math.MaxInt32)
+	}
+
+	max := int64(snappy.MaxEncodedLen(int(blockMax)))
+	if max < 0 {
+		return nil, &limitError{limit: blockMax}
+	}
+
+	src, err := h.readBuffered(r, max+1)
+	if err != nil {
+		return nil, err
+	}
+	defer h.inflight.release(int64(len(src)))
+
+	if int64(len(src)) > max {
+		return nil, &limitError{limit: max}
+	}
+
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(n) > h.snappyBlockMax {
+		return nil, &limitError{limit: h.snappyBlockMax}
+	}
+
+	if !h.inflight.reserve(int64(n)) {
+		return nil, errOverloaded
+	}
+
+	dst, err := snappy.Decode(make([]byte, n), src)
+	if err != nil {
+		h.inflight.release(int64(n))
+		return nil, err
+	}
+
+	return &bufferedReader{Reader: bytes.NewReader(dst), release: func() { h.inflight.release(int64(n)) }}, nil
+}
+
+// newBzip2Reader decodes bzip2 data.
+func (h *Handler) newBzip2Reader(req *http.Request, r io.Reader) (io.ReadCloser, error) {
+	return peekReader(bzip2.NewReader(r))
+}
+
+// newCompressReader decodes LZW data in the format of the Unix compress
+// tool, which some embedded clients still send.
+func (h *Handler) newCompressReader(req *http.Request, r io.Reader) (io.ReadCloser, error) {
+	zr, err := newLZWReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return peekReader(zr)
+}
+
+// newAWSChunkedReader strips the chunk framing of aws-chunked data, which
+// S3-compatible clients send when they sign their uploads chunk by chunk.
+func (h *Handler) newAWSChunkedReader(req *http.Request, r io.Reader) (io.ReadCloser, error) {
+	return peekReader(newAWSChunkedReader(r))
+}
+
+// newAES128GCMReader decrypts aes128gcm data (RFC 8188), as sent by Web
+// Push clients, with the key the Handler looks up for its key ID.
+func (h *Handler) newAES128GCMReader(req *http.Request, r io.Reader) (io.ReadCloser, error) {
+	zr, err := newAESGCMReader(r, h.aesgcmKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	return peekReader(zr)
+}
+
+// newZstdReader decodes zstd data (RFC 8878). Bodies compressed with one
+// of the dictionaries of the Handler are decoded with the dictionary named
+// by the dictionary header of req, if set, or else with the dictionary in
+// the zstd format whose ID their frames refer to.
+func (h *Handler) newZstdReader(req *http.Request, r io.Reader) (io.ReadCloser, error) {
+	zr, err := h.newZstdDecoder(req, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &zstdTrailingReader{ReadCloser: zr, trailing: func() error { return h.trailingData(req) }}, nil
+}
+
+// newZstdDecoder returns the zstd decoder for newZstdReader.
+func (h *Handler) newZstdDecoder(req *http.Request, r io.Reader) (io.ReadCloser, error) {
+	opts := []zstd.DOption{zstd.WithDecoderMaxWindow(zstdMaxWindow)}
+	if name := req.Header.Get(h.zstdDictHeader); h.zstdDictHeader != "" && name != "" {
+		dict, ok := h.zstdDicts[name]
+		if !ok {
+			return nil, errZstdDictionary
+		}
+
+		// Raw dictionaries are used by frames which do not refer to a
+		// dictionary by ID.
+		if !strings.HasPrefix(string(dict), zstdDictMagic) {
+			return newZstdReader(r, append(opts, zstd.WithDecoderDictRaw(0, dict))...)
+		}
+
+		return newZstdReader(r, append(opts, zstd.WithDecoderDicts(dict))...)
+	}
+
+	for _, dict := range h.zstdDicts {
+		if strings.HasPrefix(string(dict), zstdDictMagic) {
+			opts = append(opts, zstd.WithDecoderDicts(dict))
+		}
+	}
+
+	return newZstdReader(r, opts...)
+}
+
+// newDCZReader decodes dcz data, compressed with zstd and a dictionary
+// which the Handler looks up in its DictionaryStore.
+func (h *Handler) newDCZReader(req *http.Request, r io.Reader) (io.ReadCloser, error) {
+	return newDCZReader(r, h.dictionaries)
+}
+
+// newDCBReader decodes dcb data, compressed with brotli and a dictionary
+// which the Handler looks up in its DictionaryStore.
+func (h *Handler) newDCBReader(req *http.Request, r io.Reader) (io.ReadCloser, error) {
+	return newDCBReader(r, h.dictionaries, h.dcbDecode)
+}
+
+// newZstdReader returns a reader of the zstd data in r, configured by
+// opts. It decodes in the calling goroutine with as little memory as it
+// can, since a Handler decodes many bodies at once.
+func newZstdReader(r io.Reader, opts ...zstd.DOption) (io.ReadCloser, error) {
+	opts = append([]zstd.DOption{zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true)}, opts...)
+	zr, err := zstd.NewReader(r, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, err := peekReader(zr)
+	if err != nil {
+		zr.Close()
+		return nil, err
+	}
+
+	return readCloser{Reader: pr, Closer: zr.IOReadCloser()}, nil
+}
+
+// readCloser combines a reader with the closer of what it reads from.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// newBase64Reader decodes base64 data in the standard alphabet with
+// padding (RFC 4648), ignoring line breaks, as sent by some webhook
+// providers and API gateways.
+func (h *Handler) newBase64Reader(req *http.Request, r io.Reader) (io.ReadCloser, error) {
+	return peekReader(base64.NewDecoder(base64.StdEncoding, r))
+}
+
+// newXZReader decodes xz data. The decoder allocates a dictionary of the
+// size each block declares, up to 4GB, so blocks which declare a larger
+// one than the Handler allows are rejected before it is allocated. Data
+// after the first stream is rejected, since it is not checked.
+func (h *Handler) newXZReader(req *http.Request, r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReaderSize(r, xzBlockHdrMax)
+	xr, err := xz.ReaderConfig{DictCap: xzMinDictSize, SingleStream: true}.NewReader(newXZDictLimiter(br, h.xzDictMax))
+	if err != nil {
+		return nil, err
+	}
+
+	return peekReader(xr)
+}
+
+// bufferedReader is a decoder which decoded all of its data up front. It
+// releases the memory it reserved from the in-flight budget when closed.
+type bufferedReader struct {
+	*bytes.Reader
+	release func()
+}
+
+func (b *bufferedReader) Close() error {
+	if b.release != nil {
+		b.release()
+		b.release = nil
+	}
+
+	return nil
+}
@@ -0,0 +1,521 @@
+package unpack
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestStrictDeflateZlibOnly(t *testing.T) {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	fw.Write([]byte("hello"))
+	fw.Close()
+
+	zlibbed, err := ioutil.ReadFile("testdata/hello.txt.zz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		body    []byte
+		strict  bool
+		code    int
+		content string
+	}{
+		{body: buf.Bytes(), strict: true, code: http.StatusBadRequest, content: "Content-Encoding: deflate set but body is not zlib-wrapped"},
+		{body: buf.Bytes(), strict: false, code: http.StatusOK, content: "hello"},
+		{body: zlibbed, strict: true, code: http.StatusOK, content: "hello"},
+		{body: zlibbed, strict: false, code: http.StatusOK, content: "hello"},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", "deflate")
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithStrictDeflateZlibOnly(tt.strict)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("strict %v: handler returned wrong status code: got %v want %v", tt.strict, rr.Code, tt.code)
+		}
+
+		if body := strings.TrimSuffix(rr.Body.String(), "\n"); body != tt.content {
+			t.Fatalf("strict %v: handler returned unexpected body: got '%v' want '%v'", tt.strict, body, tt.content)
+		}
+	}
+}
+
+func TestZlibDictionary(t *testing.T) {
+	dict := []byte("hello, hello, hello")
+	var buf bytes.Buffer
+	zw, _ := zlib.NewWriterLevelDict(&buf, zlib.DefaultCompression, dict)
+	zw.Write([]byte("hello"))
+	zw.Close()
+
+	zlibbed, err := ioutil.ReadFile("testdata/hello.txt.zz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		body    []byte
+		dict    []byte
+		code    int
+		content string
+	}{
+		{body: buf.Bytes(), dict: dict, code: http.StatusOK, content: "hello"},
+		{body: buf.Bytes(), dict: []byte("goodbye"), code: http.StatusBadRequest, content: "Content-Encoding: deflate set but unable to decompress body"},
+		{body: buf.Bytes(), dict: nil, code: http.StatusBadRequest, content: "Content-Encoding: deflate set but unable to decompress body"},
+		{body: zlibbed, dict: dict, code: http.StatusOK, content: "hello"},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", "deflate")
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithZlibDictionary(tt.dict)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("dict %q: handler returned wrong status code: got %v want %v", tt.dict, rr.Code, tt.code)
+		}
+
+		if body := strings.TrimSuffix(rr.Body.String(), "\n"); body != tt.content {
+			t.Fatalf("dict %q: handler returned unexpected body: got '%v' want '%v'", tt.dict, body, tt.content)
+		}
+	}
+}
+
+func TestSnappyBlockFormat(t *testing.T) {
+	block := []byte("\x05\x10hello")
+	for _, tt := range []struct {
+		body    []byte
+		max     int64
+		code    int
+		content string
+	}{
+		{body: block, max: 5, code: http.StatusOK, content: "hello"},
+		{body: block, max: 4, code: http.StatusRequestEntityTooLarge, content: "Request body too large"},
+		{body: block, max: 0, code: http.StatusBadRequest, content: "Content-Encoding: snappy set but unable to decompress body"},
+		{body: []byte("\x05\x10hell"), max: 5, code: http.StatusBadRequest, content: "Content-Encoding: snappy set but unable to decompress body"},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", "snappy")
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithSnappyBlockFormat(tt.max)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("max %d: handler returned wrong status code: got %v want %v", tt.max, rr.Code, tt.code)
+		}
+
+		if body := strings.TrimSuffix(rr.Body.String(), "\n"); body != tt.content {
+			t.Fatalf("max %d: handler returned unexpected body: got '%v' want '%v'", tt.max, body, tt.content)
+		}
+	}
+}
+
+func TestXZ(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Declare a 64MB dictionary in the block header. Its checksum no
+	// longer matches, but the size is checked before the checksum is.
+	large := append([]byte(nil), buf...)
+	large[16] = 0x1c
+
+	for _, tt := range []struct {
+		body    []byte
+		maxDict int64
+		code    int
+		content string
+	}{
+		{body: buf, maxDict: 8 << 20, code: http.StatusOK, content: "hello"},
+		{body: buf, maxDict: 0, code: http.StatusOK, content: string(buf)},
+		{body: large, maxDict: 8 << 20, code: http.StatusRequestEntityTooLarge, content: "Request body too large"},
+		{body: buf[:20], maxDict: 8 << 20, code: http.StatusBadRequest, content: "Content-Encoding: xz set but unable to decompress body"},
+		{body: []byte("hello"), maxDict: 8 << 20, code: http.StatusBadRequest, content: "Content-Encoding: xz set but unable to decompress body"},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", "xz")
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithXZ(tt.maxDict)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("max dict %d: handler returned wrong status code: got %v want %v", tt.maxDict, rr.Code, tt.code)
+		}
+
+		if body := strings.TrimSuffix(rr.Body.String(), "\n"); body != tt.content {
+			t.Fatalf("max dict %d: handler returned unexpected body: got '%v' want '%v'", tt.maxDict, body, tt.content)
+		}
+	}
+}
+
+// xzStream returns an xz stream with a CRC32 check holding one block
+// for each of props, the LZMA2 dictionary size properties of the blocks.
+// Each block holds "hello" in an uncompressed LZMA2 chunk.
+func xzStream(props ...byte) []byte {
+	le32 := func(b []byte, v uint32) []byte {
+		return binary.LittleEndian.AppendUint32(b, v)
+	}
+
+	flags := []byte{0x00, 0x01}
+	out := append([]byte(xzMagic), flags...)
+	out = le32(out, crc32.ChecksumIEEE(flags))
+
+	var index []byte
+	for _, p := range props {
+		hdr := []byte{0x02, 0x00, xzFilterLZMA2, 0x01, p, 0x00, 0x00, 0x00}
+		hdr = le32(hdr, crc32.ChecksumIEEE(hdr))
+		block := append(hdr, 0x01, 0x00, 0x04, 'h', 'e', 'l', 'l', 'o', 0x00)
+		unpadded := len(block) + 4
+		for len(block)%4 != 0 {
+			block = append(block, 0x00)
+		}
+
+		out = le32(append(out, block...), crc32.ChecksumIEEE([]byte("hello")))
+		index = append(index, byte(unpadded), 5)
+	}
+
+	index = append([]byte{0x00, byte(len(props))}, index...)
+	for len(index)%4 != 0 {
+		index = append(index, 0x00)
+	}
+
+	index = le32(index, crc32.ChecksumIEEE(index))
+	out = append(out, index...)
+
+	footer := append(le32(nil, uint32(len(index)/4-1)), flags...)
+	out = le32(out, crc32.ChecksumIEEE(footer))
+	return append(append(out, footer...), 'Y', 'Z')
+}
+
+func TestXZBlocks(t *testing.T) {
+	for _, tt := range []struct {
+		body    []byte
+		code    int
+		content string
+	}{
+		{body: xzStream(0), code: http.StatusOK, content: "hello"},
+		{body: xzStream(0, 18, 0), code: http.StatusOK, content: "hellohellohello"},
+		{body: xzStream(0, 36), code: http.StatusRequestEntityTooLarge, content: "Request body too large"},
+		{body: xzStream(0, 0, 40), code: http.StatusRequestEntityTooLarge, content: "Request body too large"},
+		{body: append(xzStream(0), xzStream(36)...), code: http.StatusBadRequest, content: "Content-Encoding: xz set but unable to decompress body"},
+		{body: append(xzStream(0), xzStream(0)...), code: http.StatusBadRequest, content: "Content-Encoding: xz set but unable to decompress body"},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", "xz")
+		rr := httptest.NewRecorder()
+		New(errorBodyWriter{}, WithXZ(8<<20)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%x: handler returned wrong status code: got %v want %v", tt.body, rr.Code, tt.code)
+		}
+
+		if body := strings.TrimSuffix(rr.Body.String(), "\n"); body != tt.content {
+			t.Fatalf("%x: handler returned unexpected body: got '%v' want '%v'", tt.body, body, tt.content)
+		}
+	}
+}
+
+func TestLegacyCompress(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		enabled bool
+		content string
+	}{
+		{enabled: true, content: "hello"},
+		{enabled: false, content: string(buf)},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", "compress")
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithLegacyCompress(tt.enabled)).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("enabled %v: handler returned wrong status code: got %v want %v", tt.enabled, rr.Code, http.StatusOK)
+		}
+
+		if body := rr.Body.String(); body != tt.content {
+			t.Fatalf("enabled %v: handler returned unexpected body: got '%v' want '%v'", tt.enabled, body, tt.content)
+		}
+	}
+}
+
+func TestAES128GCM(t *testing.T) {
+	data := exampleData(t, 0)
+	for _, tt := range []struct {
+		keys    func(string) ([]byte, error)
+		body    []byte
+		code    int
+		content string
+	}{
+		{keys: exampleKeys, body: data, code: http.StatusOK, content: "I am the walrus"},
+		{keys: nil, body: data, code: http.StatusOK, content: string(data)},
+		{keys: func(string) ([]byte, error) { return nil, errUnknownKey }, body: data, code: http.StatusBadRequest, content: "Content-Encoding: aes128gcm set but unable to decompress body"},
+		{keys: exampleKeys, body: data[:len(data)-1], code: http.StatusBadRequest, content: "Content-Encoding: aes128gcm set but unable to decompress body"},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", "aes128gcm")
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithAES128GCM(tt.keys)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, tt.code)
+		}
+
+		if body := strings.TrimSuffix(rr.Body.String(), "\n"); body != tt.content {
+			t.Fatalf("handler returned unexpected body: got '%v' want '%v'", body, tt.content)
+		}
+	}
+}
+
+func TestZstdDictionaries(t *testing.T) {
+	samples := make([][]byte, 0, 100)
+	for i := 0; i < cap(samples); i++ {
+		samples = append(samples, []byte(fmt.Sprintf(`{"device": "sensor-%d", "temperature": %d, "humidity": %d}`, i, i%40, i%100)))
+	}
+
+	trained, err := zstd.BuildDict(zstd.BuildDictOptions{ID: 1234, Contents: samples, History: bytes.Join(samples, nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := []byte(`{"device": "sensor-", "temperature": , "humidity": }`)
+	data := string(samples[42])
+	compress := func(opt zstd.EOption) []byte {
+		zw, err := zstd.NewWriter(nil, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return zw.EncodeAll([]byte(data), nil)
+	}
+
+	withTrained := compress(zstd.WithEncoderDict(trained))
+	withRaw := compress(zstd.WithEncoderDictRaw(0, raw))
+	dicts := map[string][]byte{"trained": trained, "raw": raw}
+
+	for _, tt := range []struct {
+		name    string
+		body    []byte
+		header  string
+		code    int
+		content string
+	}{
+		{name: "trained by ID", body: withTrained, code: http.StatusOK, content: data},
+		{name: "trained by name", body: withTrained, header: "trained", code: http.StatusOK, content: data},
+		{name: "raw by name", body: withRaw, header: "raw", code: http.StatusOK, content: data},
+		{name: "raw without name", body: withRaw, code: http.StatusBadRequest, content: "Content-Encoding: zstd set but unable to decompress body"},
+		{name: "unknown name", body: withRaw, header: "other", code: http.StatusBadRequest, content: "Content-Encoding: zstd set but unable to decompress body"},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", "zstd")
+		if tt.header != "" {
+			req.Header.Set("Zstd-Dictionary", tt.header)
+		}
+
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithZstdDictionaries(dicts), WithZstdDictionaryHeader("Zstd-Dictionary")).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.code)
+		}
+
+		if body := strings.TrimSuffix(rr.Body.String(), "\n"); body != tt.content {
+			t.Fatalf("%s: handler returned unexpected body: got '%v' want '%v'", tt.name, body, tt.content)
+		}
+	}
+}
+
+func TestBase64(t *testing.T) {
+	for _, tt := range []struct {
+		file     string
+		encoding string
+		enabled  bool
+		code     int
+		content  string
+	}{
+		{file: "testdata/hello.txt.b64", encoding: "base64", enabled: true, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.b64", encoding: "base64", enabled: false, code: http.StatusOK, content: "aGVsbG8="},
+		{file: "testdata/hello.txt.gz.b64", encoding: "gzip, base64", enabled: true, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.gz", encoding: "base64", enabled: true, code: http.StatusBadRequest, content: "Content-Encoding: base64 set but unable to decompress body"},
+	} {
+		buf, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithBase64(tt.enabled)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.file, rr.Code, tt.code)
+		}
+
+		if body := strings.TrimSuffix(rr.Body.String(), "\n"); body != tt.content {
+			t.Fatalf("%s: handler returned unexpected body: got '%v' want '%v'", tt.file, body, tt.content)
+		}
+	}
+}
+
+func TestGzipMaxMembers(t *testing.T) {
+	member, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members := func(n int) []byte {
+		return bytes.Repeat(member, n)
+	}
+
+	// Extra members are only found while the handler reads the body.
+	for _, tt := range []struct {
+		body    []byte
+		max     int
+		code    int
+		content string
+	}{
+		{body: members(3), max: 0, code: http.StatusOK, content: "hellohellohello"},
+		{body: members(1), max: 1, code: http.StatusOK, content: "hello"},
+		{body: members(2), max: 1, code: http.StatusInternalServerError, content: "unable to read r.Body"},
+		{body: members(3), max: 3, code: http.StatusOK, content: "hellohellohello"},
+		{body: members(4), max: 3, code: http.StatusInternalServerError, content: "unable to read r.Body"},
+		{body: append(members(1), 0), max: 3, code: http.StatusOK, content: "hello"},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithGzipMaxMembers(tt.max)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("max %d: handler returned wrong status code: got %v want %v", tt.max, rr.Code, tt.code)
+		}
+
+		if body := strings.TrimSuffix(rr.Body.String(), "\n"); body != tt.content {
+			t.Fatalf("max %d: handler returned unexpected body: got '%v' want '%v'", tt.max, body, tt.content)
+		}
+	}
+}
+
+func TestGzipReaderReuse(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pooled readers must not carry anything over from bodies which
+	// failed to decode, were cut short or were fine.
+	handler := New(errorBodyWriter{})
+	for i, tt := range []struct {
+		body []byte
+		code int
+	}{
+		{body: buf, code: http.StatusOK},
+		{body: []byte("hello"), code: http.StatusBadRequest},
+		{body: buf[:len(buf)-4], code: http.StatusBadRequest},
+		{body: buf, code: http.StatusOK},
+		{body: append(append([]byte{}, buf...), buf...), code: http.StatusOK},
+		{body: buf, code: http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewReader(tt.body))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%d: handler returned wrong status code: got %v want %v", i, rr.Code, tt.code)
+		}
+
+		want := strings.Repeat("hello", len(tt.body)/len(buf))
+		if tt.code == http.StatusOK && rr.Body.String() != want {
+			t.Fatalf("%d: unexpected body: got %q want %q", i, rr.Body.String(), want)
+		}
+	}
+}
+
+func TestDeflateReaderReuse(t *testing.T) {
+	var zbuf, fbuf bytes.Buffer
+	zw := zlib.NewWriter(&zbuf)
+	zw.Write([]byte("hello"))
+	zw.Close()
+	fw, _ := flate.NewWriter(&fbuf, flate.DefaultCompression)
+	fw.Write([]byte("hello"))
+	fw.Close()
+	zlibbed, deflated := zbuf.Bytes(), fbuf.Bytes()
+
+	// Pooled readers must not carry anything over from bodies which
+	// failed to decode, were cut short or were fine, whether they are
+	// zlib streams or raw DEFLATE data.
+	handler := New(errorBodyWriter{})
+	for i, tt := range []struct {
+		body     []byte
+		encoding string
+		code     int
+	}{
+		{body: zlibbed, encoding: "deflate", code: http.StatusOK},
+		{body: zlibbed[:len(zlibbed)-4], encoding: "deflate", code: http.StatusBadRequest},
+		{body: zlibbed, encoding: "deflate", code: http.StatusOK},
+		{body: deflated, encoding: "deflate", code: http.StatusOK},
+		{body: []byte{0xff, 0xff, 0xff}, encoding: "deflate-raw", code: http.StatusBadRequest},
+		{body: deflated, encoding: "deflate-raw", code: http.StatusOK},
+		{body: deflated[:2], encoding: "deflate-raw", code: http.StatusBadRequest},
+		{body: zlibbed, encoding: "deflate", code: http.StatusOK},
+		{body: deflated, encoding: "deflate-raw", code: http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewReader(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%d: handler returned wrong status code: got %v want %v", i, rr.Code, tt.code)
+		}
+
+		if tt.code == http.StatusOK && rr.Body.String() != "hello" {
+			t.Fatalf("%d: unexpected body: %q", i, rr.Body.String())
+		}
+	}
+}
+
+func BenchmarkGzip(b *testing.B) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	handler := New(requestBodyWriter{})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest("POST", "/test", bytes.NewReader(buf))
+		req.Header.Set("Content-Encoding", "gzip")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func BenchmarkDeflate(b *testing.B) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write([]byte("hello"))
+	zw.Close()
+
+	handler := New(requestBodyWriter{})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest("POST", "/test", bytes.NewReader(buf.Bytes()))
+		req.Header.Set("Content-Encoding", "deflate")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
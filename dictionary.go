@@ -0,0 +1,89 @@
+package unpack
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// dczMagic starts dcz bodies, which are a zstd skippable frame holding the
+// SHA-256 hash of the dictionary followed by a zstd frame compressed with
+// it (RFC 9842).
+const dczMagic = "\x5e\x2a\x4d\x18\x20\x00\x00\x00"
+
+// dcbMagic starts dcb bodies, followed by the SHA-256 hash of the
+// dictionary and a brotli stream compressed with it (RFC 9842).
+const dcbMagic = "\xff\x44\x43\x42"
+
+var (
+	errDCZHeader     = errors.New("dcz: invalid header")
+	errDCZDictionary = errors.New("dcz: unknown dictionary")
+	errDCBHeader     = errors.New("dcb: invalid header")
+	errDCBDictionary = errors.New("dcb: unknown dictionary")
+)
+
+// A DictionaryStore looks up the dictionaries which clients compress
+// request bodies with, as negotiated with Compression Dictionary Transport
+// (RFC 9842). It has to be safe for concurrent use.
+type DictionaryStore interface {
+	// Dictionary returns the dictionary whose SHA-256 hash is hash, or
+	// false if there is no such dictionary.
+	Dictionary(hash [sha256.Size]byte) ([]byte, bool)
+}
+
+// newDCZReader decodes dcz data, whose dictionary it looks up in store.
+// The zstd window may be as large as 8MB or 1.25 times the dictionary
+// size, whichever is larger, which is what RFC 9842 requires clients to
+// stay within.
+func newDCZReader(r io.Reader, store DictionaryStore) (io.ReadCloser, error) {
+	var hdr [len(dczMagic) + sha256.Size]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, unexpected(err)
+	}
+
+	if string(hdr[:len(dczMagic)]) != dczMagic {
+		return nil, errDCZHeader
+	}
+
+	var hash [sha256.Size]byte
+	copy(hash[:], hdr[len(dczMagic):])
+	dict, ok := store.Dictionary(hash)
+	if !ok {
+		return nil, errDCZDictionary
+	}
+
+	window := uint64(8 << 20)
+	if w := uint64(len(dict)) + uint64(len(dict))/4; w > window {
+		window = w
+	}
+
+	return newZstdReader(r, zstd.WithDecoderDictRaw(0, dict), zstd.WithDecoderMaxWindow(window))
+}
+
+// A BrotliDictionaryDecoder returns a reader of the brotli data in r,
+// which was compressed with the shared dictionary dict.
+type BrotliDictionaryDecoder func(r io.Reader, dict []byte) (io.ReadCloser, error)
+
+// newDCBReader decodes dcb data, whose dictionary it looks up in store,
+// with decode.
+func newDCBReader(r io.Reader, store DictionaryStore, decode BrotliDictionaryDecoder) (io.ReadCloser, error) {
+	var hdr [len(dcbMagic) + sha256.Size]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, unexpected(err)
+	}
+
+	if string(hdr[:len(dcbMagic)]) != dcbMagic {
+		return nil, errDCBHeader
+	}
+
+	var hash [sha256.Size]byte
+	copy(hash[:], hdr[len(dcbMagic):])
+	dict, ok := store.Dictionary(hash)
+	if !ok {
+		return nil, errDCBDictionary
+	}
+
+	return decode(r, dict)
+}
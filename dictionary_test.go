@@ -0,0 +1,146 @@
+package unpack
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// dictionaryMap is a DictionaryStore of the dictionaries in the map.
+type dictionaryMap map[[sha256.Size]byte][]byte
+
+func (m dictionaryMap) Dictionary(hash [sha256.Size]byte) ([]byte, bool) {
+	dict, ok := m[hash]
+	return dict, ok
+}
+
+func newDictionaryMap(dicts ...string) dictionaryMap {
+	m := make(dictionaryMap)
+	for _, dict := range dicts {
+		m[sha256.Sum256([]byte(dict))] = []byte(dict)
+	}
+
+	return m
+}
+
+// compressDCZ compresses data in the dcz coding with dict.
+func compressDCZ(t *testing.T, dict, data string) []byte {
+	var buf bytes.Buffer
+	hash := sha256.Sum256([]byte(dict))
+	buf.WriteString(dczMagic)
+	buf.Write(hash[:])
+
+	zw, err := zstd.NewWriter(&buf, zstd.WithEncoderDictRaw(0, []byte(dict)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zw.Write([]byte(data))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestDictionaryStore(t *testing.T) {
+	dict := `{"temperature": , "humidity": , "pressure": }`
+	data := `{"temperature": 21.5, "humidity": 40, "pressure": 1013}`
+	body := compressDCZ(t, dict, data)
+
+	for _, tt := range []struct {
+		name    string
+		store   DictionaryStore
+		body    []byte
+		code    int
+		content string
+	}{
+		{name: "known", store: newDictionaryMap("other", dict), body: body, code: http.StatusOK, content: data},
+		{name: "unknown", store: newDictionaryMap("other"), body: body, code: http.StatusBadRequest, content: "Content-Encoding: dcz set but unable to decompress body"},
+		{name: "no store", store: nil, body: body, code: http.StatusOK, content: string(body)},
+		{name: "bad magic", store: newDictionaryMap(dict), body: body[1:], code: http.StatusBadRequest, content: "Content-Encoding: dcz set but unable to decompress body"},
+		{name: "truncated", store: newDictionaryMap(dict), body: body[:30], code: http.StatusBadRequest, content: "Content-Encoding: dcz set but unable to decompress body"},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", "dcz")
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithDictionaryStore(tt.store)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.code)
+		}
+
+		if body := strings.TrimSuffix(rr.Body.String(), "\n"); body != tt.content {
+			t.Fatalf("%s: handler returned unexpected body: got '%v' want '%v'", tt.name, body, tt.content)
+		}
+	}
+}
+
+// flateDictionaryDecoder stands in for a brotli decoder with dictionary
+// support, which the tests have no encoder for.
+func flateDictionaryDecoder(r io.Reader, dict []byte) (io.ReadCloser, error) {
+	return flate.NewReaderDict(r, dict), nil
+}
+
+// compressDCB frames data compressed with dict like a dcb body, with
+// DEFLATE in place of brotli.
+func compressDCB(t *testing.T, dict, data string) []byte {
+	var buf bytes.Buffer
+	hash := sha256.Sum256([]byte(dict))
+	buf.WriteString(dcbMagic)
+	buf.Write(hash[:])
+
+	fw, err := flate.NewWriterDict(&buf, flate.DefaultCompression, []byte(dict))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fw.Write([]byte(data))
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestSharedBrotli(t *testing.T) {
+	dict := `{"temperature": , "humidity": , "pressure": }`
+	data := `{"temperature": 21.5, "humidity": 40, "pressure": 1013}`
+	body := compressDCB(t, dict, data)
+
+	for _, tt := range []struct {
+		name    string
+		store   DictionaryStore
+		decode  BrotliDictionaryDecoder
+		body    []byte
+		code    int
+		content string
+	}{
+		{name: "known", store: newDictionaryMap("other", dict), decode: flateDictionaryDecoder, body: body, code: http.StatusOK, content: data},
+		{name: "unknown", store: newDictionaryMap("other"), decode: flateDictionaryDecoder, body: body, code: http.StatusBadRequest, content: "Content-Encoding: dcb set but unable to decompress body"},
+		{name: "no decoder", store: newDictionaryMap(dict), decode: nil, body: body, code: http.StatusOK, content: string(body)},
+		{name: "no store", store: nil, decode: flateDictionaryDecoder, body: body, code: http.StatusOK, content: string(body)},
+		{name: "bad magic", store: newDictionaryMap(dict), decode: flateDictionaryDecoder, body: body[1:], code: http.StatusBadRequest, content: "Content-Encoding: dcb set but unable to decompress body"},
+		{name: "truncated", store: newDictionaryMap(dict), decode: flateDictionaryDecoder, body: body[:20], code: http.StatusBadRequest, content: "Content-Encoding: dcb set but unable to decompress body"},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", "dcb")
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithDictionaryStore(tt.store), WithSharedBrotli(tt.decode)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.code)
+		}
+
+		if body := strings.TrimSuffix(rr.Body.String(), "\n"); body != tt.content {
+			t.Fatalf("%s: handler returned unexpected body: got '%v' want '%v'", tt.name, body, tt.content)
+		}
+	}
+}
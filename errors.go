@@ -0,0 +1,463 @@
+package unpack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnsupportedEncoding is matched by the errors for which a Handler
+// rejects request bodies in content codings which it does not support or
+// allow, or in too many of them. Check for it with errors.Is.
+var ErrUnsupportedEncoding = errors.New("unpack: unsupported content encoding")
+
+// ErrMalformedBody is matched by the errors of request bodies which cannot
+// be decoded, e.g. because they are corrupt, do not match their
+// Content-Encoding header or have data after the end of the encoded data.
+// Check for it with errors.Is.
+var ErrMalformedBody = errors.New("unpack: malformed request body")
+
+// DecompressionError is returned when a request body cannot be decoded
+// according to its Content-Encoding, either when the decoders are created
+// or while the body is being read. It matches ErrUnsupportedEncoding or
+// ErrMalformedBody with errors.Is, depending on why, unless it is due to a
+// limit, in which case it wraps an error matching ErrLimitExceeded.
+type DecompressionError struct {
+	// Encoding lists the content codings the body was to be decoded
+	// from. If the error occurred while creating a decoder it is the
+	// coding of that decoder.
+	Encoding string
+
+	// Err is the error returned by the decoder.
+	Err error
+}
+
+func (e *DecompressionError) Error() string {
+	return fmt.Sprintf("unpack: unable to decompress %s body: %v", e.Encoding, e.Err)
+}
+
+// Unwrap returns the error returned by the decoder.
+func (e *DecompressionError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrUnsupportedEncoding or ErrMalformedBody
+// and describes e.
+func (e *DecompressionError) Is(target error) bool {
+	switch target {
+	case ErrUnsupportedEncoding:
+		return isUnsupported(e.Err)
+	case ErrMalformedBody:
+		return ClassifyError(e.Err) == ClassMalformed
+	}
+
+	return false
+}
+
+// isUnsupported reports whether err is about a content coding which a
+// Handler does not decode.
+func isUnsupported(err error) bool {
+	return errors.Is(err, errUnsupportedCoding) || errors.Is(err, errDisallowedCoding) || errors.Is(err, errTooManyCodings)
+}
+
+// An ErrorClass is a kind of reason for which a Handler rejects a request,
+// see ClassifyError.
+type ErrorClass int
+
+// The classes of errors a Handler rejects requests for.
+const (
+	// ClassMalformed is for bodies which cannot be decoded, e.g. because
+	// they are corrupt or do not match their Content-Encoding header.
+	// They are rejected with HTTP 400 by default.
+	ClassMalformed ErrorClass = iota
+
+	// ClassUnsupported is for bodies in content codings which the Handler
+	// does not support or allow, or in too many of them. They are
+	// rejected with HTTP 415 by default.
+	ClassUnsupported
+
+	// ClassInvalidHeader is for Content-Encoding headers which are not
+	// valid, see WithStrictContentEncoding.
+	ClassInvalidHeader
+
+	// ClassTooLarge is for bodies which exceed a size limit.
+	ClassTooLarge
+
+	// ClassTimeout is for bodies which took too long to decode.
+	ClassTimeout
+
+	// ClassOverloaded is for bodies which could not be decoded because
+	// the Handler was out of resources, see WithMaxInflightBytes and
+	// WithSpillToDisk.
+	ClassOverloaded
+
+	// ClassThrottled is for requests from clients whose bodies failed to
+	// decode too often, see WithDecodeBreaker. They are rejected with
+	// HTTP 429 by default.
+	ClassThrottled
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ClassMalformed:
+		return "malformed"
+	case ClassUnsupported:
+		return "unsupported"
+	case ClassInvalidHeader:
+		return "invalid header"
+	case ClassTooLarge:
+		return "too large"
+	case ClassTimeout:
+		return "timeout"
+	case ClassOverloaded:
+		return "overloaded"
+	case ClassThrottled:
+		return "throttled"
+	}
+
+	return fmt.Sprintf("ErrorClass(%d)", int(c))
+}
+
+// ClassifyError returns the class of err, an error for which a Handler
+// rejected a request or which was returned while reading a body it
+// decoded. Errors of no other class are ClassMalformed.
+func ClassifyError(err error) ErrorClass {
+	switch {
+	case errors.Is(err, ErrLimitExceeded):
+		return ClassTooLarge
+	case errors.Is(err, ErrDecodeTimeout):
+		return ClassTimeout
+	case errors.Is(err, errOverloaded), errors.Is(err, errSpill):
+		return ClassOverloaded
+	case errors.Is(err, errBreakerOpen):
+		return ClassThrottled
+	case err == errEmptyHeader, errors.Is(err, ErrInvalidCoding):
+		return ClassInvalidHeader
+	case isUnsupported(err):
+		return ClassUnsupported
+	}
+
+	return ClassMalformed
+}
+
+// decodingKey is the context key under which the decoding of the body of
+// a request is kept, for Error.
+type decodingKey struct{}
+
+// decoding is a body being decoded by a Handler.
+type decoding struct {
+	h *Handler
+	b *body
+}
+
+// Error responds to r the way the Handler which decoded its body rejects
+// requests, if err is an error returned while the body was being read
+// because it exceeded a limit or could not be decoded, and reports whether
+// it did. Handlers can use it to turn such errors into the same responses
+// the Handler sends for bodies it rejects up front, e.g. HTTP 413 for a
+// body which exceeds the limit set with WithMaxDecodedBytes halfway
+// through:
+//
+//	data, err := io.ReadAll(r.Body)
+//	if unpack.Error(w, r, err) {
+//		return
+//	}
+//
+// Error writes nothing and returns false for other errors, including those
+// of bodies which were not decoded by a Handler. Responses to bodies which
+// were too large or too slow ask the client to close the connection, so
+// that the rest of the body need not be read.
+func Error(w http.ResponseWriter, r *http.Request, err error) bool {
+	d, ok := r.Context().Value(decodingKey{}).(*decoding)
+	if !ok || !isBodyError(err) {
+		return false
+	}
+
+	switch ClassifyError(err) {
+	case ClassTooLarge, ClassTimeout:
+		w.Header().Set("Connection", "close")
+	}
+
+	d.b.rejected = true
+	d.h.fail(w, r, err)
+	return true
+}
+
+// isBodyError reports whether err is one of the errors a body returns when
+// it exceeds a limit or cannot be decoded.
+func isBodyError(err error) bool {
+	var de *DecompressionError
+	switch {
+	case errors.Is(err, ErrLimitExceeded), errors.Is(err, ErrDecodeTimeout):
+		return true
+	case errors.Is(err, ErrTrailingData), errors.As(err, &de):
+		return true
+	}
+
+	return false
+}
+
+// ErrorInfo describes a request which a Handler rejected, see WithOnError.
+type ErrorInfo struct {
+	// Err is the reason for the rejection, as passed to the error handler
+	// of the Handler.
+	Err error
+
+	// Class is the class of Err.
+	Class ErrorClass
+
+	// Encoding lists the content codings of the body, e.g. "gzip" or
+	// "gzip, deflate". For requests rejected before their body was read it
+	// is the Content-Encoding header as sent.
+	Encoding string
+
+	// EncodedBytes is the number of bytes of the body as sent by the
+	// client which were read before the request was rejected.
+	EncodedBytes int64
+
+	// DecodedBytes is the number of decoded bytes read from the body
+	// before the request was rejected.
+	DecodedBytes int64
+
+	// Duration is the time spent decoding the body before the request was
+	// rejected, see Stats.DecodeDuration.
+	Duration time.Duration
+}
+
+// fail responds to a request whose body could not be decoded, using the
+// error handler of h if it has one. Responses to requests rejected because
+// of their content coding list the codings h decodes in an Accept-Encoding
+// header, as RFC 7694 suggests, so that clients can switch to one.
+func (h *Handler) fail(w http.ResponseWriter, r *http.Request, err error) {
+	class := ClassifyError(err)
+	if len(h.onError) > 0 {
+		info := ErrorInfo{Err: err, Class: class, Encoding: strings.Join(r.Header.Values("Content-Encoding"), ",")}
+		if s, ok := StatsFromContext(r.Context()); ok {
+			info.Encoding = s.Encoding
+			info.EncodedBytes = s.EncodedBytes
+			info.DecodedBytes = s.DecodedBytes
+			info.Duration = s.DecodeDuration
+		}
+
+		for _, f := range h.onError {
+			f(r, info)
+		}
+	}
+
+	if class == ClassUnsupported {
+		w.Header().Set("Accept-Encoding", strings.Join(h.supportedCodings(), ", "))
+	}
+
+	if class == ClassOverloaded && h.retryAfter > 0 {
+		secs := (h.retryAfter + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(secs), 10))
+	}
+
+	var be *breakerError
+	if errors.As(err, &be) {
+		secs := (be.retry + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(secs), 10))
+	}
+
+	if s, ok := StatsFromContext(r.Context()); ok {
+		if h.serverTiming {
+			addServerTiming(w.Header(), s)
+		}
+
+		if h.debugHeaders {
+			setDebugHeaders(w.Header(), s)
+		}
+	}
+
+	if h.debugHeaders {
+		w.Header().Set("X-Unpack-Error", class.String())
+	}
+
+	if h.errorHandler != nil {
+		h.errorHandler(w, r, err)
+		return
+	}
+
+	code, msg := errorResponse(err)
+	if c, ok := h.statuses[class]; ok {
+		code = c
+	}
+
+	if h.render != nil {
+		w.Header().Set("Content-Type", h.renderType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(code)
+		h.render(w, code, msg, err)
+		return
+	}
+
+	var limits *limitsDocument
+	if class == ClassUnsupported && h.encodingsDoc {
+		limits = h.limitsDocument(r)
+	}
+
+	if !h.problemDetails {
+		if limits == nil {
+			http.Error(w, msg, code)
+			return
+		}
+
+		writeJSON(w, "application/json", code, encodingsDocument{
+			Error:              msg,
+			SupportedEncodings: h.supportedCodings(),
+			Limits:             limits,
+		})
+		return
+	}
+
+	p := problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(code),
+		Status: code,
+		Detail: msg,
+		Limits: limits,
+	}
+
+	if class == ClassUnsupported {
+		p.SupportedEncodings = h.supportedCodings()
+	}
+
+	writeJSON(w, "application/problem+json", code, p)
+}
+
+// writeJSON responds with v as a document of the given content type.
+func writeJSON(w http.ResponseWriter, contentType string, code int, v interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// encodingsDocument describes the content codings a Handler decodes, in
+// responses to requests rejected because of their content coding, see
+// WithEncodingsDocument.
+type encodingsDocument struct {
+	Error              string          `json:"error"`
+	SupportedEncodings []string        `json:"supported_encodings"`
+	Limits             *limitsDocument `json:"limits"`
+}
+
+// limitsDocument lists the limits a Handler enforces on request bodies,
+// leaving out those which are not set.
+type limitsDocument struct {
+	MaxCodings      int     `json:"max_codings,omitempty"`
+	MaxEncodedBytes int64   `json:"max_encoded_bytes,omitempty"`
+	MaxDecodedBytes int64   `json:"max_decoded_bytes,omitempty"`
+	MaxRatio        float64 `json:"max_ratio,omitempty"`
+}
+
+// limitsDocument returns the limits h enforces on the body of r.
+func (h *Handler) limitsDocument(r *http.Request) *limitsDocument {
+	return h.limitsDocumentFor(h.requestLimits(r))
+}
+
+// limitsDocumentFor returns the limits h enforces on bodies given the
+// Limits of their request.
+func (h *Handler) limitsDocumentFor(limits Limits) *limitsDocument {
+	doc := &limitsDocument{
+		MaxCodings:      h.maxCodings,
+		MaxEncodedBytes: h.maxEncodedBytes,
+		MaxDecodedBytes: limits.maxDecodedBytes(h.maxDecodedBytes),
+		MaxRatio:        limits.maxRatio(h.maxRatio),
+	}
+
+	// Caps of zero or less are no caps at all.
+	if doc.MaxCodings < 0 {
+		doc.MaxCodings = 0
+	}
+
+	if doc.MaxEncodedBytes < 0 {
+		doc.MaxEncodedBytes = 0
+	}
+
+	if doc.MaxDecodedBytes < 0 {
+		doc.MaxDecodedBytes = 0
+	}
+
+	if doc.MaxRatio < 0 {
+		doc.MaxRatio = 0
+	}
+
+	return doc
+}
+
+// problem is a problem details object as defined by RFC 9457, describing
+// why a request was rejected.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+
+	// SupportedEncodings lists the content codings the Handler decodes,
+	// for requests rejected because of their content coding.
+	SupportedEncodings []string `json:"supported_encodings,omitempty"`
+
+	// Limits lists the limits the Handler enforces, see
+	// WithEncodingsDocument.
+	Limits *limitsDocument `json:"limits,omitempty"`
+}
+
+// DefaultErrorHandler is how a Handler responds to requests it rejects,
+// unless told otherwise with WithErrorHandler. It answers with a plain
+// text message and a status code which depends on err, e.g. HTTP 413 for
+// ErrLimitExceeded or HTTP 400 for a *DecompressionError for a corrupt body.
+func DefaultErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	code, msg := errorResponse(err)
+	http.Error(w, msg, code)
+}
+
+// errorResponse returns the status code and message of the response to a
+// request rejected because of err.
+func errorResponse(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrLimitExceeded):
+		return http.StatusRequestEntityTooLarge, "Request body too large"
+	case errors.Is(err, ErrDecodeTimeout):
+		return http.StatusRequestTimeout, "Request body took too long to decode"
+	case errors.Is(err, errOverloaded):
+		return http.StatusServiceUnavailable, "Too many request bodies in flight"
+	case errors.Is(err, errSpill):
+		return http.StatusServiceUnavailable, "Unable to buffer request body"
+	case errors.Is(err, errBreakerOpen):
+		return http.StatusTooManyRequests, "Too many request bodies which could not be decoded"
+	case err == errEmptyHeader:
+		return http.StatusBadRequest, "Content-Encoding header is empty"
+	case errors.Is(err, ErrInvalidCoding):
+		return http.StatusBadRequest, "Content-Encoding header is invalid"
+	case errors.Is(err, ErrTrailingData):
+		return http.StatusBadRequest, "Request body has data after the end of the encoded data"
+	}
+
+	encoding := "unknown"
+	if de, ok := err.(*DecompressionError); ok {
+		encoding = de.Encoding
+		if de.Err == errNotZlib {
+			return http.StatusBadRequest, fmt.Sprintf("Content-Encoding: %s set but body is not zlib-wrapped", encoding)
+		}
+
+		if me, ok := de.Err.(*mismatchError); ok {
+			return http.StatusBadRequest, fmt.Sprintf("Content-Encoding: %s set but body is %s-encoded", encoding, me.detected)
+		}
+
+		switch de.Err {
+		case errTooManyCodings:
+			return http.StatusUnsupportedMediaType, "Content-Encoding: too many content codings"
+		case errDisallowedCoding:
+			return http.StatusUnsupportedMediaType, fmt.Sprintf("Content-Encoding: %s is not allowed", encoding)
+		case errUnsupportedCoding:
+			return http.StatusUnsupportedMediaType, fmt.Sprintf("Content-Encoding: %s is not supported", encoding)
+		}
+	}
+
+	return http.StatusBadRequest, fmt.Sprintf("Content-Encoding: %s set but unable to decompress body", encoding)
+}
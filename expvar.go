@@ -0,0 +1,84 @@
+package unpack
+
+import (
+	"expvar"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// expvarMu serializes looking up and publishing expvar counters, so that
+// Handlers created at the same time with the same name share them.
+var expvarMu sync.Mutex
+
+// expvarCounters are the counters published by WithExpvar, and those
+// rendered by DebugHandler, see WithDebugCounters.
+type expvarCounters struct {
+	requests     *expvar.Map // By encoding.
+	encodedBytes *expvar.Map // By encoding.
+	decodedBytes *expvar.Map // By encoding.
+	errors       *expvar.Map // By error class.
+}
+
+// newExpvarCounters returns the counters published as name, publishing
+// them first if there are none yet.
+func newExpvarCounters(name string) *expvarCounters {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	m, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		m = expvar.NewMap(name)
+	}
+
+	return countersIn(m)
+}
+
+// countersIn returns the counters kept in m, adding them first if there
+// are none yet.
+func countersIn(m *expvar.Map) *expvarCounters {
+	sub := func(key string) *expvar.Map {
+		if v, ok := m.Get(key).(*expvar.Map); ok {
+			return v
+		}
+
+		v := new(expvar.Map).Init()
+		m.Set(key, v)
+		return v
+	}
+
+	return &expvarCounters{
+		requests:     sub("requests"),
+		encodedBytes: sub("encoded_bytes"),
+		decodedBytes: sub("decoded_bytes"),
+		errors:       sub("errors"),
+	}
+}
+
+// done counts a request which a Handler passed on, see WithOnDone.
+func (c *expvarCounters) done(r *http.Request, s Stats) {
+	c.count(s.Encoding, s.EncodedBytes, s.DecodedBytes)
+	if s.Err != nil {
+		c.errors.Add(ClassifyError(s.Err).String(), 1)
+	}
+}
+
+// rejected counts a request which a Handler rejected, see WithOnError.
+func (c *expvarCounters) rejected(r *http.Request, info ErrorInfo) {
+	// Codings which are not decoded are lumped together, so that clients
+	// cannot add keys at will.
+	encoding := "other"
+	if info.Class != ClassUnsupported && info.Class != ClassInvalidHeader {
+		encoding = strings.Join(parseCodings(info.Encoding), ", ")
+	}
+
+	c.count(encoding, info.EncodedBytes, info.DecodedBytes)
+	c.errors.Add(info.Class.String(), 1)
+}
+
+// count counts a request whose body was in the given encoding.
+func (c *expvarCounters) count(encoding string, encoded, decoded int64) {
+	c.requests.Add(encoding, 1)
+	c.encodedBytes.Add(encoding, encoded)
+	c.decodedBytes.Add(encoding, decoded)
+}
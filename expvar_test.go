@@ -0,0 +1,71 @@
+package unpack
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// expvarRuns numbers the runs of TestExpvar, so that each one publishes
+// fresh counters even with -count.
+var expvarRuns int32
+
+func TestExpvar(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Handlers with the same name share the counters.
+	name := fmt.Sprintf("%s_%d", t.Name(), atomic.AddInt32(&expvarRuns, 1))
+	handler := New(errorBodyWriter{}, WithExpvar(name))
+	limited := New(errorBodyWriter{}, WithExpvar(name), WithMaxDecodedBytes(1))
+
+	for _, tt := range []struct {
+		body     []byte
+		encoding string
+		limited  bool
+	}{
+		{body: buf, encoding: "gzip"},
+		{body: buf, encoding: "x-gzip"},
+		{body: []byte("hello"), encoding: "gzip"},
+		{body: buf, encoding: "gzip", limited: true},
+		{body: buf, encoding: "gzip, made-up"},
+		{body: []byte("hello")},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		if tt.encoding != "" {
+			req.Header.Set("Content-Encoding", tt.encoding)
+		}
+
+		h := handler
+		if tt.limited {
+			h = limited
+		}
+
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	m := expvar.Get(name).(*expvar.Map)
+	for _, tt := range []struct {
+		key   string
+		field string
+		want  string
+	}{
+		{key: "requests", field: "gzip", want: "4"},
+		{key: "requests", field: "other", want: "1"},
+		{key: "decoded_bytes", field: "gzip", want: "11"},
+		{key: "errors", field: "malformed", want: "1"},
+		{key: "errors", field: "too large", want: "1"},
+		{key: "errors", field: "unsupported", want: "1"},
+	} {
+		v := m.Get(tt.key).(*expvar.Map).Get(tt.field)
+		if v == nil || v.String() != tt.want {
+			t.Fatalf("%s[%s]: got %v want %s", tt.key, tt.field, v, tt.want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package unpack
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+)
+
+// recordingReader keeps a copy of what is read from r until it is
+// stopped, so that a body can still be passed on as it was sent after
+// decoders failed to make sense of its start.
+type recordingReader struct {
+	r       io.Reader
+	buf     []byte
+	stopped bool
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if !rr.stopped {
+		rr.buf = append(rr.buf, p[:n]...)
+	}
+
+	return n, err
+}
+
+// stop stops recording and drops what was recorded.
+func (rr *recordingReader) stop() {
+	rr.stopped = true
+	rr.buf = nil
+}
+
+// serveRaw passes r on with its body as it was sent, after its decoders
+// failed with err, see WithFailOpen. The first own closers of b are not
+// decoders and are kept, the rest are closed.
+func (h *Handler) serveRaw(w http.ResponseWriter, r *http.Request, b *body, own int, rec *recordingReader, err error) {
+	for _, c := range b.closers[own:] {
+		c.Close()
+	}
+
+	b.closers = b.closers[:own]
+	defer b.Close()
+
+	b.stats.Err = err
+	b.stats.Raw = true
+	b.r = io.MultiReader(bytes.NewReader(rec.buf), rec.r)
+	b.replay = true
+	rec.stop()
+
+	r = r.WithContext(context.WithValue(r.Context(), statsKey{}, &b.stats))
+	r.Body = b
+	h.next.ServeHTTP(w, r)
+	h.done(r, b)
+}
@@ -0,0 +1,75 @@
+package unpack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFailOpen(t *testing.T) {
+	gz, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zst, err := ioutil.ReadFile("testdata/hello.txt.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := append([]byte{}, gz...)
+	corrupt[3] = 0xff // Reserved flag bits.
+
+	for _, tt := range []struct {
+		name     string
+		body     []byte
+		encoding string
+		opts     []Option
+		code     int
+		content  []byte
+		raw      bool
+	}{
+		{name: "valid", body: gz, encoding: "gzip", code: http.StatusOK, content: []byte("hello")},
+		{name: "corrupt header", body: corrupt, encoding: "gzip", code: http.StatusOK, content: corrupt, raw: true},
+		{name: "wrong coding", body: zst, encoding: "gzip", code: http.StatusOK, content: zst, raw: true},
+		{name: "fallback", body: zst, encoding: "gzip", opts: []Option{WithDecodeFallbacks(EncodingZstd)}, code: http.StatusOK, content: []byte("hello")},
+		{name: "unsupported", body: gz, encoding: "gzip, unknown", code: http.StatusUnsupportedMediaType},
+		{name: "too large", body: gz, encoding: "gzip", opts: []Option{WithMaxEncodedBytes(4)}, code: http.StatusRequestEntityTooLarge},
+	} {
+		var got []byte
+		var stats Stats
+		var encoding string
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = ioutil.ReadAll(r.Body)
+			stats, _ = StatsFromContext(r.Context())
+			encoding = r.Header.Get("Content-Encoding")
+		})
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		New(inner, append(tt.opts, WithFailOpen(true))...).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.code)
+		}
+
+		if tt.code != http.StatusOK {
+			continue
+		}
+
+		if !bytes.Equal(got, tt.content) {
+			t.Fatalf("%s: got body %q, want %q", tt.name, got, tt.content)
+		}
+
+		if stats.Raw != tt.raw || (stats.Err != nil) != tt.raw {
+			t.Fatalf("%s: unexpected stats %+v", tt.name, stats)
+		}
+
+		if tt.raw && encoding != tt.encoding {
+			t.Fatalf("%s: got Content-Encoding %q, want %q", tt.name, encoding, tt.encoding)
+		}
+	}
+}
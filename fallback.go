@@ -0,0 +1,86 @@
+package unpack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// maxFallbackBuffer is the largest compressed body which is buffered in
+// order to try the codings set with WithDecodeFallbacks, unless the limit
+// set with WithMaxEncodedBytes is smaller, see fallbackBuffer.
+const maxFallbackBuffer = 10 << 20
+
+// fallbackBuffer returns the largest compressed body which h buffers in
+// order to try its fallbacks.
+func (h *Handler) fallbackBuffer() int64 {
+	if h.maxEncodedBytes > 0 && h.maxEncodedBytes < maxFallbackBuffer {
+		return h.maxEncodedBytes
+	}
+
+	return maxFallbackBuffer
+}
+
+// openFallbackBody is like openBody, but if src cannot be decoded
+// according to codings it tries each of the fallbacks of h in turn and
+// opens b for the first one which decodes src without errors. If none of
+// them do, b is opened for codings. Bodies larger than fallbackBuffer
+// are only decoded according to codings. The buffer counts towards the
+// in-flight budget of h until the body is closed.
+func (h *Handler) openFallbackBody(b *body, req *http.Request, codings []string, src io.Reader) error {
+	buf, err := h.readBuffered(src, h.fallbackBuffer()+1)
+	if err == errOverloaded {
+		return err
+	}
+
+	if err != nil {
+		return &DecompressionError{Encoding: codings[len(codings)-1], Err: err}
+	}
+
+	codings, src = h.pickFallback(b, req, codings, buf, src)
+	if err := h.openBody(b, req, codings, src); err != nil {
+		h.inflight.release(int64(len(buf)))
+		return err
+	}
+
+	b.release = func() { h.inflight.release(int64(len(buf))) }
+	return nil
+}
+
+// pickFallback returns the codings to decode b with for openFallbackBody,
+// and the reader to decode it from, given the start of the compressed body
+// in buf and the rest of it in src.
+func (h *Handler) pickFallback(b *body, req *http.Request, codings []string, buf []byte, src io.Reader) ([]string, io.Reader) {
+	if int64(len(buf)) > h.fallbackBuffer() {
+		return codings, io.MultiReader(bytes.NewReader(buf), src)
+	}
+
+	if h.decodes(b, req, codings, buf) {
+		return codings, bytes.NewReader(buf)
+	}
+
+	for _, coding := range h.fallbacks {
+		if h.supports(coding) && h.decodes(b, req, []string{coding}, buf) {
+			return []string{coding}, bytes.NewReader(buf)
+		}
+	}
+
+	return codings, bytes.NewReader(buf)
+}
+
+// decodes reports whether buf can be decoded according to codings without
+// errors, under the limits and by the deadline of b. Bodies which decode
+// to more bytes than b allows count as decoded, the limit is enforced
+// once the handler reads them. Trial decodes are not reported to hooks.
+func (h *Handler) decodes(b *body, req *http.Request, codings []string, buf []byte) bool {
+	trial := &body{limits: b.limits, deadline: b.deadline, trial: true}
+	defer trial.Close()
+	if err := h.openBody(trial, req, codings, bytes.NewReader(buf)); err != nil {
+		return false
+	}
+
+	_, err := io.Copy(ioutil.Discard, trial)
+	return err == nil || errors.Is(err, ErrLimitExceeded)
+}
@@ -0,0 +1,108 @@
+package unpack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeFallbacks(t *testing.T) {
+	for _, tt := range []struct {
+		file      string
+		encoding  string
+		fallbacks []string
+		opts      []Option
+		code      int
+		content   string
+	}{
+		{file: "testdata/hello.txt.zz", encoding: "gzip", fallbacks: []string{"deflate"}, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.gz", encoding: "deflate", fallbacks: []string{"zstd", "GZIP"}, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.gz.zz", encoding: "gzip, deflate", fallbacks: []string{"gzip"}, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.zz", encoding: "gzip", fallbacks: []string{"deflate"}, opts: []Option{WithMaxEncodedBytes(13)}, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.zz", encoding: "gzip", code: http.StatusBadRequest, content: "Content-Encoding: gzip set but unable to decompress body"},
+		{file: "testdata/hello.txt", encoding: "gzip", fallbacks: []string{"deflate"}, code: http.StatusBadRequest, content: "Content-Encoding: gzip set but unable to decompress body"},
+	} {
+		buf, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, append(tt.opts, WithDecodeFallbacks(tt.fallbacks...))...).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s %v: handler returned wrong status code: got %v want %v", tt.file, tt.fallbacks, rr.Code, tt.code)
+		}
+
+		if body := strings.TrimSuffix(rr.Body.String(), "\n"); body != tt.content {
+			t.Fatalf("%s %v: handler returned unexpected body: got '%v' want '%v'", tt.file, tt.fallbacks, body, tt.content)
+		}
+	}
+}
+
+func TestFallbackBuffer(t *testing.T) {
+	for _, tt := range []struct {
+		opts []Option
+		want int64
+	}{
+		{want: maxFallbackBuffer},
+		{opts: []Option{WithMaxEncodedBytes(1 << 20)}, want: 1 << 20},
+		{opts: []Option{WithMaxEncodedBytes(100 << 20)}, want: maxFallbackBuffer},
+		{opts: []Option{WithMaxEncodedBytes(0)}, want: maxFallbackBuffer},
+	} {
+		if got := New(requestBodyWriter{}, tt.opts...).fallbackBuffer(); got != tt.want {
+			t.Fatalf("%d options: got %d want %d", len(tt.opts), got, tt.want)
+		}
+	}
+}
+
+func TestFallbackTrials(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(make([]byte, 1<<20))
+	zw.Close()
+	gz := buf.Bytes()
+
+	// The trial decode of the gzip fallback must not report the ratio of
+	// the body on top of the decode which the handler does.
+	var calls int
+	onExceeded := func(r *http.Request, s Stats) { calls++ }
+	req := httptest.NewRequest("POST", "/test", bytes.NewReader(gz))
+	req.Header.Set("Content-Encoding", "deflate")
+	rr := httptest.NewRecorder()
+	New(errorBodyWriter{}, WithMaxRatio(10, onExceeded), WithDecodeFallbacks("gzip")).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	if calls != 1 {
+		t.Fatalf("ratio callback called %d times, want 1", calls)
+	}
+
+	// Trials stop at the limits and the deadline of the request. The body
+	// without its trailer decodes fine up to the limit.
+	h := New(requestBodyWriter{}, WithDecodeFallbacks("gzip"))
+	truncated := gz[:len(gz)-8]
+	for _, tt := range []struct {
+		body    *body
+		buf     []byte
+		decodes bool
+	}{
+		{body: &body{}, buf: gz, decodes: true},
+		{body: &body{}, buf: truncated, decodes: false},
+		{body: &body{limits: Limits{MaxDecodedBytes: 1 << 10}}, buf: truncated, decodes: true},
+		{body: &body{deadline: time.Now().Add(-time.Second)}, buf: gz, decodes: false},
+	} {
+		if got := h.decodes(tt.body, req, []string{EncodingGzip}, tt.buf); got != tt.decodes {
+			t.Fatalf("limits %+v, deadline %v, %d bytes: got %v want %v", tt.body.limits, tt.body.deadline, len(tt.buf), got, tt.decodes)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+module github.com/njern/unpack
+
+go 1.22
+
+require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/golang/snappy v1.0.0
+	github.com/klauspost/compress v1.18.0
+	github.com/pierrec/lz4/v4 v4.1.21
+	github.com/ulikunitz/xz v0.5.15
+)
@@ -0,0 +1,72 @@
+package unpack
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// errOverloaded is returned when a request body would have to be buffered
+// while the Handler already buffers as many bytes as it may.
+var errOverloaded = errors.New("unpack: too many buffered request bodies in flight")
+
+// budget keeps track of the bytes buffered by all requests in flight. A
+// nil budget is unlimited.
+type budget struct {
+	max  int64
+	used int64 // Accessed atomically.
+}
+
+// reserve reserves n bytes of the budget, unless that would exceed it.
+func (b *budget) reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+
+	if atomic.AddInt64(&b.used, n) > b.max {
+		atomic.AddInt64(&b.used, -n)
+		return false
+	}
+
+	return true
+}
+
+// release returns n reserved bytes to the budget.
+func (b *budget) release(n int64) {
+	if b != nil {
+		atomic.AddInt64(&b.used, -n)
+	}
+}
+
+// readBuffered reads src into memory until EOF or until max bytes have
+// been read, reserving the bytes read from the in-flight budget of h as it
+// goes. It fails with errOverloaded if the budget runs out. Unless it
+// fails, the caller has to release len of the returned slice once it is
+// done with it.
+func (h *Handler) readBuffered(src io.Reader, max int64) ([]byte, error) {
+	var buf []byte
+	p := make([]byte, 32<<10)
+	for int64(len(buf)) < max {
+		if remaining := max - int64(len(buf)); int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+
+		n, err := src.Read(p)
+		if !h.inflight.reserve(int64(n)) {
+			h.inflight.release(int64(len(buf)))
+			return nil, errOverloaded
+		}
+
+		buf = append(buf, p[:n]...)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			h.inflight.release(int64(len(buf)))
+			return nil, err
+		}
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,61 @@
+package unpack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestMaxInflightBytes(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Room for one buffered body, but not for two.
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			entered <- struct{}{}
+			<-unblock
+		}
+
+		requestBodyWriter{}.ServeHTTP(w, r)
+	}), WithDecodeFallbacks("deflate"), WithMaxInflightBytes(int64(len(buf)*3/2)))
+
+	serve := func(path string) int {
+		req := httptest.NewRequest("POST", path, bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if code := serve("/block"); code != http.StatusOK {
+			t.Errorf("blocking request: got status %v want %v", code, http.StatusOK)
+		}
+	}()
+
+	<-entered
+	if code := serve("/test"); code != http.StatusServiceUnavailable {
+		t.Fatalf("concurrent request: got status %v want %v", code, http.StatusServiceUnavailable)
+	}
+
+	close(unblock)
+	wg.Wait()
+
+	// The budget is released once the blocking request is done.
+	for i := 0; i < 3; i++ {
+		if code := serve("/test"); code != http.StatusOK {
+			t.Fatalf("later request: got status %v want %v", code, http.StatusOK)
+		}
+	}
+}
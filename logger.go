@@ -0,0 +1,71 @@
+package unpack
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+// A Logger logs structured records about what a Handler does with request
+// bodies, see WithLogger. A *slog.Logger is a Logger, and the zap and
+// logrus subpackages adapt the loggers of those packages.
+type Logger interface {
+	// Enabled reports whether records at level are logged, so that the
+	// Handler can skip building them if not.
+	Enabled(ctx context.Context, level slog.Level) bool
+
+	// LogAttrs logs a record with the given level, message and attributes.
+	LogAttrs(ctx context.Context, level slog.Level, msg string, attrs ...slog.Attr)
+}
+
+// logHooks log what a Handler does with request bodies, see WithLogger.
+type logHooks struct {
+	logger Logger
+}
+
+// done logs a request which a Handler passed on, see WithOnDone.
+func (l logHooks) done(r *http.Request, s Stats) {
+	level, msg := slog.LevelDebug, "unpack: decoded request body"
+	if s.Err != nil {
+		level, msg = slog.LevelWarn, "unpack: unable to decode request body"
+	}
+
+	if !l.logger.Enabled(r.Context(), level) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("encoding", s.Encoding),
+		slog.Int64("encoded_bytes", s.EncodedBytes),
+		slog.Int64("decoded_bytes", s.DecodedBytes),
+		slog.Duration("duration", s.DecodeDuration),
+	}
+
+	if s.Raw {
+		attrs = append(attrs, slog.Bool("raw", true))
+	}
+
+	if s.Err != nil {
+		attrs = append(attrs,
+			slog.String("error_class", ClassifyError(s.Err).String()),
+			slog.String("error", s.Err.Error()))
+	}
+
+	l.logger.LogAttrs(r.Context(), level, msg, attrs...)
+}
+
+// rejected logs a request which a Handler rejected, see WithOnError.
+func (l logHooks) rejected(r *http.Request, info ErrorInfo) {
+	if !l.logger.Enabled(r.Context(), slog.LevelWarn) {
+		return
+	}
+
+	l.logger.LogAttrs(r.Context(), slog.LevelWarn, "unpack: rejected request",
+		slog.String("encoding", info.Encoding),
+		slog.Int64("encoded_bytes", info.EncodedBytes),
+		slog.Int64("decoded_bytes", info.DecodedBytes),
+		slog.Duration("duration", info.Duration),
+		slog.String("error_class", info.Class.String()),
+		slog.String("error", info.Err.Error()),
+	)
+}
@@ -0,0 +1,111 @@
+package unpack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSlog(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		body     []byte
+		encoding string
+		level    slog.Level
+		record   map[string]interface{}
+	}{
+		{body: buf, encoding: "gzip", level: slog.LevelDebug, record: map[string]interface{}{
+			"level":         "DEBUG",
+			"msg":           "unpack: decoded request body",
+			"encoding":      "gzip",
+			"decoded_bytes": float64(5),
+		}},
+		{body: buf, encoding: "gzip", level: slog.LevelInfo},
+		{body: []byte("hello"), encoding: "gzip", level: slog.LevelInfo, record: map[string]interface{}{
+			"level":       "WARN",
+			"msg":         "unpack: rejected request",
+			"encoding":    "gzip",
+			"error_class": "malformed",
+		}},
+		{body: buf, encoding: "gzip, made-up", level: slog.LevelInfo, record: map[string]interface{}{
+			"level":         "WARN",
+			"msg":           "unpack: rejected request",
+			"encoding":      "gzip, made-up",
+			"encoded_bytes": float64(0),
+			"error_class":   "unsupported",
+		}},
+	} {
+		var out bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: tt.level}))
+		handler := New(errorBodyWriter{}, WithSlog(logger))
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if tt.record == nil {
+			if out.Len() != 0 {
+				t.Fatalf("%s: unexpected record: %s", tt.encoding, out.String())
+			}
+
+			continue
+		}
+
+		var record map[string]interface{}
+		if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+			t.Fatalf("%s: want exactly one record: %v: %s", tt.encoding, err, out.String())
+		}
+
+		for k, want := range tt.record {
+			if got := record[k]; got != want {
+				t.Fatalf("%s: wrong %s: got %v want %v", tt.encoding, k, got, want)
+			}
+		}
+	}
+}
+
+// recordingLogger is a Logger which keeps the messages of the records it
+// logs, for levels from level up.
+type recordingLogger struct {
+	level slog.Level
+	msgs  []string
+}
+
+func (l *recordingLogger) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= l.level
+}
+
+func (l *recordingLogger) LogAttrs(ctx context.Context, level slog.Level, msg string, attrs ...slog.Attr) {
+	if level < l.level {
+		panic("logged a record at a disabled level")
+	}
+
+	l.msgs = append(l.msgs, msg)
+}
+
+func TestLogger(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := &recordingLogger{level: slog.LevelInfo}
+	handler := New(errorBodyWriter{}, WithLogger(logger))
+	for _, body := range [][]byte{buf, []byte("hello")} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(body))
+		req.Header.Set("Content-Encoding", "gzip")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if len(logger.msgs) != 1 || logger.msgs[0] != "unpack: rejected request" {
+		t.Fatalf("wrong records: %q", logger.msgs)
+	}
+}
@@ -0,0 +1,56 @@
+// Package logrus adapts logrus loggers to unpack.Logger, for services which
+// log with github.com/sirupsen/logrus rather than log/slog:
+//
+//	handler := unpack.New(next, unpack.WithLogger(logrus.New(logger)))
+package logrus
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/njern/unpack"
+	"github.com/sirupsen/logrus"
+)
+
+// logger is an unpack.Logger logging to a *logrus.Entry.
+type logger struct {
+	e *logrus.Entry
+}
+
+// New returns an unpack.Logger which logs to l. Attributes become fields
+// of the same names, and records carry the context of the request.
+func New(l *logrus.Logger) unpack.Logger {
+	return NewEntry(logrus.NewEntry(l))
+}
+
+// NewEntry is New for an entry, whose fields are added to every record.
+func NewEntry(e *logrus.Entry) unpack.Logger {
+	return logger{e: e}
+}
+
+func (l logger) Enabled(ctx context.Context, level slog.Level) bool {
+	return l.e.Logger.IsLevelEnabled(logrusLevel(level))
+}
+
+func (l logger) LogAttrs(ctx context.Context, level slog.Level, msg string, attrs ...slog.Attr) {
+	fields := make(logrus.Fields, len(attrs))
+	for _, a := range attrs {
+		fields[a.Key] = a.Value.Any()
+	}
+
+	l.e.WithContext(ctx).WithFields(fields).Log(logrusLevel(level), msg)
+}
+
+// logrusLevel returns the logrus level of the slog level level.
+func logrusLevel(level slog.Level) logrus.Level {
+	switch {
+	case level < slog.LevelInfo:
+		return logrus.DebugLevel
+	case level < slog.LevelWarn:
+		return logrus.InfoLevel
+	case level < slog.LevelError:
+		return logrus.WarnLevel
+	default:
+		return logrus.ErrorLevel
+	}
+}
@@ -0,0 +1,86 @@
+package logrus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/njern/unpack"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// drain reads the body of each request.
+var drain = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+})
+
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestLogger(t *testing.T) {
+	for _, tt := range []struct {
+		body    []byte
+		level   logrus.Level
+		want    logrus.Level
+		message string
+		class   string
+	}{
+		{body: gzipped(t, "hello"), level: logrus.DebugLevel, want: logrus.DebugLevel, message: "unpack: decoded request body"},
+		{body: gzipped(t, "hello"), level: logrus.InfoLevel},
+		{body: []byte("hello"), level: logrus.InfoLevel, want: logrus.WarnLevel, message: "unpack: rejected request", class: "malformed"},
+	} {
+		l, hook := test.NewNullLogger()
+		l.SetLevel(tt.level)
+		logger := NewEntry(l.WithFields(logrus.Fields{"service": "test"}))
+		handler := unpack.New(drain, unpack.WithLogger(logger))
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewReader(tt.body))
+		req.Header.Set("Content-Encoding", "gzip")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		entries := hook.AllEntries()
+		if tt.message == "" {
+			if len(entries) != 0 {
+				t.Fatalf("unexpected entries: %v", entries)
+			}
+
+			continue
+		}
+
+		if len(entries) != 1 {
+			t.Fatalf("%s: got %d entries want 1", tt.message, len(entries))
+		}
+
+		e := entries[0]
+		if e.Level != tt.want || e.Message != tt.message {
+			t.Fatalf("wrong entry: got %v %q want %v %q", e.Level, e.Message, tt.want, tt.message)
+		}
+
+		if e.Data["encoding"] != "gzip" || e.Data["service"] != "test" {
+			t.Fatalf("%s: wrong fields: %v", tt.message, e.Data)
+		}
+
+		if tt.class != "" && e.Data["error_class"] != tt.class {
+			t.Fatalf("%s: wrong error class: got %v want %s", tt.message, e.Data["error_class"], tt.class)
+		}
+
+		if e.Context == nil {
+			t.Fatalf("%s: entry does not carry the context of the request", tt.message)
+		}
+	}
+}
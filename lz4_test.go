@@ -0,0 +1,88 @@
+package unpack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// lz4Frame compresses content into an LZ4 frame written with opts.
+func lz4Frame(t *testing.T, content string, opts ...lz4.Option) []byte {
+	var b bytes.Buffer
+	zw := lz4.NewWriter(&b)
+	if err := zw.Apply(opts...); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := zw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestLZ4Reader(t *testing.T) {
+	hello := lz4Frame(t, "hello")
+	large := strings.Repeat("hello, world\n", 100000)
+
+	// The content checksum is at the end of the frame.
+	badChecksum := append([]byte(nil), hello...)
+	badChecksum[len(badChecksum)-1] ^= 0xff
+
+	for _, tt := range []struct {
+		name    string
+		frame   []byte
+		content string
+		ok      bool
+	}{
+		{name: "content checksum", frame: hello, content: "hello", ok: true},
+		{name: "block checksums", frame: lz4Frame(t, "hello", lz4.BlockChecksumOption(true)), content: "hello", ok: true},
+		{name: "large blocks", frame: lz4Frame(t, large, lz4.BlockSizeOption(lz4.Block4Mb)), content: large, ok: true},
+		{name: "many blocks", frame: lz4Frame(t, large, lz4.BlockSizeOption(lz4.Block64Kb)), content: large, ok: true},
+		{
+			// "hello world" in an uncompressed block, then an 11 byte match
+			// at offset 11 referring to it, then "!".
+			name:    "dependent blocks",
+			frame:   []byte("\x04\"M\x18D@^\v\x00\x00\x80hello world\x05\x00\x00\x00\a\v\x00\x10!\x00\x00\x00\x00 \xfe\xe0^"),
+			content: "hello worldhello world!",
+			ok:      true,
+		},
+		{
+			name:    "skippable and concatenated frames",
+			frame:   concat([]byte("\x5a\x2a\x4d\x18\x03\x00\x00\x00abc"), hello, lz4Frame(t, "world")),
+			content: "helloworld",
+			ok:      true,
+		},
+		{name: "independent blocks cannot refer back", frame: []byte("\x04\"M\x18`@\x82\v\x00\x00\x80hello world\x05\x00\x00\x00\a\v\x00\x10!\x00\x00\x00\x00")},
+		{name: "bad content checksum", frame: badChecksum},
+		{name: "truncated", frame: hello[:10]},
+		{name: "trailing garbage", frame: concat(hello, []byte("garbage"))},
+		{name: "not lz4", frame: []byte("hello")},
+		{name: "empty"},
+	} {
+		var content []byte
+		zr, err := New(nil).newLZ4Reader(nil, bytes.NewReader(tt.frame))
+		if err == nil {
+			content, err = ioutil.ReadAll(zr)
+		}
+
+		if tt.ok != (err == nil) {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+
+		if tt.ok && string(content) != tt.content {
+			t.Fatalf("%s: got %d bytes want %d", tt.name, len(content), len(tt.content))
+		}
+	}
+}
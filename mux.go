@@ -0,0 +1,45 @@
+package unpack
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Mux returns an http.Handler which passes each request on to the Handler
+// registered under the longest prefix of its URL path. Prefixes are
+// matched as plain strings, so "/api/" matches "/api/v1/status" but not
+// "/api" or "/apiv2/". Requests which match no prefix are passed on to
+// fallback, or answered with 404 Not Found if fallback is nil.
+//
+// Mux makes it possible to apply different unpacking policies to
+// different parts of a site, e.g. a capped Handler for "/api/" and a
+// lenient one for "/".
+func Mux(handlers map[string]*Handler, fallback http.Handler) http.Handler {
+	prefixes := make([]string, 0, len(handlers))
+	for prefix := range handlers {
+		prefixes = append(prefixes, prefix)
+	}
+
+	// Try longer prefixes first so that the first match is the longest.
+	sort.Slice(prefixes, func(i, j int) bool {
+		return len(prefixes[i]) > len(prefixes[j])
+	})
+
+	if fallback == nil {
+		fallback = http.NotFoundHandler()
+	}
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				handlers[prefix].ServeHTTP(w, r)
+				return
+			}
+		}
+
+		fallback.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
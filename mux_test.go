@@ -0,0 +1,47 @@
+package unpack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMux(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := Mux(map[string]*Handler{
+		"/api/": New(requestBodyWriter{}, WithMaxDecodedBytes(4)),
+		"/":     New(requestBodyWriter{}),
+	}, nil)
+
+	for _, tt := range []struct {
+		path string
+		code int
+	}{
+		{path: "/api/v1/status", code: http.StatusInternalServerError},
+		{path: "/api", code: http.StatusOK},
+		{path: "/upload", code: http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", tt.path, bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.path, rr.Code, tt.code)
+		}
+	}
+
+	// Paths matching no prefix go to the fallback.
+	mux = Mux(map[string]*Handler{"/api/": New(requestBodyWriter{})}, nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/other", bytes.NewBuffer(buf)))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
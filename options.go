@@ -0,0 +1,1075 @@
+package unpack
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// An Option configures a Handler created by New.
+type Option func(*Handler)
+
+// WithSkipper sets a function which tells the Handler which requests to
+// pass on untouched, e.g. health checks or signed uploads whose encoded
+// bodies have to reach the handler as they are. Requests for which skip
+// returns true are not looked at in any other way.
+func WithSkipper(skip func(*http.Request) bool) Option {
+	return func(h *Handler) {
+		h.skipper = skip
+	}
+}
+
+// WithMethods restricts decoding to the bodies of requests with the given
+// methods, e.g. WithMethods(http.MethodPost, http.MethodPut). Other
+// requests are passed on untouched. By default requests with any method
+// are decoded.
+func WithMethods(methods ...string) Option {
+	return func(h *Handler) {
+		h.methods = make(map[string]bool, len(methods))
+		for _, method := range methods {
+			h.methods[strings.ToUpper(method)] = true
+		}
+	}
+}
+
+// WithPathPrefix restricts decoding to the bodies of requests whose URL
+// path starts with one of the given prefixes, e.g. WithPathPrefix("/api/").
+// Other requests are passed on untouched. It can be combined with
+// WithPathMatcher, in which case paths have to match either. By default
+// requests with any path are decoded.
+func WithPathPrefix(prefixes ...string) Option {
+	return WithPathMatcher(func(path string) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// WithPathMatcher restricts decoding to the bodies of requests whose URL
+// path match reports true for. Other requests are passed on untouched.
+// Used more than once, or together with WithPathPrefix, paths have to
+// match any of them. By default requests with any path are decoded.
+func WithPathMatcher(match func(path string) bool) Option {
+	return func(h *Handler) {
+		h.pathMatchers = append(h.pathMatchers, match)
+	}
+}
+
+// WithSetVaryOnDecode controls whether Content-Encoding is added to the
+// Vary header of the response when the request body was decoded, which
+// helps caches in front of content-negotiated endpoints. Requests which
+// are passed on as they are do not get the header.
+func WithSetVaryOnDecode(enabled bool) Option {
+	return func(h *Handler) {
+		h.setVary = enabled
+	}
+}
+
+// WithMaxDecodedBytes caps the size of decoded request bodies at n bytes.
+// Reading past the cap fails with ErrLimitExceeded, which handlers can
+// answer with HTTP 413 using Error. A cap of zero or less means that
+// decoded bodies may be of any size, which is the default.
+func WithMaxDecodedBytes(n int64) Option {
+	return func(h *Handler) {
+		h.maxDecodedBytes = n
+	}
+}
+
+// WithLimitFor caps the size of decoded request bodies in the given
+// content coding at n bytes, instead of the cap set with
+// WithMaxDecodedBytes, e.g. to allow large zstd bodies while keeping
+// deflate ones small. A cap of zero or less means that bodies in the
+// coding may be of any size. Bodies in several codings are capped at the
+// smallest of their caps.
+func WithLimitFor(encoding string, n int64) Option {
+	return func(h *Handler) {
+		if h.codingLimits == nil {
+			h.codingLimits = make(map[string]int64)
+		}
+
+		for _, coding := range parseCodings(encoding) {
+			h.codingLimits[coding] = n
+		}
+	}
+}
+
+// Limits are limits on decoding the body of a request, see
+// WithLimitResolver. Fields left zero keep the limit the Handler was
+// configured with, and fields less than zero lift it.
+type Limits struct {
+	// MaxDecodedBytes caps the decoded size of the body, replacing any
+	// cap set with WithMaxDecodedBytes or WithLimitFor.
+	MaxDecodedBytes int64
+
+	// MaxRatio caps the ratio of decoded to encoded bytes, see
+	// WithMaxRatio.
+	MaxRatio float64
+
+	// DecodeTimeout bounds the time spent decoding the body, see
+	// WithDecodeTimeout.
+	DecodeTimeout time.Duration
+}
+
+// maxDecodedBytes returns the cap on the decoded size of a body under l,
+// given the configured cap, which is lifted if it is zero or less.
+func (l Limits) maxDecodedBytes(configured int64) int64 {
+	if l.MaxDecodedBytes != 0 {
+		return l.MaxDecodedBytes
+	}
+
+	return configured
+}
+
+// maxRatio is like maxDecodedBytes, for the ratio cap.
+func (l Limits) maxRatio(configured float64) float64 {
+	if l.MaxRatio != 0 {
+		return l.MaxRatio
+	}
+
+	return configured
+}
+
+// decodeTimeout is like maxDecodedBytes, for the decode timeout.
+func (l Limits) decodeTimeout(configured time.Duration) time.Duration {
+	if l.DecodeTimeout != 0 {
+		return l.DecodeTimeout
+	}
+
+	return configured
+}
+
+// WithLimitResolver makes the Handler call resolve for each request whose
+// body it decodes, to get the limits for it, e.g. from the plan of the
+// tenant which sent it, as stored in the request context by an earlier
+// middleware. Caps set with WithLimitOverride take precedence.
+func WithLimitResolver(resolve func(r *http.Request) Limits) Option {
+	return func(h *Handler) {
+		h.limitResolver = resolve
+	}
+}
+
+// WithLimitOverride lets trusted requests set the cap on the decoded size
+// of their own body in the header with the given name, e.g. X-Unpack-Limit,
+// for gateways which know more about each client than the service does.
+// The cap, a number of bytes, replaces any cap set with
+// WithMaxDecodedBytes or WithLimitFor, so it may raise or lower them, and
+// a cap of zero or less lifts them. Requests are only trusted if trusted
+// returns true for them, and caps which are not a valid number are
+// ignored. The header is removed from requests whose body the Handler
+// decodes, whether they are trusted or not.
+func WithLimitOverride(header string, trusted func(r *http.Request) bool) Option {
+	return func(h *Handler) {
+		h.limitHeader = http.CanonicalHeaderKey(header)
+		h.trusted = trusted
+	}
+}
+
+// WithMaxEncodedBytes caps the size of the request bodies the Handler
+// decodes at n bytes as sent by the client, before they are decoded, so
+// that clients which send large amounts of data slowly can be cut off
+// before all of it has been decoded. Reading past the cap fails with
+// ErrLimitExceeded, like reading past the cap on decoded bodies. Requests
+// whose Content-Length exceeds the cap fail with HTTP 413 before any of
+// their body is read, so clients which send Expect: 100-continue never
+// send it. A cap of zero or less means that bodies may be of any size,
+// which is the default.
+func WithMaxEncodedBytes(n int64) Option {
+	return func(h *Handler) {
+		h.maxEncodedBytes = n
+	}
+}
+
+// WithMaxRatio caps the ratio of the size of decoded request bodies to
+// their size as sent by the client at ratio, e.g. 100 for 100:1, to stop
+// decompression bombs earlier than a cap on the decoded size would. The
+// ratio is only checked once a body has decoded to 64KB. Reading past the
+// cap fails with ErrLimitExceeded, like reading past the cap on decoded
+// bodies, and calls onExceeded, if not nil, with the request and the Stats
+// of the body so far. A ratio of zero or less means that bodies may have
+// any ratio, which is the default.
+func WithMaxRatio(ratio float64, onExceeded func(r *http.Request, s Stats)) Option {
+	return func(h *Handler) {
+		h.maxRatio = ratio
+		h.onRatio = onExceeded
+	}
+}
+
+// WithDecodeTimeout caps the time the Handler allows for reading and
+// decoding the body of a request at d, counted from when it starts to
+// decode it, so that clients which send their bodies very slowly cannot
+// tie up a handler for good. Reading the body after that fails with
+// ErrDecodeTimeout, and requests whose response has not been written yet
+// fail with HTTP 408. The deadline applies to reads from the connection
+// too, as long as the ResponseWriter supports read deadlines, see
+// http.ResponseController, and is cleared once the body has been read or
+// closed. A d of zero or less means that there is no deadline, which is
+// the default.
+func WithDecodeTimeout(d time.Duration) Option {
+	return func(h *Handler) {
+		h.decodeTimeout = d
+	}
+}
+
+// WithDecodeContentTypes restricts decoding to request bodies of the given
+// media types, e.g. "application/json". Media types are matched without
+// their parameters and case-insensitively. Bodies of any other type are
+// passed on untouched, even if they have a supported Content-Encoding.
+func WithDecodeContentTypes(types ...string) Option {
+	return func(h *Handler) {
+		h.decodeTypes = make(map[string]bool, len(types))
+		for _, t := range types {
+			h.decodeTypes[strings.ToLower(strings.TrimSpace(t))] = true
+		}
+	}
+}
+
+// WithSkipContentTypes makes the Handler pass on request bodies of the
+// given media types untouched, even if they have a supported
+// Content-Encoding, e.g. uploads of "application/gzip" archives which
+// clients label as gzip-encoded. Media types are matched like those set
+// with WithDecodeContentTypes, which they take precedence over.
+func WithSkipContentTypes(types ...string) Option {
+	return func(h *Handler) {
+		h.skipTypes = make(map[string]bool, len(types))
+		for _, t := range types {
+			h.skipTypes[strings.ToLower(strings.TrimSpace(t))] = true
+		}
+	}
+}
+
+// WithDecodeFallbacks sets content codings to try, in order, when a body
+// cannot be decoded according to its Content-Encoding, which helps with
+// clients that mislabel their bodies. Trying the fallbacks means reading
+// the whole body, so bodies are buffered in memory, up to 10MB or the
+// limit set with WithMaxEncodedBytes, whichever is smaller. Larger bodies
+// are only decoded according to their Content-Encoding. Bodies are tried
+// under the limits and the decode timeout which apply to the request, see
+// WithLimitResolver, and trials are not reported to any hooks.
+// Unsupported or disallowed codings are ignored. By default no fallbacks
+// are tried.
+func WithDecodeFallbacks(codings ...string) Option {
+	return func(h *Handler) {
+		h.fallbacks = parseCodings(strings.Join(codings, ","))
+	}
+}
+
+// WithAllowedEncodings restricts decoding to the given content codings,
+// e.g. WithAllowedEncodings(EncodingGzip). Bodies in any other coding are
+// passed on untouched, just like bodies in unsupported codings. By default
+// all supported codings are decoded.
+func WithAllowedEncodings(codings ...string) Option {
+	return func(h *Handler) {
+		h.allowed = make(map[string]bool, len(codings))
+		for _, coding := range parseCodings(strings.Join(codings, ",")) {
+			h.allowed[coding] = true
+		}
+	}
+}
+
+// WithDeniedEncodings stops the Handler from decoding the given content
+// codings, e.g. WithDeniedEncodings(EncodingDeflate), even if they are
+// allowed with WithAllowedEncodings. Bodies in them are passed on
+// untouched, just like bodies in unsupported codings, unless the Handler
+// is strict about the header, see WithStrictContentEncoding.
+func WithDeniedEncodings(codings ...string) Option {
+	return func(h *Handler) {
+		h.denied = make(map[string]bool, len(codings))
+		for _, coding := range parseCodings(strings.Join(codings, ",")) {
+			h.denied[coding] = true
+		}
+	}
+}
+
+// WithUnknownEncodingWarning makes the Handler flag requests in content
+// codings which it does not decode, or which are not allowed, and which it
+// passes on untouched: it adds a Warning header (RFC 7234 section 5.5)
+// with warn-code 299 to their response and calls report, if not nil, with
+// the request and the first such coding. This helps to find out which
+// codings clients send before being strict about them, see
+// WithStrictContentEncoding. By default these requests are not flagged.
+func WithUnknownEncodingWarning(enabled bool, report func(r *http.Request, coding string)) Option {
+	return func(h *Handler) {
+		h.warnUnknown = enabled
+		h.onUnknown = report
+	}
+}
+
+// WithOnError makes the Handler call f for each request it rejects, before
+// responding to it, e.g. to feed rejections to abuse detection. f must not
+// write a response, which is left to the error handler, see
+// WithErrorHandler. WithOnError adds to the hooks set before, so that
+// several of them, e.g. for logging and metrics, can be used at once.
+func WithOnError(f func(r *http.Request, info ErrorInfo)) Option {
+	return func(h *Handler) {
+		h.onError = append(h.onError, f)
+	}
+}
+
+// WithOnDone makes the Handler call f with the final Stats of each request
+// it passes on with a body which it decoded, or tried to, see WithFailOpen,
+// once the next handler has returned, e.g. to collect metrics. Requests
+// which the Handler rejects, including those rejected with Error or after
+// their checksums were verified, are reported to the hooks set with
+// WithOnError instead. Like WithOnError, WithOnDone adds to the hooks set
+// before.
+func WithOnDone(f func(r *http.Request, s Stats)) Option {
+	return func(h *Handler) {
+		h.onDone = append(h.onDone, f)
+	}
+}
+
+// WithServerTiming makes the Handler add a Server-Timing metric named
+// unpack to the responses to requests whose body it decodes, with the time
+// spent decoding the body until the response was written, in
+// milliseconds, and its encoding, e.g.
+//
+//	Server-Timing: unpack;dur=1.234;desc="gzip"
+//
+// so that decompression overhead shows up in browser developer tools.
+// Responses to requests rejected because of their body get one too.
+func WithServerTiming(enabled bool) Option {
+	return func(h *Handler) {
+		h.serverTiming = enabled
+	}
+}
+
+// WithDebugHeaders makes the Handler describe the body of each request
+// it decodes in headers of the response, as of when the response was
+// written, to help diagnose client compression issues:
+//
+//   - X-Unpack-Encoding lists the content codings of the body.
+//   - X-Unpack-Compressed-Bytes is the number of bytes of the body as
+//     sent which were read.
+//   - X-Unpack-Decoded-Bytes is the number of decoded bytes read.
+//   - X-Unpack-Error is the class of the error the request was rejected
+//     for, if it was, see ErrorClass.
+//
+// They tell clients how the service handles their bodies, so they are
+// best left to staging and test environments.
+func WithDebugHeaders(enabled bool) Option {
+	return func(h *Handler) {
+		h.debugHeaders = enabled
+	}
+}
+
+// WithDebugCounters makes the Handler count the requests whose body it
+// decodes, or rejects, the way WithExpvar does, for DebugHandler to render
+// without publishing them. Counting adds to the hooks of the Handler, see
+// WithOnDone and WithOnError, so it is off by default.
+func WithDebugCounters(enabled bool) Option {
+	return func(h *Handler) {
+		h.debugCounters = enabled
+	}
+}
+
+// WithPprofLabels makes the Handler decode request bodies with pprof
+// labels set, so that CPU profiles attribute decompression cost to the
+// encoding of the body, in an unpack.encoding label, e.g. "gzip", and, if
+// route is not nil and returns a non-empty string for the request, to its
+// route, in an unpack.route label. Setting labels for each read of a body
+// has a cost, which is why it is optional.
+func WithPprofLabels(route func(r *http.Request) string) Option {
+	return func(h *Handler) {
+		h.pprofLabels = true
+		h.pprofRoute = route
+	}
+}
+
+// WithRatioTracker makes the Handler feed t with the sizes of the
+// request bodies it decodes, and of those which were sent without a
+// content coding, see RatioTracker. Several Handlers may feed the same
+// RatioTracker. It adds to the hooks of the Handler, see WithOnDone.
+func WithRatioTracker(t *RatioTracker) Option {
+	return func(h *Handler) {
+		h.ratios = t
+		h.onDone = append(h.onDone, t.done)
+	}
+}
+
+// WithDecodeBreaker makes the Handler stop decoding the bodies of the
+// requests with a key, e.g. a client address or API key, once threshold
+// bodies of such requests failed to decode within window, protecting the
+// CPU from clients stuck sending corrupt data. Until window has passed,
+// their requests with encoded bodies are rejected with HTTP 429 and a
+// Retry-After header, or with the status set with WithStatusMapping for
+// ClassThrottled, e.g. 415. key returns the key of a request, or "" for
+// requests which are never short-circuited. If key is nil requests are
+// keyed by the IP address of the client, which is only the right key if
+// no proxy is in between. A threshold or window of zero or less turns off
+// a breaker set by an earlier option.
+func WithDecodeBreaker(key func(r *http.Request) string, threshold int, window time.Duration) Option {
+	return func(h *Handler) {
+		h.breaker = nil
+		if threshold > 0 && window > 0 {
+			h.breaker = newBreaker(key, threshold, window)
+		}
+	}
+}
+
+// WithTee makes the Handler copy the decoded body of each request to the
+// writer f returns for it, as it is read, e.g. so that compliance teams
+// can archive exactly what the next handler saw. Parts of the body which
+// the Handler reads itself, e.g. to verify checksums, are copied too. f
+// may return nil for requests whose bodies are not to be copied. If the
+// writer is an io.Closer, it is closed once the body is closed. The copy
+// stops at the first error writing to the writer, without failing the
+// request, so writers which must not lose data have to deal with errors
+// themselves.
+func WithTee(f func(r *http.Request) io.Writer) Option {
+	return func(h *Handler) {
+		h.tee = f
+	}
+}
+
+// WithSlowDecodes makes the Handler call f with the DecodeStats of the
+// requests whose bodies took at least threshold to decode, if threshold is
+// positive, and of those among the given percentage of the slowest decodes
+// of the last 1024, if percent is positive, e.g. to log them:
+//
+//	unpack.WithSlowDecodes(100*time.Millisecond, 1, func(r *http.Request, s unpack.DecodeStats) {
+//		slog.Warn("slow decode", "remote_addr", r.RemoteAddr, "encoding", s.Encoding,
+//			"encoded_bytes", s.EncodedBytes, "decoded_bytes", s.DecodedBytes, "duration", s.Duration)
+//	})
+//
+// This finds pathological clients without logging every request. The
+// slowest decodes are only picked out once the Handler has seen a few
+// dozen of them. f is called once the next handler has returned or the
+// request has been rejected. It adds to the hooks of the Handler, see
+// WithOnDone and WithOnError.
+func WithSlowDecodes(threshold time.Duration, percent float64, f func(r *http.Request, s DecodeStats)) Option {
+	return func(h *Handler) {
+		s := &slowDecodes{threshold: threshold, percent: percent, f: f}
+		h.onDone = append(h.onDone, s.done)
+		h.onError = append(h.onError, s.rejected)
+	}
+}
+
+// WithOnDecode makes the Handler call f with the DecodeStats of each
+// request whose body it decodes, or tries to, once the next handler has
+// returned or the request has been rejected, whichever the outcome, e.g.
+// to bill clients for the bytes they made the service decode. It adds to
+// the hooks of the Handler, see WithOnDone and WithOnError.
+func WithOnDecode(f func(DecodeStats)) Option {
+	return func(h *Handler) {
+		h.onDone = append(h.onDone, func(r *http.Request, s Stats) {
+			f(decodeStats(s))
+		})
+		h.onError = append(h.onError, func(r *http.Request, info ErrorInfo) {
+			f(rejectedStats(info))
+		})
+	}
+}
+
+// WithExpvar makes the Handler count the requests whose body it decodes,
+// or rejects, in an expvar.Map published as name, e.g. "unpack", so that
+// they show up at /debug/vars without a metrics stack. The map holds maps
+// of counters: requests, encoded_bytes and decoded_bytes by encoding, e.g.
+// "gzip", and errors by class, see ErrorClass. Bodies in codings which the
+// Handler does not decode are counted as "other". Handlers created with the
+// same name share the counters. It adds to the hooks of the Handler, see
+// WithOnDone and WithOnError.
+func WithExpvar(name string) Option {
+	return func(h *Handler) {
+		c := newExpvarCounters(name)
+		h.onDone = append(h.onDone, c.done)
+		h.onError = append(h.onError, c.rejected)
+	}
+}
+
+// WithLogger makes the Handler log a structured record with logger for
+// each request it rejects, at the warning level, and for each request
+// whose body it decodes, at the debug level, or at the warning level if
+// the body turns out to be corrupt. Records list the encoding of the body,
+// its encoded and decoded sizes, the time spent decoding it and, for
+// failures, the class of the error, see ErrorClass, and the error itself.
+// Whether successful decodes are logged is up to the level of logger. It
+// adds to the hooks of the Handler, see WithOnDone and WithOnError.
+func WithLogger(logger Logger) Option {
+	return func(h *Handler) {
+		l := logHooks{logger: logger}
+		h.onDone = append(h.onDone, l.done)
+		h.onError = append(h.onError, l.rejected)
+	}
+}
+
+// WithSlog is WithLogger for a *slog.Logger.
+func WithSlog(logger *slog.Logger) Option {
+	return WithLogger(logger)
+}
+
+// WithFailureCapture makes the Handler call capture with the first n bytes
+// of each request body whose decoders fail, as sent by the client and
+// hex-encoded, along with the error, so that broken bodies can be looked
+// into. Only what the decoders read before they failed is captured, and n
+// is capped at 4KB. The bytes may well be sensitive, so they are never
+// part of responses or errors, and capture is the only place they end up.
+// Bodies which exceed a limit or time out are not captured.
+func WithFailureCapture(n int, capture func(r *http.Request, err error, prefix string)) Option {
+	return func(h *Handler) {
+		if n > maxCaptureBytes {
+			n = maxCaptureBytes
+		}
+
+		h.captureBytes = n
+		h.capture = capture
+	}
+}
+
+// WithErrorHandler makes the Handler respond to the requests it rejects
+// with f rather than DefaultErrorHandler, e.g. to render errors the way
+// the rest of an API does. The error passed to f is the reason for the
+// rejection, which f can tell apart with errors.Is, e.g. ErrMalformedBody
+// for a body which could not be decoded or ErrLimitExceeded for one which
+// is too large, or with ClassifyError. It is only called before the next
+// handler runs, or after it if the Handler verifies checksums, see
+// WithVerifyChecksum, or through Error; errors hit while the next handler
+// reads the body are returned by its Read method instead.
+func WithErrorHandler(f func(w http.ResponseWriter, r *http.Request, err error)) Option {
+	return func(h *Handler) {
+		h.errorHandler = f
+	}
+}
+
+// WithStatusMapping overrides the status codes of the responses to the
+// requests the Handler rejects, by class of error, e.g.
+// WithStatusMapping(map[ErrorClass]int{ClassMalformed: 422}). Classes
+// missing from statuses keep their default status codes, which are those
+// used by DefaultErrorHandler. It has no effect if the Handler has an
+// error handler of its own, see WithErrorHandler.
+func WithStatusMapping(statuses map[ErrorClass]int) Option {
+	return func(h *Handler) {
+		h.statuses = make(map[ErrorClass]int, len(statuses))
+		for class, code := range statuses {
+			h.statuses[class] = code
+		}
+	}
+}
+
+// WithProblemDetails makes the Handler respond to the requests it rejects
+// with an application/problem+json document as defined by RFC 9457 rather
+// than plain text. Its title is the text of the status code and its detail
+// the plain text message. Responses to requests rejected because of their
+// content coding also list the codings the Handler decodes, in a
+// supported_encodings member. It has no effect if the Handler has an
+// error handler of its own, see WithErrorHandler.
+func WithProblemDetails(enabled bool) Option {
+	return func(h *Handler) {
+		h.problemDetails = enabled
+	}
+}
+
+// WithErrorRenderer makes the Handler write the bodies of its responses to
+// the requests it rejects with render, as documents of the given content
+// type, e.g. to wrap errors in the XML envelopes of a legacy API. Unlike
+// with WithErrorHandler, the Handler still picks the status code, see
+// WithStatusMapping, and sets the headers; render is passed the status
+// code, the plain text message and the error, and only has to format them.
+// It takes precedence over WithProblemDetails and WithEncodingsDocument,
+// and has no effect if the Handler has an error handler of its own.
+func WithErrorRenderer(contentType string, render func(w io.Writer, status int, msg string, err error)) Option {
+	return func(h *Handler) {
+		h.renderType = contentType
+		h.render = render
+	}
+}
+
+// WithEncodingsDocument makes the Handler respond to requests it rejects
+// because of their content coding with an application/json document which
+// SDKs can configure themselves from, e.g.
+//
+//	{
+//	  "error": "Content-Encoding: br is not supported",
+//	  "supported_encodings": ["deflate", "gzip"],
+//	  "limits": {"max_codings": 2, "max_decoded_bytes": 1048576}
+//	}
+//
+// Limits which are not set are left out. With WithProblemDetails the
+// limits are added to the problem details document instead. It has no
+// effect if the Handler has an error handler of its own, see
+// WithErrorHandler.
+func WithEncodingsDocument(enabled bool) Option {
+	return func(h *Handler) {
+		h.encodingsDoc = enabled
+	}
+}
+
+// A HeaderMode says what a Handler does with the Content-Encoding header of
+// requests whose body it decodes, see WithHeaderMode.
+type HeaderMode int
+
+const (
+	// HeaderIdentity sets the header to identity, which is what the body
+	// passed on is in. It is the default.
+	HeaderIdentity HeaderMode = iota
+
+	// HeaderKeep leaves the header as the client sent it, e.g. for
+	// handlers which log it. They must not decode the body again.
+	HeaderKeep
+
+	// HeaderDelete removes the header.
+	HeaderDelete
+)
+
+var headerModes = []string{"identity", "keep", "delete"}
+
+func (m HeaderMode) String() string {
+	if m >= 0 && int(m) < len(headerModes) {
+		return headerModes[m]
+	}
+
+	return fmt.Sprintf("HeaderMode(%d)", int(m))
+}
+
+// MarshalText writes m as its name, e.g. "keep" for HeaderKeep.
+func (m HeaderMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText reads a HeaderMode written by MarshalText.
+func (m *HeaderMode) UnmarshalText(text []byte) error {
+	for i, name := range headerModes {
+		if strings.EqualFold(string(text), name) {
+			*m = HeaderMode(i)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unpack: unknown header mode %q", text)
+}
+
+// WithHeaderMode sets what the Handler does with the Content-Encoding
+// header of requests whose body it decodes, or whose header lists no
+// codings. Whatever the mode, the codings the body was decoded from are
+// available from the Stats of the request, see StatsFromContext, along
+// with its encoded size and any error hit while decoding it.
+func WithHeaderMode(mode HeaderMode) Option {
+	return func(h *Handler) {
+		h.headerMode = mode
+	}
+}
+
+// WithBuffering makes the Handler decode each body into memory before
+// passing the request on, so that its ContentLength and Content-Length
+// header can be set to the decoded size and its GetBody can return a copy
+// of the decoded body, e.g. for reverse proxies which retry requests or
+// handlers which verify signatures over the body. The body itself is an
+// io.Seeker, and copies returned by GetBody can be read until the next
+// handler returns. Bodies which decode to more than max bytes fail with
+// HTTP 413, as do bodies which exceed any other limit, and bodies which
+// cannot be decoded fail before the next handler runs. Buffers count
+// towards the budget set with WithMaxInflightBytes. A max of zero or less
+// turns buffering off, which is the default.
+func WithBuffering(max int64) Option {
+	return func(h *Handler) {
+		h.bufferMax = max
+	}
+}
+
+// WithSpillToDisk makes the Handler write the decoded data of buffered
+// bodies, see WithBuffering, to a temporary file in dir once they decode to
+// more than threshold bytes, rather than keep all of it in memory. The
+// file is removed once the body is closed, which a Handler does once the
+// next handler returns. An empty dir is the default directory for
+// temporary files, see os.TempDir. Requests whose body cannot be written
+// to the file fail with HTTP 503. A threshold of zero or less keeps all
+// of each body in memory, which is the default.
+func WithSpillToDisk(threshold int64, dir string) Option {
+	return func(h *Handler) {
+		h.spillThreshold = threshold
+		h.spillDir = dir
+	}
+}
+
+// WithLazyDecoding makes the Handler set up the decoders of each body when
+// the next handler first reads from it, rather than before passing the
+// request on, so that no work is wasted on requests which the handler
+// rejects without reading their body. Bodies which cannot be decoded then
+// fail the first read, and every read after it, with the error which
+// would have failed the request, such as a *DecompressionError, rather
+// than with HTTP 400. Options which read the body before passing the
+// request on, such as WithBuffering, still decode it up front.
+func WithLazyDecoding(enabled bool) Option {
+	return func(h *Handler) {
+		h.lazy = enabled
+	}
+}
+
+// WithValidateOnly makes the Handler decode each body in full, enforcing
+// all limits, but pass the request on with the body as it was sent, e.g.
+// for gateways which store compressed bodies as they are but should still
+// reject corrupt bodies or decompression bombs. The Content-Encoding and
+// Content-Length headers are left alone, and the Stats of the decoded body
+// are available from the request context, see StatsFromContext. Bodies
+// are held in memory, counting towards the budget set with
+// WithMaxInflightBytes, until the next handler returns, so their size is
+// best capped with WithMaxEncodedBytes.
+func WithValidateOnly(enabled bool) Option {
+	return func(h *Handler) {
+		h.validateOnly = enabled
+	}
+}
+
+// WithFailOpen makes the Handler pass on requests whose body cannot be
+// decoded with the body as it was sent, rather than fail them with HTTP
+// 400, e.g. for endpoints which would rather store a broken body than
+// lose it. The Content-Encoding header of such requests is left alone and
+// their Stats, see StatsFromContext, have Raw set and say why in Err.
+// This only covers bodies whose decoders cannot be set up, e.g. because
+// their header is corrupt. Bodies which turn out to be corrupt later on
+// fail the reads of the next handler as usual, since part of them has
+// been decoded already, and bodies which exceed a limit fail as usual
+// too. It has no effect on bodies which are decoded lazily, see
+// WithLazyDecoding.
+func WithFailOpen(enabled bool) Option {
+	return func(h *Handler) {
+		h.failOpen = enabled
+	}
+}
+
+// WithVerifyChecksum makes sure that corrupt bodies are detected even if
+// the handler does not read them to the end, where the checksums of
+// encodings such as gzip are. Once the handler returns, the rest of the
+// body is read, up to 1MB of decoded data, and if it turns out to be
+// corrupt while the handler has not written a response yet, the request
+// fails with HTTP 400 just as if the body could not be decoded at all.
+func WithVerifyChecksum(enabled bool) Option {
+	return func(h *Handler) {
+		h.verifyChecksum = enabled
+	}
+}
+
+// WithDecodedSizeHeader sets the response header with the given name, e.g.
+// X-Decoded-Content-Length, to the decoded size of the request body, which
+// helps debugging compression from the client side. The size is only
+// known, and the header only set, if the handler read the whole body
+// before it started writing its response. The header should only be
+// enabled for trusted clients.
+func WithDecodedSizeHeader(name string) Option {
+	return func(h *Handler) {
+		h.decodedSizeHeader = name
+	}
+}
+
+// WithChannelSink makes the Handler feed decoded bodies to channels rather
+// than to the next handler. For each decoded request, sink is called to
+// get a channel, and the body is sent on it in chunks of up to chunk bytes
+// as it is decoded. Since the channel is closed at the end of each body,
+// every request needs a channel of its own, which is why sink is a func
+// rather than a channel.
+//
+// The body is sent in the goroutine serving the request, before the next
+// handler is called, so the receiver must run in another goroutine. Only
+// the channel buffers chunks: decoding blocks while it is full, so the
+// receiver controls the pace, and stops if the request context is done.
+// Once the body has been sent, or decoding failed, the channel is closed
+// and the next handler is called with an empty body, unless decoding
+// failed and the request was answered with an error. The next handler
+// can thus not answer before the receiver has taken all but the chunks
+// which fit in the channel. Requests for which sink returns nil are passed
+// on as usual. A chunk size of zero or less means 32KB.
+func WithChannelSink(sink func(r *http.Request) chan<- []byte, chunk int) Option {
+	return func(h *Handler) {
+		if chunk <= 0 {
+			chunk = 32 << 10
+		}
+
+		h.sink = sink
+		h.sinkChunk = chunk
+	}
+}
+
+// WithGzipMaxMembers caps the number of members of gzip bodies at n. A
+// gzip body may consist of several members, which are decoded one after
+// the other, and extra members can be used to smuggle data past checks
+// which only look at the first one. Reading a body with more members fails
+// with a *DecompressionError once the handler reads past the last allowed
+// one. A cap of 1 rejects all bodies with several members. A cap of zero
+// or less means that bodies may have any number of members, which is the
+// default.
+func WithGzipMaxMembers(n int) Option {
+	return func(h *Handler) {
+		h.gzipMaxMembers = n
+	}
+}
+
+// defaultMaxCodings is the number of content codings a body may have by
+// default, which is more than legitimate clients use.
+const defaultMaxCodings = 3
+
+// WithMaxCodings caps the number of content codings a body may have, not
+// counting identity codings, at n. Each coding takes a decoder, and some
+// decoders take a lot of memory, so a long chain such as gzip, gzip, gzip
+// is a cheap way for clients to make the Handler allocate a lot. Bodies
+// with more codings fail with HTTP 415. The default cap is 3. A cap of
+// zero or less means that bodies may have any number of codings.
+func WithMaxCodings(n int) Option {
+	return func(h *Handler) {
+		h.maxCodings = n
+	}
+}
+
+// WithStrictContentEncoding makes the Handler strict about the syntax of
+// the Content-Encoding header. Requests whose header names a coding which
+// is not a valid token, see ParseCodings, or which is set but lists no
+// codings at all, not even identity, fail with HTTP 400. Requests in a
+// coding which the Handler supports but does not allow, see
+// WithAllowedEncodings and WithDeniedEncodings, fail with HTTP 415. By
+// default bytes which cannot be part of a coding name are stripped from
+// both ends of each name, names which are still invalid are treated like
+// unsupported codings, requests in codings which are not allowed are
+// passed on untouched, and requests whose header lists no codings are
+// passed on as if their body was not encoded, which it is not, with the
+// header set to identity like that of decoded requests.
+func WithStrictContentEncoding(enabled bool) Option {
+	return func(h *Handler) {
+		h.strictHeader = enabled
+	}
+}
+
+// WithSniffing makes the Handler decode the bodies of requests without a
+// Content-Encoding header which start like gzip, zstd or zlib data, as
+// sent by clients which compress their bodies but forget the header. zlib
+// data is decoded as deflate. Before such requests are passed on, the
+// Handler waits for the first four bytes of their body. Plain bodies which
+// happen to start like compressed data, e.g. text starting with "x^",
+// fail with HTTP 400, so sniffing is best enabled for bodies which cannot,
+// such as JSON. By default bodies are only decoded according to their
+// header.
+func WithSniffing(enabled bool) Option {
+	return func(h *Handler) {
+		h.sniff = enabled
+	}
+}
+
+// WithMismatchMode sets what the Handler does with bodies which start like
+// gzip, zstd or zlib data, while their Content-Encoding header says that
+// another coding was applied last, e.g. zstd bodies sent as gzip. By
+// default, or with MismatchIgnore, they are decoded according to their
+// header, which fails with HTTP 400 without saying why.
+func WithMismatchMode(mode MismatchMode) Option {
+	return func(h *Handler) {
+		h.mismatch = mode
+	}
+}
+
+// WithDoubleGzip makes the Handler decode bodies which were gzipped twice,
+// as some clients and proxies do, while their Content-Encoding header only
+// lists gzip once, as the first coding applied. Once the declared gzip
+// layer is decoded, data which still starts like gzip data is decoded
+// once more. The Stats of such requests have DoubleGzip set, so that the
+// clients which send them can be tracked down. Bodies which legitimately
+// decode to gzip data, such as uploads of .gz files, are decoded one time
+// too many, so the option should only be enabled for endpoints which do
+// not accept those. By default bodies are only decoded as many times as
+// their header says.
+func WithDoubleGzip(enabled bool) Option {
+	return func(h *Handler) {
+		h.doubleGzip = enabled
+	}
+}
+
+// WithRejectTrailingData makes reading the body of a gzip, deflate,
+// deflate-raw or zstd request fail with ErrTrailingData, wrapped in a
+// *DecompressionError, if the encoded data in it is followed by more data
+// which is not part of it. Requests whose response has not been written
+// yet, e.g. because the Handler verifies checksums, fail with HTTP 400.
+// By default such data is ignored, once the decoded data has been read,
+// but recorded in the Stats of the request so that it can be logged. For
+// zstd bodies, less than four bytes of such data are taken for a
+// truncated frame, which is always an error.
+func WithRejectTrailingData(enabled bool) Option {
+	return func(h *Handler) {
+		h.rejectTrailing = enabled
+	}
+}
+
+// WithStrictDeflateZlibOnly enforces that deflate bodies are zlib-wrapped,
+// as HTTP requires. By default, bodies which are not are decoded as raw
+// DEFLATE data, which is what some clients send instead. Enforced, they
+// fail with HTTP 400 and a message which says so.
+func WithStrictDeflateZlibOnly(enabled bool) Option {
+	return func(h *Handler) {
+		h.strictDeflate = enabled
+	}
+}
+
+// WithZlibDictionary sets the preset dictionary for deflate bodies whose
+// zlib header says that they were compressed with one, as done by some
+// protocols whose messages share a lot of data. Bodies compressed with a
+// different dictionary fail with HTTP 400, as do all bodies which need a
+// dictionary if none is set. Bodies without a preset dictionary are
+// decoded as usual.
+func WithZlibDictionary(dict []byte) Option {
+	return func(h *Handler) {
+		h.zlibDict = dict
+	}
+}
+
+// WithMaxInflightBytes caps the number of bytes the Handler buffers in
+// memory for all of the requests it is serving at once, e.g. to try the
+// fallbacks set with WithDecodeFallbacks. Requests which would need to
+// buffer more fail with HTTP 503 instead. Buffered bytes count towards
+// the cap until the handler is done with the request. By default there is
+// no cap.
+func WithMaxInflightBytes(n int64) Option {
+	return func(h *Handler) {
+		h.inflight = nil
+		if n > 0 {
+			h.inflight = &budget{max: n}
+		}
+	}
+}
+
+// WithRetryAfter makes the Handler ask clients to retry requests which it
+// rejects for lack of resources, see WithMaxInflightBytes and
+// WithSpillToDisk, after d at the earliest, with a Retry-After header, so
+// that well-behaved clients back off. d is rounded up to whole seconds.
+// By default there is no such header.
+func WithRetryAfter(d time.Duration) Option {
+	return func(h *Handler) {
+		h.retryAfter = d
+	}
+}
+
+// WithRawBodyWrapper sets a function which wraps the body of each request
+// to be decoded before any decoders are attached to it, so the wrapper
+// sees the encoded data. It can be used to count, rate limit or inject
+// faults into the data read from clients. The wrapper is closed along
+// with the decoders, so its Close method has to close the body it wraps.
+func WithRawBodyWrapper(wrap func(io.ReadCloser) io.ReadCloser) Option {
+	return func(h *Handler) {
+		h.rawBodyWrapper = wrap
+	}
+}
+
+// WithXZ enables decoding of xz bodies, whose decoder allocates a
+// dictionary of the size the body declares, of up to 4GB. Bodies which
+// declare a dictionary larger than maxDict bytes fail with HTTP 413. Each
+// block of a body may declare a dictionary of its own, so all of them are
+// checked before they are decoded. Bodies made of several concatenated xz
+// streams fail with HTTP 400. The xz tool uses 8MB dictionaries by
+// default. A maxDict of zero or less disables xz decoding, which is the
+// default.
+func WithXZ(maxDict int64) Option {
+	return func(h *Handler) {
+		h.xzDictMax = maxDict
+	}
+}
+
+// WithLegacyCompress controls whether bodies in the compress coding, i.e.
+// LZW data as written by the Unix compress tool, are decoded, which they
+// are by default. Disabled, such bodies are passed on untouched.
+func WithLegacyCompress(enabled bool) Option {
+	return func(h *Handler) {
+		h.noCompress = !enabled
+	}
+}
+
+// WithAES128GCM enables decryption of bodies in the aes128gcm coding (RFC
+// 8188), as sent by Web Push and some IoT clients. For each body, keys is
+// called with the key ID from its header, which may be empty, and returns
+// the input keying material, typically a 16 byte secret, or an error if
+// the key ID is unknown. Bodies which cannot be decrypted, including any
+// with an unknown key ID or a record which fails authentication, fail with
+// HTTP 400. By default aes128gcm bodies are passed on untouched.
+func WithAES128GCM(keys func(keyID string) ([]byte, error)) Option {
+	return func(h *Handler) {
+		h.aesgcmKeys = keys
+	}
+}
+
+// WithDictionaryStore enables decoding of dcz bodies, which clients
+// compress with zstd and a dictionary negotiated using Compression
+// Dictionary Transport (RFC 9842). The body names the dictionary by its
+// SHA-256 hash, which is looked up in store. Bodies whose dictionary is
+// not in the store fail with HTTP 400. Bodies in the dcb coding, which
+// use brotli, are only decoded with WithSharedBrotli. By default dcz
+// bodies are passed on untouched.
+func WithDictionaryStore(store DictionaryStore) Option {
+	return func(h *Handler) {
+		h.dictionaries = store
+	}
+}
+
+// WithSharedBrotli enables decoding of dcb bodies, which clients compress
+// with brotli and a dictionary negotiated like those of dcz bodies, see
+// WithDictionaryStore, which has to be set as well. The brotli decoder
+// used for br bodies does not support dictionaries, so the bodies are
+// decoded with decode, e.g. one wrapping the brotli C library, once their
+// dictionary has been looked up. Bodies whose dictionary is not in the
+// store fail with HTTP 400. By default dcb bodies are passed on untouched.
+func WithSharedBrotli(decode BrotliDictionaryDecoder) Option {
+	return func(h *Handler) {
+		h.dcbDecode = decode
+	}
+}
+
+// WithZstdDictionaries sets the dictionaries, by name, which clients may
+// compress zstd bodies with. Bodies whose frames refer to a dictionary by
+// ID are decoded with the dictionary in the zstd format, as written by zstd
+// --train, with that ID. Clients can also name the dictionary they used,
+// which may be a raw one, in the header set with WithZstdDictionaryHeader.
+// Since the decoder of each body loads the dictionaries it may need, it
+// pays to keep their number small.
+func WithZstdDictionaries(dicts map[string][]byte) Option {
+	return func(h *Handler) {
+		h.zstdDicts = make(map[string][]byte, len(dicts))
+		for name, dict := range dicts {
+			h.zstdDicts[name] = dict
+		}
+	}
+}
+
+// WithZstdDictionaryHeader sets the request header, e.g. Zstd-Dictionary,
+// in which clients name the dictionary set with WithZstdDictionaries which
+// they compressed their zstd body with. Bodies which name a dictionary
+// the Handler does not have fail with HTTP 400. Bodies without the header
+// are decoded as usual.
+func WithZstdDictionaryHeader(name string) Option {
+	return func(h *Handler) {
+		h.zstdDictHeader = name
+	}
+}
+
+// WithBase64 controls whether bodies in the base64 coding, which is not a
+// registered content coding but is used by some webhook providers and API
+// gateways, are decoded. Like any other coding, base64 may be part of a
+// chain, e.g. Content-Encoding: gzip, base64 for a gzipped body which was
+// then base64-encoded. By default base64 bodies are passed on untouched.
+func WithBase64(enabled bool) Option {
+	return func(h *Handler) {
+		h.base64 = enabled
+	}
+}
+
+// WithCodec makes the Handler decode bodies in the content coding name
+// with c, replacing any built-in codec or codec registered with
+// RegisterCodec for name. Names are case-insensitive.
+func WithCodec(name string, c Codec) Option {
+	return func(h *Handler) {
+		if h.extraCodecs == nil {
+			h.extraCodecs = make(map[string]Codec)
+		}
+
+		h.extraCodecs[strings.ToLower(name)] = c
+	}
+}
+
+// WithSnappyBlockFormat makes the Handler decode snappy bodies as a single
+// block in the snappy block format, as sent by Prometheus remote write,
+// rather than in the snappy framing format. Blocks can only be decoded as
+// a whole, so they are buffered in memory and must decode to at most max
+// bytes, or the request fails with HTTP 413. A max of zero or less
+// switches back to the framing format, which is the default.
+func WithSnappyBlockFormat(max int64) Option {
+	return func(h *Handler) {
+		h.snappyBlockMax = max
+	}
+}
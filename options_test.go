@@ -0,0 +1,1445 @@
+package unpack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSkipper(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	skip := func(r *http.Request) bool {
+		return r.Header.Get("X-Signature") != ""
+	}
+
+	for _, tt := range []struct {
+		signature string
+		content   string
+	}{
+		{signature: "", content: "hello"},
+		{signature: "abc", content: string(buf)},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("X-Signature", tt.signature)
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithSkipper(skip)).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("signature %q: handler returned wrong status code: got %v want %v", tt.signature, rr.Code, http.StatusOK)
+		}
+
+		if rr.Body.String() != tt.content {
+			t.Fatalf("signature %q: handler returned unexpected body: got %q want %q", tt.signature, rr.Body.String(), tt.content)
+		}
+	}
+}
+
+func TestMethodsAndPaths(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	isUpload := func(path string) bool {
+		return strings.HasSuffix(path, "/upload")
+	}
+
+	for _, tt := range []struct {
+		method  string
+		path    string
+		opts    []Option
+		decoded bool
+	}{
+		{method: "POST", path: "/api/v1", opts: nil, decoded: true},
+		{method: "POST", path: "/api/v1", opts: []Option{WithMethods("post", "PUT")}, decoded: true},
+		{method: "PATCH", path: "/api/v1", opts: []Option{WithMethods("post", "PUT")}, decoded: false},
+		{method: "POST", path: "/api/v1", opts: []Option{WithPathPrefix("/api/", "/v2/")}, decoded: true},
+		{method: "POST", path: "/static/v1", opts: []Option{WithPathPrefix("/api/", "/v2/")}, decoded: false},
+		{method: "POST", path: "/files/upload", opts: []Option{WithPathMatcher(isUpload)}, decoded: true},
+		{method: "POST", path: "/files/upload", opts: []Option{WithPathPrefix("/api/"), WithPathMatcher(isUpload)}, decoded: true},
+		{method: "POST", path: "/files/download", opts: []Option{WithPathPrefix("/api/"), WithPathMatcher(isUpload)}, decoded: false},
+		{method: "PUT", path: "/api/v1", opts: []Option{WithMethods("POST"), WithPathPrefix("/api/")}, decoded: false},
+	} {
+		req := httptest.NewRequest(tt.method, tt.path, bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, tt.opts...).ServeHTTP(rr, req)
+
+		want := string(buf)
+		if tt.decoded {
+			want = "hello"
+		}
+
+		if rr.Body.String() != want {
+			t.Fatalf("%s %s: handler returned unexpected body: got %q want %q", tt.method, tt.path, rr.Body.String(), want)
+		}
+	}
+}
+
+func TestSetVaryOnDecode(t *testing.T) {
+	for _, ft := range []fileTest{
+		{file: "testdata/hello.txt.gz", encoding: "gzip"},
+		{file: "testdata/hello.txt", encoding: "identity"},
+	} {
+		buf, err := ioutil.ReadFile(ft.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", ft.encoding)
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithSetVaryOnDecode(true)).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", ft.encoding, rr.Code, http.StatusOK)
+		}
+
+		vary := rr.Header().Get("Vary")
+		if decoded := ft.encoding != "identity"; decoded != (vary == "Content-Encoding") {
+			t.Fatalf("%s: unexpected Vary header: got '%v'", ft.encoding, vary)
+		}
+	}
+}
+
+func TestMaxDecodedBytes(t *testing.T) {
+	for _, tt := range []struct {
+		max  int64
+		code int
+	}{
+		{max: 5, code: http.StatusOK},
+		{max: 4, code: http.StatusInternalServerError},
+	} {
+		buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithMaxDecodedBytes(tt.max)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("max %d: handler returned wrong status code: got %v want %v", tt.max, rr.Code, tt.code)
+		}
+	}
+}
+
+func TestLimitFor(t *testing.T) {
+	for _, tt := range []struct {
+		file     string
+		encoding string
+		opts     []Option
+		code     int
+	}{
+		{file: "testdata/hello.txt.gz", encoding: "gzip", opts: []Option{WithMaxDecodedBytes(4), WithLimitFor(EncodingGzip, 5)}, code: http.StatusOK},
+		{file: "testdata/hello.txt.gz", encoding: "gzip", opts: []Option{WithMaxDecodedBytes(5), WithLimitFor(EncodingGzip, 4)}, code: http.StatusInternalServerError},
+		{file: "testdata/hello.txt.gz", encoding: "x-gzip", opts: []Option{WithMaxDecodedBytes(5), WithLimitFor("X-Gzip", 4)}, code: http.StatusInternalServerError},
+		{file: "testdata/hello.txt.gz", encoding: "gzip", opts: []Option{WithMaxDecodedBytes(4), WithLimitFor(EncodingGzip, 0)}, code: http.StatusOK},
+		{file: "testdata/hello.txt.zz", encoding: "deflate", opts: []Option{WithMaxDecodedBytes(4), WithLimitFor(EncodingGzip, 5)}, code: http.StatusInternalServerError},
+		{file: "testdata/hello.txt.zz", encoding: "deflate", opts: []Option{WithLimitFor(EncodingGzip, 4)}, code: http.StatusOK},
+		{file: "testdata/hello.txt.gz.zz", encoding: "gzip, deflate", opts: []Option{WithLimitFor(EncodingGzip, 5), WithLimitFor(EncodingDeflate, 4)}, code: http.StatusInternalServerError},
+		{file: "testdata/hello.txt.gz.zz", encoding: "gzip, deflate", opts: []Option{WithMaxDecodedBytes(4), WithLimitFor(EncodingGzip, 5), WithLimitFor(EncodingDeflate, 0)}, code: http.StatusOK},
+	} {
+		buf, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, tt.opts...).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s, %d options: handler returned wrong status code: got %v want %v", tt.encoding, len(tt.opts), rr.Code, tt.code)
+		}
+	}
+}
+
+func TestLimitOverride(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		limit   string
+		trusted bool
+		code    int
+	}{
+		{limit: "", trusted: true, code: http.StatusInternalServerError},
+		{limit: "5", trusted: true, code: http.StatusOK},
+		{limit: "5", trusted: false, code: http.StatusInternalServerError},
+		{limit: "0", trusted: true, code: http.StatusOK},
+		{limit: "five", trusted: true, code: http.StatusInternalServerError},
+		{limit: "4", trusted: true, code: http.StatusInternalServerError},
+	} {
+		var header []string
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header = r.Header.Values("X-Unpack-Limit")
+			requestBodyWriter{}.ServeHTTP(w, r)
+		})
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", "gzip")
+		if tt.limit != "" {
+			req.Header.Set("X-Unpack-Limit", tt.limit)
+		}
+
+		rr := httptest.NewRecorder()
+		New(inner,
+			WithMaxDecodedBytes(4),
+			WithLimitOverride("x-unpack-limit", func(r *http.Request) bool { return tt.trusted }),
+		).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%q, trusted %v: handler returned wrong status code: got %v want %v", tt.limit, tt.trusted, rr.Code, tt.code)
+		}
+
+		if header != nil {
+			t.Fatalf("%q, trusted %v: header passed on: %q", tt.limit, tt.trusted, header)
+		}
+	}
+}
+
+func TestLimitResolver(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type tenantKey struct{}
+	plans := map[string]Limits{
+		"free":      {MaxDecodedBytes: 4},
+		"pro":       {MaxDecodedBytes: 5},
+		"unlimited": {MaxDecodedBytes: -1},
+		"slow":      {MaxDecodedBytes: 5, DecodeTimeout: time.Nanosecond},
+	}
+
+	for _, tt := range []struct {
+		tenant string
+		limit  string
+		err    error
+	}{
+		{tenant: "", err: ErrLimitExceeded},
+		{tenant: "free", err: ErrLimitExceeded},
+		{tenant: "pro", err: nil},
+		{tenant: "unlimited", err: nil},
+		{tenant: "slow", err: ErrDecodeTimeout},
+		{tenant: "free", limit: "5", err: nil},
+		{tenant: "pro", limit: "4", err: ErrLimitExceeded},
+	} {
+		var readErr error
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, readErr = ioutil.ReadAll(r.Body)
+		})
+
+		handler := New(inner,
+			WithMaxDecodedBytes(3),
+			WithLimitResolver(func(r *http.Request) Limits {
+				tenant, _ := r.Context().Value(tenantKey{}).(string)
+				return plans[tenant]
+			}),
+			WithLimitOverride("X-Unpack-Limit", func(r *http.Request) bool { return true }),
+		)
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req = req.WithContext(context.WithValue(req.Context(), tenantKey{}, tt.tenant))
+		req.Header.Set("Content-Encoding", "gzip")
+		if tt.limit != "" {
+			req.Header.Set("X-Unpack-Limit", tt.limit)
+		}
+
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if !errors.Is(readErr, tt.err) {
+			t.Fatalf("%q, %q: unexpected read error: got %v want %v", tt.tenant, tt.limit, readErr, tt.err)
+		}
+	}
+}
+
+func TestMaxEncodedBytes(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		max     int64
+		chunked bool
+		code    int
+	}{
+		{max: int64(len(buf)), code: http.StatusOK},
+		{max: 0, code: http.StatusOK},
+		{max: int64(len(buf)) - 1, code: http.StatusRequestEntityTooLarge},
+		{max: int64(len(buf)) - 1, chunked: true, code: http.StatusInternalServerError},
+		{max: 5, chunked: true, code: http.StatusRequestEntityTooLarge},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", "gzip")
+		if tt.chunked {
+			req.ContentLength = -1
+		}
+
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithMaxEncodedBytes(tt.max)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("max %d, chunked %v: handler returned wrong status code: got %v want %v", tt.max, tt.chunked, rr.Code, tt.code)
+		}
+	}
+}
+
+func TestMaxRatio(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(make([]byte, 1<<20))
+	zw.Close()
+
+	for _, tt := range []struct {
+		ratio    float64
+		code     int
+		exceeded bool
+	}{
+		{ratio: 100, code: http.StatusInternalServerError, exceeded: true},
+		{ratio: 10000, code: http.StatusOK},
+		{ratio: 0, code: http.StatusOK},
+	} {
+		var exceeded *Stats
+		onExceeded := func(r *http.Request, s Stats) {
+			exceeded = &s
+		}
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewReader(buf.Bytes()))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithMaxRatio(tt.ratio, onExceeded)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("ratio %v: handler returned wrong status code: got %v want %v", tt.ratio, rr.Code, tt.code)
+		}
+
+		if (exceeded != nil) != tt.exceeded {
+			t.Fatalf("ratio %v: got exceeded %v want %v", tt.ratio, exceeded != nil, tt.exceeded)
+		}
+
+		if exceeded != nil && float64(exceeded.DecodedBytes) <= tt.ratio*float64(exceeded.EncodedBytes) {
+			t.Fatalf("ratio %v: got unexpected stats %+v", tt.ratio, *exceeded)
+		}
+	}
+}
+
+// slowBody yields its data one byte at a time, each after a delay.
+type slowBody struct {
+	data  []byte
+	fast  int // Number of bytes to yield without delay.
+	delay time.Duration
+}
+
+func (s *slowBody) Read(p []byte) (int, error) {
+	if len(s.data) == 0 {
+		return 0, io.EOF
+	}
+
+	if s.fast > 0 {
+		s.fast--
+	} else {
+		time.Sleep(s.delay)
+	}
+
+	p[0] = s.data[0]
+	s.data = s.data[1:]
+	return 1, nil
+}
+
+func TestDecodeTimeout(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The handler leaves it to the Handler to respond to errors found
+	// while reading the body.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, err := ioutil.ReadAll(r.Body); err == nil {
+			w.Write(body)
+		}
+	})
+
+	for _, tt := range []struct {
+		name    string
+		fast    int
+		timeout time.Duration
+		code    int
+	}{
+		{name: "slow header", fast: 0, timeout: 20 * time.Millisecond, code: http.StatusRequestTimeout},
+		{name: "slow data", fast: 10, timeout: 20 * time.Millisecond, code: http.StatusRequestTimeout},
+		{name: "in time", fast: 0, timeout: time.Minute, code: http.StatusOK},
+		{name: "no timeout", fast: 0, timeout: 0, code: http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "/test", &slowBody{data: buf, fast: tt.fast, delay: 5 * time.Millisecond})
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		New(handler, WithDecodeTimeout(tt.timeout), WithVerifyChecksum(true)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.code)
+		}
+	}
+}
+
+func TestDecodeContentTypes(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		contentType string
+		content     string
+	}{
+		{contentType: "application/json", content: "hello"},
+		{contentType: "Application/JSON; charset=utf-8", content: "hello"},
+		{contentType: "application/octet-stream", content: string(buf)},
+		{contentType: "", content: string(buf)},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("Content-Type", tt.contentType)
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithDecodeContentTypes("application/json", "text/plain")).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%q: handler returned wrong status code: got %v want %v", tt.contentType, rr.Code, http.StatusOK)
+		}
+
+		if rr.Body.String() != tt.content {
+			t.Fatalf("%q: handler returned unexpected body: got '%v' want '%v'", tt.contentType, rr.Body.String(), tt.content)
+		}
+	}
+}
+
+func TestSkipContentTypes(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		contentType string
+		opts        []Option
+		content     string
+	}{
+		{contentType: "application/json", content: "hello"},
+		{contentType: "application/gzip", content: string(buf)},
+		{contentType: "Application/X-Gzip; name=hello.gz", content: string(buf)},
+		{contentType: "", content: "hello"},
+		{contentType: "application/gzip", opts: []Option{WithDecodeContentTypes("application/gzip")}, content: string(buf)},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("Content-Type", tt.contentType)
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, append(tt.opts, WithSkipContentTypes("application/gzip", "application/x-gzip"))...).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%q: handler returned wrong status code: got %v want %v", tt.contentType, rr.Code, http.StatusOK)
+		}
+
+		if rr.Body.String() != tt.content {
+			t.Fatalf("%q: handler returned unexpected body: got '%v' want '%v'", tt.contentType, rr.Body.String(), tt.content)
+		}
+	}
+}
+
+func TestAllowedEncodings(t *testing.T) {
+	for _, ft := range []fileTest{
+		{file: "testdata/hello.txt.gz", encoding: EncodingGzip, content: "hello"},
+		{file: "testdata/hello.txt.zz", encoding: EncodingDeflate, content: "\x78\x5e"},
+		{file: "testdata/hello.txt.gz.zz", encoding: "gzip, deflate", content: "\x78\x9c"},
+		{file: "testdata/hello.txt", encoding: EncodingIdentity, content: "hello"},
+	} {
+		buf, err := ioutil.ReadFile(ft.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", ft.encoding)
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, WithAllowedEncodings(EncodingGzip, "x-gzip")).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", ft.encoding, rr.Code, http.StatusOK)
+		}
+
+		if !strings.HasPrefix(rr.Body.String(), ft.content) {
+			t.Fatalf("%s: handler returned unexpected body: got '%v' want prefix '%v'", ft.encoding, rr.Body.String(), ft.content)
+		}
+	}
+}
+
+func TestDeniedEncodings(t *testing.T) {
+	for _, tt := range []struct {
+		file     string
+		encoding string
+		strict   bool
+		code     int
+		content  string
+	}{
+		{file: "testdata/hello.txt.gz", encoding: EncodingGzip, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.zz", encoding: EncodingDeflate, code: http.StatusOK, content: "\x78\x5e"},
+		{file: "testdata/hello.txt.gz.zz", encoding: "gzip, deflate", code: http.StatusOK, content: "\x78\x9c"},
+		{file: "testdata/hello.txt.zz", encoding: EncodingDeflate, strict: true, code: http.StatusUnsupportedMediaType, content: "Content-Encoding: deflate is not allowed"},
+		{file: "testdata/hello.txt.zst", encoding: EncodingZstd, strict: true, code: http.StatusUnsupportedMediaType, content: "Content-Encoding: zstd is not allowed"},
+		{file: "testdata/hello.txt.br", encoding: EncodingBrotli, strict: true, code: http.StatusUnsupportedMediaType, content: "Content-Encoding: br is not allowed"},
+		{file: "testdata/hello.txt.gz", encoding: EncodingGzip, strict: true, code: http.StatusOK, content: "hello"},
+	} {
+		buf, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{},
+			WithAllowedEncodings(EncodingGzip, EncodingDeflate, EncodingBrotli),
+			WithDeniedEncodings("Deflate", EncodingBrotli),
+			WithStrictContentEncoding(tt.strict),
+		).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s, strict %v: handler returned wrong status code: got %v want %v", tt.encoding, tt.strict, rr.Code, tt.code)
+		}
+
+		if !strings.HasPrefix(rr.Body.String(), tt.content) {
+			t.Fatalf("%s, strict %v: handler returned unexpected body: got '%v' want prefix '%v'", tt.encoding, tt.strict, rr.Body.String(), tt.content)
+		}
+	}
+}
+
+func TestUnknownEncodingWarning(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		encoding string
+		enabled  bool
+		warning  string
+		reported string
+	}{
+		{encoding: "gzip", enabled: true},
+		{encoding: "unknown", enabled: true, warning: `299 - "Content-Encoding: unknown was not decoded"`, reported: "unknown"},
+		{encoding: "deflate", enabled: true, warning: `299 - "Content-Encoding: deflate was not decoded"`, reported: "deflate"},
+		{encoding: "unknown", enabled: false},
+	} {
+		var reported string
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{},
+			WithDeniedEncodings(EncodingDeflate),
+			WithUnknownEncodingWarning(tt.enabled, func(r *http.Request, coding string) {
+				reported = coding
+			}),
+		).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.encoding, rr.Code, http.StatusOK)
+		}
+
+		if warning := rr.Header().Get("Warning"); warning != tt.warning || reported != tt.reported {
+			t.Fatalf("%s: got warning %q and reported %q, want %q and %q", tt.encoding, warning, reported, tt.warning, tt.reported)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		opts  []Option
+		code  int
+		retry string
+	}{
+		{name: "ok", opts: []Option{WithRetryAfter(time.Second)}, code: http.StatusOK},
+		{name: "overloaded", opts: []Option{WithBuffering(1 << 10), WithMaxInflightBytes(1), WithRetryAfter(1500 * time.Millisecond)}, code: http.StatusServiceUnavailable, retry: "2"},
+		{name: "no retry", opts: []Option{WithBuffering(1 << 10), WithMaxInflightBytes(1)}, code: http.StatusServiceUnavailable},
+		{name: "too large", opts: []Option{WithBuffering(1), WithRetryAfter(time.Second)}, code: http.StatusRequestEntityTooLarge},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, tt.opts...).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.code)
+		}
+
+		if retry := rr.Header().Get("Retry-After"); retry != tt.retry {
+			t.Fatalf("%s: handler returned wrong Retry-After: got %q want %q", tt.name, retry, tt.retry)
+		}
+	}
+}
+
+func TestOnDone(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		body     []byte
+		encoding string
+		opts     []Option
+		called   bool
+		decoded  int64
+		raw      bool
+	}{
+		{name: "decoded", body: buf, encoding: "gzip", called: true, decoded: 5},
+		{name: "not encoded", body: []byte("hello"), called: false},
+		{name: "rejected", body: []byte("hello"), encoding: "gzip", called: false},
+		{name: "validated", body: buf, encoding: "gzip", opts: []Option{WithValidateOnly(true)}, called: true, decoded: 5},
+		{name: "raw", body: []byte("hello"), encoding: "gzip", opts: []Option{WithFailOpen(true)}, called: true, raw: true},
+		{name: "rejected with Error", body: buf, encoding: "gzip", opts: []Option{WithMaxDecodedBytes(1)}, called: false},
+	} {
+		var called bool
+		var stats Stats
+		opts := append([]Option{WithOnDone(func(r *http.Request, s Stats) {
+			called, stats = true, s
+		})}, tt.opts...)
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		if tt.encoding != "" {
+			req.Header.Set("Content-Encoding", tt.encoding)
+		}
+
+		New(errorBodyWriter{}, opts...).ServeHTTP(httptest.NewRecorder(), req)
+
+		if called != tt.called {
+			t.Fatalf("%s: hook called: got %v want %v", tt.name, called, tt.called)
+		}
+
+		if stats.DecodedBytes != tt.decoded || stats.Raw != tt.raw {
+			t.Fatalf("%s: unexpected stats: %+v", tt.name, stats)
+		}
+	}
+}
+
+func TestOnError(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		body     []byte
+		encoding string
+		opts     []Option
+		called   bool
+		class    ErrorClass
+		want     string
+		encoded  bool
+	}{
+		{body: buf, encoding: "gzip", called: false},
+		{body: buf, encoding: "gzip, unknown", called: true, class: ClassUnsupported, want: "gzip, unknown"},
+		{body: []byte("hello"), encoding: "gzip", called: true, class: ClassMalformed, want: "gzip", encoded: true},
+		{body: buf, encoding: "x-gzip", opts: []Option{WithMaxDecodedBytes(1)}, called: true, class: ClassTooLarge, want: "gzip", encoded: true},
+	} {
+		var called bool
+		var info ErrorInfo
+		opts := append([]Option{WithOnError(func(r *http.Request, i ErrorInfo) {
+			called, info = true, i
+		})}, tt.opts...)
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		New(errorBodyWriter{}, opts...).ServeHTTP(httptest.NewRecorder(), req)
+
+		if called != tt.called {
+			t.Fatalf("%s: hook called: got %v want %v", tt.encoding, called, tt.called)
+		}
+
+		if !called {
+			continue
+		}
+
+		if info.Class != tt.class || info.Class != ClassifyError(info.Err) {
+			t.Fatalf("%s: wrong class: got %v want %v", tt.encoding, info.Class, tt.class)
+		}
+
+		if info.Encoding != tt.want {
+			t.Fatalf("%s: wrong encoding: got %q want %q", tt.encoding, info.Encoding, tt.want)
+		}
+
+		if encoded := info.EncodedBytes > 0; encoded != tt.encoded {
+			t.Fatalf("%s: wrong encoded bytes: got %d", tt.encoding, info.EncodedBytes)
+		}
+	}
+
+	// Hooks add up rather than replace each other.
+	var calls int
+	hook := WithOnError(func(r *http.Request, i ErrorInfo) { calls++ })
+	req := httptest.NewRequest("POST", "/test", strings.NewReader("hello"))
+	req.Header.Set("Content-Encoding", "gzip")
+	New(errorBodyWriter{}, hook, hook).ServeHTTP(httptest.NewRecorder(), req)
+
+	if calls != 2 {
+		t.Fatalf("hooks called %d times, want 2", calls)
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotErr error
+	var gotPath string
+	handler := New(requestBodyWriter{},
+		WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+			gotErr, gotPath = err, r.URL.Path
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTeapot)
+			fmt.Fprint(w, `{"error":"bad body"}`)
+		}),
+	)
+
+	for _, tt := range []struct {
+		body     []byte
+		encoding string
+		code     int
+		content  string
+		err      func(error) bool
+	}{
+		{body: buf, encoding: "gzip", code: http.StatusOK, content: "hello"},
+		{body: []byte("hello"), encoding: "gzip", code: http.StatusTeapot, content: `{"error":"bad body"}`, err: func(err error) bool {
+			de, ok := err.(*DecompressionError)
+			return ok && de.Encoding == "gzip"
+		}},
+		{body: buf, encoding: "gzip, gzip, gzip, gzip", code: http.StatusTeapot, content: `{"error":"bad body"}`, err: func(err error) bool {
+			_, ok := err.(*DecompressionError)
+			return ok
+		}},
+	} {
+		gotErr, gotPath = nil, ""
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.encoding, rr.Code, tt.code)
+		}
+
+		if !strings.HasPrefix(rr.Body.String(), tt.content) {
+			t.Fatalf("%s: handler returned unexpected body: got '%v' want prefix '%v'", tt.encoding, rr.Body.String(), tt.content)
+		}
+
+		if tt.err == nil && gotErr != nil || tt.err != nil && (!tt.err(gotErr) || gotPath != "/test") {
+			t.Fatalf("%s: error handler got unexpected error %v for %q", tt.encoding, gotErr, gotPath)
+		}
+	}
+}
+
+func TestStatusMapping(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := New(requestBodyWriter{},
+		WithStrictContentEncoding(true),
+		WithVerifyChecksum(true),
+		WithStatusMapping(map[ErrorClass]int{
+			ClassMalformed:   http.StatusUnprocessableEntity,
+			ClassUnsupported: http.StatusNotImplemented,
+		}),
+	)
+
+	for _, tt := range []struct {
+		body     []byte
+		encoding string
+		code     int
+		content  string
+	}{
+		{body: buf, encoding: "gzip", code: http.StatusOK, content: "hello"},
+		{body: []byte("hello"), encoding: "gzip", code: http.StatusUnprocessableEntity, content: "Content-Encoding: gzip set but unable to decompress body"},
+		{body: buf, encoding: "gzip, unknown", code: http.StatusNotImplemented, content: "Content-Encoding: unknown is not supported"},
+		{body: buf, encoding: "gzip, gzip, gzip, gzip", code: http.StatusNotImplemented, content: "Content-Encoding: too many content codings"},
+		{body: buf, encoding: "gzip;q=1", code: http.StatusBadRequest, content: "Content-Encoding header is invalid"},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.encoding, rr.Code, tt.code)
+		}
+
+		if !strings.HasPrefix(rr.Body.String(), tt.content) {
+			t.Fatalf("%s: handler returned unexpected body: got '%v' want prefix '%v'", tt.encoding, rr.Body.String(), tt.content)
+		}
+	}
+}
+
+func TestProblemDetails(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := New(requestBodyWriter{},
+		WithProblemDetails(true),
+		WithAllowedEncodings(EncodingGzip, EncodingZstd),
+		WithStatusMapping(map[ErrorClass]int{ClassMalformed: http.StatusUnprocessableEntity}),
+	)
+
+	for _, tt := range []struct {
+		body     []byte
+		encoding string
+		code     int
+		problem  string
+	}{
+		{body: []byte("hello"), encoding: "gzip", code: http.StatusUnprocessableEntity, problem: `{"type":"about:blank","title":"Unprocessable Entity","status":422,"detail":"Content-Encoding: gzip set but unable to decompress body"}`},
+		{body: buf, encoding: "gzip, unknown", code: http.StatusUnsupportedMediaType, problem: `{"type":"about:blank","title":"Unsupported Media Type","status":415,"detail":"Content-Encoding: unknown is not supported","supported_encodings":["gzip","zstd"]}`},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.encoding, rr.Code, tt.code)
+		}
+
+		if ct := rr.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Fatalf("%s: handler returned wrong content type: %q", tt.encoding, ct)
+		}
+
+		if body := strings.TrimSpace(rr.Body.String()); body != tt.problem {
+			t.Fatalf("%s: handler returned unexpected body: got '%v' want '%v'", tt.encoding, body, tt.problem)
+		}
+	}
+}
+
+func TestErrorRenderer(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := New(requestBodyWriter{},
+		WithErrorRenderer("text/xml", func(w io.Writer, status int, msg string, err error) {
+			fmt.Fprintf(w, "<error><code>%d</code><class>%s</class><message>%s</message></error>", status, ClassifyError(err), msg)
+		}),
+		WithProblemDetails(true),
+		WithStatusMapping(map[ErrorClass]int{ClassMalformed: http.StatusUnprocessableEntity}),
+	)
+
+	for _, tt := range []struct {
+		body     []byte
+		encoding string
+		code     int
+		content  string
+		accept   bool
+	}{
+		{body: buf, encoding: "gzip", code: http.StatusOK, content: "hello"},
+		{body: []byte("hello"), encoding: "gzip", code: http.StatusUnprocessableEntity, content: "<error><code>422</code><class>malformed</class><message>Content-Encoding: gzip set but unable to decompress body</message></error>"},
+		{body: buf, encoding: "gzip, unknown", code: http.StatusUnsupportedMediaType, content: "<error><code>415</code><class>unsupported</class><message>Content-Encoding: unknown is not supported</message></error>", accept: true},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.encoding, rr.Code, tt.code)
+		}
+
+		if rr.Body.String() != tt.content {
+			t.Fatalf("%s: handler returned unexpected body: got '%v' want '%v'", tt.encoding, rr.Body.String(), tt.content)
+		}
+
+		if tt.code != http.StatusOK && rr.Header().Get("Content-Type") != "text/xml" {
+			t.Fatalf("%s: handler returned wrong content type: %q", tt.encoding, rr.Header().Get("Content-Type"))
+		}
+
+		if accept := rr.Header().Get("Accept-Encoding") != ""; accept != tt.accept {
+			t.Fatalf("%s: handler returned wrong Accept-Encoding: %q", tt.encoding, rr.Header().Get("Accept-Encoding"))
+		}
+	}
+}
+
+func TestEncodingsDocument(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		body     []byte
+		encoding string
+		opts     []Option
+		code     int
+		ct       string
+		doc      string
+	}{
+		{body: buf, encoding: "gzip, unknown", code: http.StatusUnsupportedMediaType, ct: "application/json", doc: `{"error":"Content-Encoding: unknown is not supported","supported_encodings":["gzip","zstd"],"limits":{"max_codings":3}}`},
+		{body: buf, encoding: "gzip, unknown", opts: []Option{WithMaxCodings(2), WithMaxEncodedBytes(1 << 10), WithMaxDecodedBytes(1 << 20), WithMaxRatio(100, nil)}, code: http.StatusUnsupportedMediaType, ct: "application/json", doc: `{"error":"Content-Encoding: unknown is not supported","supported_encodings":["gzip","zstd"],"limits":{"max_codings":2,"max_encoded_bytes":1024,"max_decoded_bytes":1048576,"max_ratio":100}}`},
+		{body: buf, encoding: "gzip, unknown", opts: []Option{WithMaxCodings(0), WithProblemDetails(true)}, code: http.StatusUnsupportedMediaType, ct: "application/problem+json", doc: `{"type":"about:blank","title":"Unsupported Media Type","status":415,"detail":"Content-Encoding: unknown is not supported","supported_encodings":["gzip","zstd"],"limits":{}}`},
+		{body: []byte("hello"), encoding: "gzip", code: http.StatusBadRequest, ct: "text/plain; charset=utf-8", doc: "Content-Encoding: gzip set but unable to decompress body"},
+	} {
+		opts := append([]Option{WithEncodingsDocument(true), WithAllowedEncodings(EncodingGzip, EncodingZstd)}, tt.opts...)
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, opts...).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.encoding, rr.Code, tt.code)
+		}
+
+		if ct := rr.Header().Get("Content-Type"); ct != tt.ct {
+			t.Fatalf("%s: handler returned wrong content type: got %q want %q", tt.encoding, ct, tt.ct)
+		}
+
+		if body := strings.TrimSpace(rr.Body.String()); body != tt.doc {
+			t.Fatalf("%s: handler returned unexpected body: got '%v' want '%v'", tt.encoding, body, tt.doc)
+		}
+	}
+}
+
+func TestBuffering(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		body []byte
+		max  int64
+		code int
+	}{
+		{body: buf, max: 5, code: http.StatusOK},
+		{body: buf, max: 4, code: http.StatusRequestEntityTooLarge},
+		{body: buf[:len(buf)-4], max: 5, code: http.StatusBadRequest},
+	} {
+		called := false
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			if r.ContentLength != 5 || r.Header.Get("Content-Length") != "5" {
+				t.Fatalf("max %d: got ContentLength %d and header %q, want 5", tt.max, r.ContentLength, r.Header.Get("Content-Length"))
+			}
+
+			if stats, _ := StatsFromContext(r.Context()); stats.DecodedBytes != 5 {
+				t.Fatalf("max %d: got %d decoded bytes before reading, want 5", tt.max, stats.DecodedBytes)
+			}
+
+			for i := 0; i < 2; i++ {
+				body, err := r.GetBody()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if p, err := ioutil.ReadAll(body); err != nil || string(p) != "hello" {
+					t.Fatalf("max %d: GetBody returned %q, %v", tt.max, p, err)
+				}
+			}
+
+			requestBodyWriter{}.ServeHTTP(w, r)
+			if err := CloseBody(r); err != nil {
+				t.Fatalf("max %d: unexpected error closing body: %v", tt.max, err)
+			}
+		})
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		New(inner, WithBuffering(tt.max)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("max %d: handler returned wrong status code: got %v want %v", tt.max, rr.Code, tt.code)
+		}
+
+		if called != (tt.code == http.StatusOK) {
+			t.Fatalf("max %d: next handler called: %v", tt.max, called)
+		}
+
+		if tt.code == http.StatusOK && rr.Body.String() != "hello" {
+			t.Fatalf("max %d: handler returned unexpected body: got '%v' want 'hello'", tt.max, rr.Body.String())
+		}
+	}
+}
+
+func TestLazyDecoding(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened := 0
+	gz := CodecFunc(func(r *http.Request, body io.Reader) (io.ReadCloser, error) {
+		opened++
+		return gzip.NewReader(body)
+	})
+
+	for _, tt := range []struct {
+		body   []byte
+		read   bool
+		opened int
+		err    bool
+	}{
+		{body: buf, read: false, opened: 0},
+		{body: []byte("hello"), read: false, opened: 0},
+		{body: buf, read: true, opened: 1},
+		{body: []byte("hello"), read: true, opened: 1, err: true},
+	} {
+		var errs []error
+		var content string
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !tt.read {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			for i := 0; i < 2; i++ {
+				p, err := ioutil.ReadAll(r.Body)
+				content += string(p)
+				errs = append(errs, err)
+			}
+		})
+
+		opened = 0
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		New(inner, WithCodec(EncodingGzip, gz), WithLazyDecoding(true), WithVerifyChecksum(true)).ServeHTTP(rr, req)
+
+		if opened != tt.opened {
+			t.Fatalf("%q, read %v: decoder opened %d times, want %d", tt.body, tt.read, opened, tt.opened)
+		}
+
+		if !tt.read {
+			if rr.Code != http.StatusUnauthorized {
+				t.Fatalf("%q: handler returned wrong status code: got %v want %v", tt.body, rr.Code, http.StatusUnauthorized)
+			}
+
+			continue
+		}
+
+		if !tt.err {
+			if content != "hello" || errs[0] != nil || errs[1] != nil {
+				t.Fatalf("%q: read %q, %v", tt.body, content, errs)
+			}
+
+			continue
+		}
+
+		if de, ok := errs[0].(*DecompressionError); !ok || de.Encoding != "gzip" || errs[1] != errs[0] {
+			t.Fatalf("%q: unexpected read errors: %v", tt.body, errs)
+		}
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut off the gzip trailer, so that the deflate stream ends cleanly
+	// but the checksum and length are missing.
+	truncated := buf[:len(buf)-8]
+
+	// readHello reads the five bytes of the expected body, but not the
+	// end of it, and writes no response.
+	var stats Stats
+	readHello := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := make([]byte, 5)
+		if _, err := io.ReadFull(r.Body, p); err != nil || string(p) != "hello" {
+			t.Fatalf("unexpected read: %q, %v", p, err)
+		}
+
+		r.Body.Close()
+		stats, _ = StatsFromContext(r.Context())
+	})
+
+	for _, tt := range []struct {
+		body   []byte
+		verify bool
+		code   int
+	}{
+		{body: buf, verify: true, code: http.StatusOK},
+		{body: truncated, verify: false, code: http.StatusOK},
+		{body: truncated, verify: true, code: http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		New(readHello, WithVerifyChecksum(tt.verify)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%d bytes, verify %v: handler returned wrong status code: got %v want %v", len(tt.body), tt.verify, rr.Code, tt.code)
+		}
+	}
+
+	// Handlers which read to the end see the error themselves.
+	var readErr error
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = ioutil.ReadAll(r.Body)
+		stats, _ = StatsFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(truncated))
+	req.Header.Set("Content-Encoding", "gzip")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if de, ok := readErr.(*DecompressionError); !ok || de.Encoding != "gzip" || de.Err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected read error: %v", readErr)
+	}
+
+	if stats.Err != readErr {
+		t.Fatalf("unexpected stats error: got %v want %v", stats.Err, readErr)
+	}
+}
+
+func TestDecodedSizeHeader(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// writeFirst responds before reading the body, so the decoded size
+	// is not known yet.
+	writeFirst := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		ioutil.ReadAll(r.Body)
+	})
+
+	for _, tt := range []struct {
+		handler http.Handler
+		size    string
+	}{
+		{handler: requestBodyWriter{}, size: "5"},
+		{handler: writeFirst, size: ""},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		New(tt.handler, WithDecodedSizeHeader("X-Decoded-Content-Length")).ServeHTTP(rr, req)
+
+		if size := rr.Result().Header.Get("X-Decoded-Content-Length"); size != tt.size {
+			t.Fatalf("unexpected X-Decoded-Content-Length: got '%v' want '%v'", size, tt.size)
+		}
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timing := regexp.MustCompile(`^unpack;dur=[0-9]+\.[0-9]{3};desc="(.*)"$`)
+	for _, tt := range []struct {
+		body     []byte
+		encoding string
+		handler  http.Handler
+		desc     string
+	}{
+		{body: buf, encoding: "gzip", handler: requestBodyWriter{}, desc: "gzip"},
+		{body: buf, encoding: "x-gzip", handler: errorBodyWriter{}, desc: "gzip"},
+		{body: []byte("hello"), encoding: "gzip", handler: errorBodyWriter{}, desc: "gzip"},
+		{body: []byte("hello"), encoding: "made-up", handler: requestBodyWriter{}},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		New(tt.handler, WithServerTiming(true)).ServeHTTP(rr, req)
+
+		values := rr.Result().Header.Values("Server-Timing")
+		if tt.desc == "" {
+			if len(values) != 0 {
+				t.Fatalf("%s: unexpected Server-Timing: %q", tt.encoding, values)
+			}
+
+			continue
+		}
+
+		if len(values) != 1 {
+			t.Fatalf("%s: want one Server-Timing, got %q", tt.encoding, values)
+		}
+
+		m := timing.FindStringSubmatch(values[0])
+		if m == nil || m[1] != tt.desc {
+			t.Fatalf("%s: unexpected Server-Timing: %q", tt.encoding, values[0])
+		}
+	}
+}
+
+func TestDebugHeaders(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		body     []byte
+		encoding string
+		opts     []Option
+		headers  map[string]string
+	}{
+		{body: buf, encoding: "gzip", headers: map[string]string{
+			"X-Unpack-Encoding":         "gzip",
+			"X-Unpack-Compressed-Bytes": fmt.Sprint(len(buf)),
+			"X-Unpack-Decoded-Bytes":    "5",
+			"X-Unpack-Error":            "",
+		}},
+		{body: buf, encoding: "gzip", opts: []Option{WithMaxDecodedBytes(4)}, headers: map[string]string{
+			"X-Unpack-Encoding":      "gzip",
+			"X-Unpack-Decoded-Bytes": "4",
+			"X-Unpack-Error":         "too large",
+		}},
+		{body: []byte("hello"), encoding: "gzip", headers: map[string]string{
+			"X-Unpack-Encoding": "gzip",
+			"X-Unpack-Error":    "malformed",
+		}},
+		{body: []byte("hello"), encoding: "made-up", headers: map[string]string{
+			"X-Unpack-Encoding": "",
+			"X-Unpack-Error":    "",
+		}},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		New(errorBodyWriter{}, append(tt.opts, WithDebugHeaders(true))...).ServeHTTP(rr, req)
+
+		for name, want := range tt.headers {
+			if got := rr.Result().Header.Get(name); got != want {
+				t.Fatalf("%s: wrong %s: got %q want %q", tt.encoding, name, got, want)
+			}
+		}
+	}
+}
+
+func TestPprofLabels(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz.zz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		route  func(*http.Request) string
+		labels map[string]string
+	}{
+		{labels: map[string]string{"unpack.encoding": "gzip, deflate"}},
+		{route: func(r *http.Request) string { return r.URL.Path }, labels: map[string]string{
+			"unpack.encoding": "gzip, deflate",
+			"unpack.route":    "/test",
+		}},
+		{route: func(r *http.Request) string { return "" }, labels: map[string]string{
+			"unpack.encoding": "gzip, deflate",
+			"unpack.route":    "",
+		}},
+	} {
+		var labels context.Context
+		handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			labels = r.Body.(*body).labels
+			requestBodyWriter{}.ServeHTTP(w, r)
+		}), WithPprofLabels(tt.route))
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", "gzip, deflate")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Body.String() != "hello" {
+			t.Fatalf("unexpected body: %q", rr.Body.String())
+		}
+
+		for key, want := range tt.labels {
+			if got, _ := pprof.Label(labels, key); got != want {
+				t.Fatalf("wrong %s label: got %q want %q", key, got, want)
+			}
+		}
+	}
+}
+
+// teeWriter keeps what is written to it, failing writes after the first
+// max bytes if max is not zero.
+type teeWriter struct {
+	bytes.Buffer
+	max    int
+	closed bool
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	if w.max > 0 && w.Len()+len(p) > w.max {
+		return 0, errFault
+	}
+
+	return w.Buffer.Write(p)
+}
+
+func (w *teeWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestTee(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		max  int
+		want string
+	}{
+		{want: "hello"},
+		{max: 2, want: ""},
+	} {
+		var tee *teeWriter
+		handler := New(requestBodyWriter{}, WithTee(func(r *http.Request) io.Writer {
+			tee = &teeWriter{max: tt.max}
+			return tee
+		}))
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK || rr.Body.String() != "hello" {
+			t.Fatalf("unexpected response: %d %q", rr.Code, rr.Body.String())
+		}
+
+		if tee.String() != tt.want || !tee.closed {
+			t.Fatalf("unexpected copy: %q, closed %v", tee.String(), tee.closed)
+		}
+	}
+}
+
+// faultyBody fails with errFault once n bytes have been read from it.
+type faultyBody struct {
+	io.ReadCloser
+	n      int
+	closed bool
+}
+
+var errFault = errors.New("injected fault")
+
+func (f *faultyBody) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, errFault
+	}
+
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+
+	n, err := f.ReadCloser.Read(p)
+	f.n -= n
+	return n, err
+}
+
+func (f *faultyBody) Close() error {
+	f.closed = true
+	return f.ReadCloser.Close()
+}
+
+func TestRawBodyWrapper(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(bytes.Repeat([]byte("hello, world\n"), 1000))
+	zw.Close()
+
+	var faulty *faultyBody
+	wrap := func(rc io.ReadCloser) io.ReadCloser {
+		faulty = &faultyBody{ReadCloser: rc, n: buf.Len() / 2}
+		return faulty
+	}
+
+	var readErr error
+	handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = ioutil.ReadAll(r.Body)
+	}), WithRawBodyWrapper(wrap))
+
+	req := httptest.NewRequest("POST", "/test", &buf)
+	req.Header.Set("Content-Encoding", "gzip")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	de, ok := readErr.(*DecompressionError)
+	if !ok || !errors.Is(de, errFault) {
+		t.Fatalf("handler got %v, want a *DecompressionError wrapping the fault", readErr)
+	}
+
+	if !faulty.closed {
+		t.Fatal("wrapper was not closed")
+	}
+}
+
+func TestMaxCodings(t *testing.T) {
+	body := []byte("hello")
+	for i := 0; i < 4; i++ {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		zw.Close()
+		body = buf.Bytes()
+	}
+
+	for _, tt := range []struct {
+		encoding string
+		opts     []Option
+		code     int
+		content  string
+	}{
+		{encoding: "gzip, gzip, gzip, gzip", code: http.StatusUnsupportedMediaType, content: "Content-Encoding: too many content codings"},
+		{encoding: "gzip, gzip, gzip, gzip", opts: []Option{WithMaxCodings(4)}, code: http.StatusOK, content: "hello"},
+		{encoding: "gzip, gzip, gzip, gzip", opts: []Option{WithMaxCodings(0)}, code: http.StatusOK, content: "hello"},
+		{encoding: "gzip, gzip, identity, gzip, gzip", opts: []Option{WithMaxCodings(3)}, code: http.StatusUnsupportedMediaType, content: "Content-Encoding: too many content codings"},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, tt.opts...).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.encoding, rr.Code, tt.code)
+		}
+
+		if body := strings.TrimSuffix(rr.Body.String(), "\n"); body != tt.content {
+			t.Fatalf("%s: handler returned unexpected body: got '%v' want '%v'", tt.encoding, body, tt.content)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+module github.com/njern/unpack/otel
+
+go 1.22
+
+require (
+	github.com/njern/unpack v0.0.0-20261016170640-d234ddb6f3a0
+	go.opentelemetry.io/otel v1.28.0
+	go.opentelemetry.io/otel/metric v1.28.0
+	go.opentelemetry.io/otel/trace v1.28.0
+)
+
+require (
+	github.com/andybalholm/brotli v1.2.0 // indirect
+	github.com/golang/snappy v1.0.0 // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
+	github.com/ulikunitz/xz v0.5.15 // indirect
+)
+
+replace github.com/njern/unpack => ../
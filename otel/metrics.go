@@ -0,0 +1,119 @@
+package otel
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/njern/unpack"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// meterName is the name of the meter Metrics are created with.
+const meterName = "github.com/njern/unpack/otel"
+
+// otherEncoding labels bodies in codings which are not decoded, so that
+// clients cannot blow up the number of series.
+const otherEncoding = "other"
+
+// Metrics records OpenTelemetry metrics about the request bodies unpacked
+// by Handlers, for services which do not use the prometheus subpackage:
+//
+//   - unpack.decode.duration is a histogram of the time spent decoding
+//     bodies, in seconds.
+//   - unpack.decode.ratio is a histogram of the ratios of the decoded to
+//     the encoded sizes of bodies.
+//   - unpack.rejects counts the requests which Handlers rejected, by
+//     class of error, see unpack.ErrorClass, in an error.class attribute.
+//
+// All of them have an unpack.encoding attribute listing the content
+// codings of the body, e.g. "gzip", or "other" for bodies in codings which
+// are not decoded.
+type Metrics struct {
+	duration metric.Float64Histogram
+	ratio    metric.Float64Histogram
+	rejects  metric.Int64Counter
+}
+
+// NewMetrics returns Metrics which record to meters of mp, e.g. the global
+// otel.GetMeterProvider().
+func NewMetrics(mp metric.MeterProvider) (*Metrics, error) {
+	meter := mp.Meter(meterName)
+	duration, err := meter.Float64Histogram("unpack.decode.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Time spent decoding request bodies."))
+	if err != nil {
+		return nil, err
+	}
+
+	ratio, err := meter.Float64Histogram("unpack.decode.ratio",
+		metric.WithUnit("1"),
+		metric.WithDescription("Ratios of the decoded to the encoded sizes of request bodies."))
+	if err != nil {
+		return nil, err
+	}
+
+	rejects, err := meter.Int64Counter("unpack.rejects",
+		metric.WithUnit("{request}"),
+		metric.WithDescription("Requests rejected because of their body."))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Metrics{duration: duration, ratio: ratio, rejects: rejects}, nil
+}
+
+// Option returns an unpack.Option which makes a Handler record to m.
+func (m *Metrics) Option() unpack.Option {
+	onDone := unpack.WithOnDone(m.observeDone)
+	onError := unpack.WithOnError(m.observeError)
+	return func(h *unpack.Handler) {
+		onDone(h)
+		onError(h)
+	}
+}
+
+// observeDone records a body which a Handler passed on.
+func (m *Metrics) observeDone(r *http.Request, s unpack.Stats) {
+	m.observe(r, s.Encoding, s.EncodedBytes, s.DecodedBytes, s.DecodeDuration.Seconds())
+}
+
+// observeError records the body of a request which a Handler rejected.
+func (m *Metrics) observeError(r *http.Request, info unpack.ErrorInfo) {
+	encoding := canonical(info.Encoding)
+	if info.Class == unpack.ClassUnsupported || info.Class == unpack.ClassInvalidHeader {
+		encoding = otherEncoding
+	}
+
+	m.observe(r, encoding, info.EncodedBytes, info.DecodedBytes, info.Duration.Seconds())
+	m.rejects.Add(r.Context(), 1, metric.WithAttributes(
+		attribute.String("unpack.encoding", encoding),
+		attribute.String("error.class", info.Class.String()),
+	))
+}
+
+// observe records the decoding of a body in the given encoding.
+func (m *Metrics) observe(r *http.Request, encoding string, encoded, decoded int64, seconds float64) {
+	attrs := metric.WithAttributes(attribute.String("unpack.encoding", encoding))
+	m.duration.Record(r.Context(), seconds, attrs)
+	if encoded > 0 {
+		m.ratio.Record(r.Context(), float64(decoded)/float64(encoded), attrs)
+	}
+}
+
+// canonical returns the canonical names of the codings listed in the
+// Content-Encoding header value header, the way unpack.Stats lists them,
+// or otherEncoding if header is invalid.
+func canonical(header string) string {
+	codings, err := unpack.ParseCodings(header)
+	if err != nil {
+		return otherEncoding
+	}
+
+	names := make([]string, len(codings))
+	for i, c := range codings {
+		names[i] = c.Name
+	}
+
+	return strings.Join(names, ", ")
+}
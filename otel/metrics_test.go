@@ -0,0 +1,114 @@
+package otel
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/njern/unpack"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// fakeProvider is a metric.MeterProvider of a fakeMeter.
+type fakeProvider struct {
+	metric.MeterProvider
+	m *fakeMeter
+}
+
+func (p fakeProvider) Meter(name string, opts ...metric.MeterOption) metric.Meter {
+	return p.m
+}
+
+// fakeMeter is a metric.Meter whose instruments keep what is recorded to
+// them, by "name encoding [class]".
+type fakeMeter struct {
+	metric.Meter
+	values map[string][]float64
+}
+
+func (m *fakeMeter) Float64Histogram(name string, options ...metric.Float64HistogramOption) (metric.Float64Histogram, error) {
+	return &fakeHistogram{m: m, name: name}, nil
+}
+
+func (m *fakeMeter) Int64Counter(name string, options ...metric.Int64CounterOption) (metric.Int64Counter, error) {
+	return &fakeCounter{m: m, name: name}, nil
+}
+
+type fakeHistogram struct {
+	metric.Float64Histogram
+	m    *fakeMeter
+	name string
+}
+
+func (h *fakeHistogram) Record(ctx context.Context, v float64, options ...metric.RecordOption) {
+	attrs := metric.NewRecordConfig(options).Attributes()
+	encoding, _ := attrs.Value("unpack.encoding")
+	key := h.name + " " + encoding.AsString()
+	h.m.values[key] = append(h.m.values[key], v)
+}
+
+type fakeCounter struct {
+	metric.Int64Counter
+	m    *fakeMeter
+	name string
+}
+
+func (c *fakeCounter) Add(ctx context.Context, v int64, options ...metric.AddOption) {
+	attrs := metric.NewAddConfig(options).Attributes()
+	encoding, _ := attrs.Value("unpack.encoding")
+	class, _ := attrs.Value("error.class")
+	key := c.name + " " + encoding.AsString() + " " + class.AsString()
+	c.m.values[key] = append(c.m.values[key], float64(v))
+}
+
+func TestMetrics(t *testing.T) {
+	fake := &fakeMeter{values: map[string][]float64{}}
+	m, err := NewMetrics(fakeProvider{m: fake})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := unpack.New(echo, m.Option(), unpack.WithMaxDecodedBytes(8))
+	for _, tt := range []struct {
+		body     []byte
+		encoding string
+	}{
+		{body: gzipped(t, "hello"), encoding: "gzip"},
+		{body: gzipped(t, "hello, world"), encoding: "gzip"},
+		{body: []byte("hello"), encoding: "x-gzip"},
+		{body: gzipped(t, "hello"), encoding: "gzip, made-up"},
+		{body: []byte("hello")},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewReader(tt.body))
+		if tt.encoding != "" {
+			req.Header.Set("Content-Encoding", tt.encoding)
+		}
+
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for key, want := range map[string]int{
+		"unpack.decode.duration gzip":        3,
+		"unpack.decode.ratio gzip":           3,
+		"unpack.decode.duration other":       1,
+		"unpack.rejects gzip too large":      1,
+		"unpack.rejects gzip malformed":      1,
+		"unpack.rejects other unsupported":   1,
+		"unpack.decode.ratio other":          0,
+		"unpack.rejects gzip, made-up other": 0,
+	} {
+		if got := len(fake.values[key]); got != want {
+			t.Fatalf("%s: got %d values want %d", key, got, want)
+		}
+	}
+
+	want := 5 / float64(len(gzipped(t, "hello")))
+	if ratio := fake.values["unpack.decode.ratio gzip"][0]; ratio != want {
+		t.Fatalf("wrong ratio: got %v want %v", ratio, want)
+	}
+
+	if n := len(fake.values); n != 6 {
+		t.Fatalf("unexpected series: %v", fake.values)
+	}
+}
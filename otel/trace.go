@@ -0,0 +1,87 @@
+// Package otel instruments unpack Handlers with OpenTelemetry, so that
+// slow or failing decodes show up in traces, and records metrics about
+// them, see Metrics:
+//
+//	m, err := otel.NewMetrics(meterProvider)
+//	if err != nil {
+//		return err
+//	}
+//	handler := unpack.New(next, otel.Tracing(), m.Option())
+//
+// Decoding is spread over the reads of the next handler, so rather than
+// in a span of its own it is described by attributes of the active span
+// of the request, usually the server span:
+//
+//   - unpack.encoding lists the content codings of the body, e.g. "gzip".
+//   - unpack.encoded_bytes and unpack.decoded_bytes are the sizes of the
+//     body as sent and as decoded.
+//   - unpack.decode_duration is the time spent decoding, in seconds.
+//   - unpack.raw is set for bodies passed on as sent, see
+//     unpack.WithFailOpen.
+//   - unpack.error_class is the class of the error which the body failed
+//     with, if any, see unpack.ErrorClass. The error itself is recorded as
+//     an exception event.
+package otel
+
+import (
+	"net/http"
+
+	"github.com/njern/unpack"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing returns an unpack.Option which makes a Handler describe what it
+// did with the body of each request in the active span of the request,
+// once the next handler has returned or the request has been rejected.
+func Tracing() unpack.Option {
+	onDone := unpack.WithOnDone(annotateDone)
+	onError := unpack.WithOnError(annotateError)
+	return func(h *unpack.Handler) {
+		onDone(h)
+		onError(h)
+	}
+}
+
+// annotateDone describes a body which a Handler passed on in the span of
+// r.
+func annotateDone(r *http.Request, s unpack.Stats) {
+	span := trace.SpanFromContext(r.Context())
+	if !span.IsRecording() {
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("unpack.encoding", s.Encoding),
+		attribute.Int64("unpack.encoded_bytes", s.EncodedBytes),
+		attribute.Int64("unpack.decoded_bytes", s.DecodedBytes),
+		attribute.Float64("unpack.decode_duration", s.DecodeDuration.Seconds()),
+	)
+
+	if s.Raw {
+		span.SetAttributes(attribute.Bool("unpack.raw", true))
+	}
+
+	if s.Err != nil {
+		span.SetAttributes(attribute.String("unpack.error_class", unpack.ClassifyError(s.Err).String()))
+		span.RecordError(s.Err)
+	}
+}
+
+// annotateError describes the body of a request which a Handler rejected
+// in the span of r.
+func annotateError(r *http.Request, info unpack.ErrorInfo) {
+	span := trace.SpanFromContext(r.Context())
+	if !span.IsRecording() {
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("unpack.encoding", info.Encoding),
+		attribute.Int64("unpack.encoded_bytes", info.EncodedBytes),
+		attribute.Int64("unpack.decoded_bytes", info.DecodedBytes),
+		attribute.Float64("unpack.decode_duration", info.Duration.Seconds()),
+		attribute.String("unpack.error_class", info.Class.String()),
+	)
+	span.RecordError(info.Err)
+}
@@ -0,0 +1,115 @@
+package otel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/njern/unpack"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordingSpan keeps the attributes and errors recorded in it.
+type recordingSpan struct {
+	trace.Span
+	attrs map[attribute.Key]interface{}
+	errs  []error
+}
+
+func (s *recordingSpan) IsRecording() bool {
+	return true
+}
+
+func (s *recordingSpan) SetAttributes(kvs ...attribute.KeyValue) {
+	for _, kv := range kvs {
+		s.attrs[kv.Key] = kv.Value.AsInterface()
+	}
+}
+
+func (s *recordingSpan) RecordError(err error, options ...trace.EventOption) {
+	s.errs = append(s.errs, err)
+}
+
+// echo writes the body of each request back to the client, answering
+// errors reading it with unpack.Error where it can.
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	var buf strings.Builder
+	if _, err := io.Copy(&buf, r.Body); err != nil {
+		if !unpack.Error(w, r, err) {
+			http.Error(w, "unable to read r.Body", http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	w.Write([]byte(buf.String()))
+})
+
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestTracing(t *testing.T) {
+	handler := unpack.New(echo, Tracing(), unpack.WithMaxDecodedBytes(8))
+
+	for _, tt := range []struct {
+		body     []byte
+		encoding string
+		attrs    map[attribute.Key]interface{}
+		err      bool
+	}{
+		{body: []byte("hello"), attrs: map[attribute.Key]interface{}{}},
+		{body: gzipped(t, "hello"), encoding: "gzip", attrs: map[attribute.Key]interface{}{
+			"unpack.encoding":      "gzip",
+			"unpack.decoded_bytes": int64(5),
+		}},
+		{body: gzipped(t, "hello, world"), encoding: "gzip", attrs: map[attribute.Key]interface{}{
+			"unpack.encoding":      "gzip",
+			"unpack.decoded_bytes": int64(8),
+			"unpack.error_class":   "too large",
+		}, err: true},
+		{body: gzipped(t, "hello"), encoding: "gzip, made-up", attrs: map[attribute.Key]interface{}{
+			"unpack.encoding":      "gzip, made-up",
+			"unpack.encoded_bytes": int64(0),
+			"unpack.error_class":   "unsupported",
+		}, err: true},
+	} {
+		span := &recordingSpan{attrs: map[attribute.Key]interface{}{}}
+		req := httptest.NewRequest("POST", "/test", bytes.NewReader(tt.body))
+		req = req.WithContext(trace.ContextWithSpan(req.Context(), span))
+		if tt.encoding != "" {
+			req.Header.Set("Content-Encoding", tt.encoding)
+		}
+
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		for k, want := range tt.attrs {
+			if got := span.attrs[k]; got != want {
+				t.Fatalf("%s: wrong %s: got %v want %v", tt.encoding, k, got, want)
+			}
+		}
+
+		if len(tt.attrs) == 0 && len(span.attrs) != 0 {
+			t.Fatalf("%s: unexpected attributes: %v", tt.encoding, span.attrs)
+		}
+
+		if recorded := len(span.errs) > 0; recorded != tt.err {
+			t.Fatalf("%s: error recorded: got %v want %v", tt.encoding, recorded, tt.err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package unpack
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/zlib"
+	"io"
+	"sync"
+)
+
+// Pools of decoders, and of the buffered readers they read through, which
+// are large enough for allocating them for each request to show.
+var (
+	bufReaders   sync.Pool // Of *bufio.Reader.
+	gzipReaders  sync.Pool // Of *gzip.Reader.
+	zlibReaders  sync.Pool // Of zlib readers, which are zlib.Resetters.
+	flateReaders sync.Pool // Of flate readers, which are flate.Resetters.
+)
+
+// getBufReader returns a buffered reader of r from the pool.
+func getBufReader(r io.Reader) *bufio.Reader {
+	if br, ok := bufReaders.Get().(*bufio.Reader); ok {
+		br.Reset(r)
+		return br
+	}
+
+	return bufio.NewReader(r)
+}
+
+// putBufReader returns br to the pool.
+func putBufReader(br *bufio.Reader) {
+	br.Reset(nil)
+	bufReaders.Put(br)
+}
+
+// pooledReader is a decoder from a pool which, once it is closed, returns
+// itself and the buffered reader it reads from to their pools.
+type pooledReader struct {
+	io.ReadCloser
+	pool *sync.Pool
+	br   *bufio.Reader
+}
+
+// Close closes the decoder of p and returns it to its pool. p must not be
+// used after.
+func (p *pooledReader) Close() error {
+	if p.ReadCloser == nil {
+		return nil
+	}
+
+	err := p.ReadCloser.Close()
+	p.pool.Put(p.ReadCloser)
+	putBufReader(p.br)
+	p.ReadCloser, p.br = nil, nil
+	return err
+}
+
+// newZlibReader returns a zlib reader of br from the pool, which decodes
+// streams that need a preset dictionary with dict. Once the reader is
+// closed, br is returned to the pool too.
+func newZlibReader(br *bufio.Reader, dict []byte) (io.ReadCloser, error) {
+	zr, ok := zlibReaders.Get().(io.ReadCloser)
+	if ok {
+		if err := zr.(zlib.Resetter).Reset(br, dict); err != nil {
+			zlibReaders.Put(zr)
+			return nil, err
+		}
+	} else {
+		var err error
+		if zr, err = zlib.NewReaderDict(br, dict); err != nil {
+			return nil, err
+		}
+	}
+
+	return &pooledReader{ReadCloser: zr, pool: &zlibReaders, br: br}, nil
+}
+
+// newFlateReader returns a reader of the raw DEFLATE data in br from the
+// pool. Once the reader is closed, br is returned to the pool too.
+func newFlateReader(br *bufio.Reader) io.ReadCloser {
+	fr, ok := flateReaders.Get().(io.ReadCloser)
+	if ok {
+		// Resetting without a dictionary cannot fail.
+		fr.(flate.Resetter).Reset(br, nil)
+	} else {
+		fr = flate.NewReader(br)
+	}
+
+	return &pooledReader{ReadCloser: fr, pool: &flateReaders, br: br}
+}
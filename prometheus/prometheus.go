@@ -0,0 +1,175 @@
+// Package prometheus exports metrics about the request bodies unpacked by
+// unpack Handlers to Prometheus, so that decompression behavior can be put
+// on dashboards per service:
+//
+//	m := prometheus.New("myservice")
+//	registry.MustRegister(m)
+//	handler := unpack.New(next, m.Option())
+//
+// All metrics are labeled with the content codings of the body, e.g.
+// "gzip" or "gzip, deflate". Bodies in codings which the Handler does not
+// decode, or whose Content-Encoding header is invalid, are labeled "other"
+// so that clients cannot blow up the number of series.
+package prometheus
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/njern/unpack"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// otherEncoding labels bodies in codings which are not decoded.
+const otherEncoding = "other"
+
+// Metrics collects metrics about the request bodies unpacked by Handlers.
+// It is a prometheus.Collector, which has to be registered for the
+// metrics to be exported.
+type Metrics struct {
+	requests     *prometheus.CounterVec
+	limits       *prometheus.CounterVec
+	encodedBytes *prometheus.HistogramVec
+	decodedBytes *prometheus.HistogramVec
+	duration     *prometheus.HistogramVec
+}
+
+// New returns Metrics whose names start with namespace, if it is not
+// empty, and unpack:
+//
+//   - unpack_requests_total counts requests by encoding and outcome, which
+//     is "ok" for bodies which were decoded without errors, "raw" for
+//     bodies passed on as they were sent, see unpack.WithFailOpen, and the
+//     class of the error otherwise, see unpack.ErrorClass, e.g. "malformed".
+//   - unpack_limit_rejections_total counts bodies by encoding which
+//     exceeded a size limit.
+//   - unpack_encoded_bytes and unpack_decoded_bytes are histograms of the
+//     sizes of bodies by encoding, as sent and as decoded.
+//   - unpack_decode_duration_seconds is a histogram of the time spent
+//     decoding bodies by encoding, see unpack.Stats.
+func New(namespace string) *Metrics {
+	sizes := prometheus.ExponentialBuckets(256, 4, 10)
+	return &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "unpack",
+			Name:      "requests_total",
+			Help:      "Requests with an encoded body, by encoding and outcome.",
+		}, []string{"encoding", "outcome"}),
+		limits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "unpack",
+			Name:      "limit_rejections_total",
+			Help:      "Request bodies which exceeded a size limit, by encoding.",
+		}, []string{"encoding"}),
+		encodedBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "unpack",
+			Name:      "encoded_bytes",
+			Help:      "Sizes of request bodies as sent, by encoding.",
+			Buckets:   sizes,
+		}, []string{"encoding"}),
+		decodedBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "unpack",
+			Name:      "decoded_bytes",
+			Help:      "Sizes of decoded request bodies, by encoding.",
+			Buckets:   sizes,
+		}, []string{"encoding"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "unpack",
+			Name:      "decode_duration_seconds",
+			Help:      "Time spent decoding request bodies, by encoding.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"encoding"}),
+	}
+}
+
+// collectors returns the metrics of m.
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.requests, m.limits, m.encodedBytes, m.decodedBytes, m.duration}
+}
+
+// Describe sends the descriptors of the metrics of m to ch.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect sends the metrics of m to ch.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// Option returns an unpack.Option which makes a Handler report to m, by
+// adding ObserveDone and ObserveError to its hooks, see unpack.WithOnDone
+// and unpack.WithOnError.
+func (m *Metrics) Option() unpack.Option {
+	onDone := unpack.WithOnDone(m.ObserveDone)
+	onError := unpack.WithOnError(m.ObserveError)
+	return func(h *unpack.Handler) {
+		onDone(h)
+		onError(h)
+	}
+}
+
+// ObserveDone records a request which a Handler passed on, see
+// unpack.WithOnDone.
+func (m *Metrics) ObserveDone(r *http.Request, s unpack.Stats) {
+	outcome := "ok"
+	switch {
+	case s.Raw:
+		outcome = "raw"
+	case s.Err != nil:
+		outcome = unpack.ClassifyError(s.Err).String()
+	}
+
+	m.observe(s.Encoding, outcome, s.EncodedBytes, s.DecodedBytes, s.DecodeDuration.Seconds())
+	if s.Err != nil && !s.Raw && unpack.ClassifyError(s.Err) == unpack.ClassTooLarge {
+		m.limits.WithLabelValues(s.Encoding).Inc()
+	}
+}
+
+// ObserveError records a request which a Handler rejected, see
+// unpack.WithOnError.
+func (m *Metrics) ObserveError(r *http.Request, info unpack.ErrorInfo) {
+	encoding := canonical(info.Encoding)
+	if info.Class == unpack.ClassUnsupported || info.Class == unpack.ClassInvalidHeader {
+		encoding = otherEncoding
+	}
+
+	m.observe(encoding, info.Class.String(), info.EncodedBytes, info.DecodedBytes, info.Duration.Seconds())
+	if info.Class == unpack.ClassTooLarge {
+		m.limits.WithLabelValues(encoding).Inc()
+	}
+}
+
+// observe records a request whose body was in the given encoding.
+func (m *Metrics) observe(encoding, outcome string, encoded, decoded int64, seconds float64) {
+	m.requests.WithLabelValues(encoding, outcome).Inc()
+	m.encodedBytes.WithLabelValues(encoding).Observe(float64(encoded))
+	m.decodedBytes.WithLabelValues(encoding).Observe(float64(decoded))
+	m.duration.WithLabelValues(encoding).Observe(seconds)
+}
+
+// canonical returns the canonical names of the codings listed in the
+// Content-Encoding header value header, the way unpack.Stats lists them.
+// Handlers only reject invalid headers when they are strict about them,
+// so header may list anything; it is labeled otherEncoding then.
+func canonical(header string) string {
+	codings, err := unpack.ParseCodings(header)
+	if err != nil {
+		return otherEncoding
+	}
+
+	names := make([]string, len(codings))
+	for i, c := range codings {
+		names[i] = c.Name
+	}
+
+	return strings.Join(names, ", ")
+}
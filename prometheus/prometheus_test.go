@@ -0,0 +1,99 @@
+package prometheus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/njern/unpack"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// echo writes the body of each request back to the client, answering
+// errors reading it with unpack.Error where it can.
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	var buf strings.Builder
+	if _, err := io.Copy(&buf, r.Body); err != nil {
+		if !unpack.Error(w, r, err) {
+			http.Error(w, "unable to read r.Body", http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	w.Write([]byte(buf.String()))
+})
+
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestMetrics(t *testing.T) {
+	m := New("test")
+	handler := unpack.New(echo, m.Option(), unpack.WithMaxDecodedBytes(8))
+
+	for _, tt := range []struct {
+		body     []byte
+		encoding string
+		code     int
+	}{
+		{body: gzipped(t, "hello"), encoding: "gzip", code: http.StatusOK},
+		{body: gzipped(t, "hello"), encoding: "x-gzip", code: http.StatusOK},
+		{body: gzipped(t, "hello, world"), encoding: "gzip", code: http.StatusRequestEntityTooLarge},
+		{body: []byte("hello"), encoding: "gzip", code: http.StatusBadRequest},
+		{body: gzipped(t, "hello"), encoding: "gzip, made-up", code: http.StatusUnsupportedMediaType},
+		{body: gzipped(t, "hello"), encoding: "gzip, also-made-up", code: http.StatusUnsupportedMediaType},
+		{body: []byte("hello"), code: http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewReader(tt.body))
+		if tt.encoding != "" {
+			req.Header.Set("Content-Encoding", tt.encoding)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.encoding, rr.Code, tt.code)
+		}
+	}
+
+	for _, tt := range []struct {
+		encoding string
+		outcome  string
+		want     float64
+	}{
+		{encoding: "gzip", outcome: "ok", want: 2},
+		{encoding: "gzip", outcome: "too large", want: 1},
+		{encoding: "gzip", outcome: "malformed", want: 1},
+		{encoding: "other", outcome: "unsupported", want: 2},
+	} {
+		if got := testutil.ToFloat64(m.requests.WithLabelValues(tt.encoding, tt.outcome)); got != tt.want {
+			t.Fatalf("%s, %s: wrong request count: got %v want %v", tt.encoding, tt.outcome, got, tt.want)
+		}
+	}
+
+	if got := testutil.ToFloat64(m.limits.WithLabelValues("gzip")); got != 1 {
+		t.Fatalf("wrong limit rejection count: got %v want 1", got)
+	}
+
+	// One series per encoding and outcome, and one per encoding for the
+	// other metrics.
+	if n := testutil.CollectAndCount(m); n != 4+1+3*2 {
+		t.Fatalf("wrong number of series: got %d want %d", n, 4+1+3*2)
+	}
+}
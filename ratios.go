@@ -0,0 +1,134 @@
+package unpack
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// uncompressibleRatio is the ratio of the decoded to the encoded size
+// below which a body is considered uncompressible, see RouteRatios.
+const uncompressibleRatio = 1.1
+
+// RouteRatios aggregates the sizes of the request bodies sent to a route,
+// see RatioTracker.
+type RouteRatios struct {
+	// Route is the route, as returned by the route function of the
+	// RatioTracker.
+	Route string
+
+	// Requests is the number of requests whose body was decoded.
+	Requests int64
+
+	// EncodedBytes and DecodedBytes are the sizes of those bodies as sent
+	// and as decoded, summed up.
+	EncodedBytes int64
+	DecodedBytes int64
+
+	// Uncompressible is the number of those bodies which decoded to less
+	// than 1.1 times their encoded size, i.e. which hardly compressed.
+	Uncompressible int64
+
+	// IdentityRequests is the number of requests whose body was sent
+	// without a content coding, and IdentityBytes the size of those of
+	// them whose size was declared in a Content-Length header.
+	IdentityRequests int64
+	IdentityBytes    int64
+}
+
+// Ratio returns the ratio of the decoded to the encoded size of the
+// bodies which were decoded, or 0 if there were none.
+func (r RouteRatios) Ratio() float64 {
+	if r.EncodedBytes == 0 {
+		return 0
+	}
+
+	return float64(r.DecodedBytes) / float64(r.EncodedBytes)
+}
+
+// A RatioTracker aggregates the compression ratios of request bodies by
+// route, so that capacity planners can see which routes would benefit
+// from requiring compression and which receive bodies that do not
+// compress. Use WithRatioTracker to feed it from Handlers.
+type RatioTracker struct {
+	route func(*http.Request) string
+
+	mu     sync.Mutex
+	routes map[string]*RouteRatios
+}
+
+// NewRatioTracker returns a RatioTracker which aggregates requests by the
+// route which route returns for them, e.g. the pattern of the ServeMux
+// entry which matched. route should return one of a bounded set of
+// values, since each of them is kept. If route is nil all requests are
+// aggregated under the empty route.
+func NewRatioTracker(route func(r *http.Request) string) *RatioTracker {
+	return &RatioTracker{route: route, routes: map[string]*RouteRatios{}}
+}
+
+// Routes returns the aggregates of t so far, sorted by route.
+func (t *RatioTracker) Routes() []RouteRatios {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	routes := make([]RouteRatios, 0, len(t.routes))
+	for _, r := range t.routes {
+		routes = append(routes, *r)
+	}
+
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Route < routes[j].Route })
+	return routes
+}
+
+// Reset discards the aggregates of t, e.g. after reporting them.
+func (t *RatioTracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.routes = map[string]*RouteRatios{}
+}
+
+// add adds to the aggregates of the route of r with f.
+func (t *RatioTracker) add(r *http.Request, f func(*RouteRatios)) {
+	var route string
+	if t.route != nil {
+		route = t.route(r)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rr, ok := t.routes[route]
+	if !ok {
+		rr = &RouteRatios{Route: route}
+		t.routes[route] = rr
+	}
+
+	f(rr)
+}
+
+// done aggregates a request whose body a Handler decoded, see WithOnDone.
+func (t *RatioTracker) done(r *http.Request, s Stats) {
+	if s.Raw || s.EncodedBytes == 0 {
+		return
+	}
+
+	t.add(r, func(rr *RouteRatios) {
+		rr.Requests++
+		rr.EncodedBytes += s.EncodedBytes
+		rr.DecodedBytes += s.DecodedBytes
+		if float64(s.DecodedBytes) < uncompressibleRatio*float64(s.EncodedBytes) {
+			rr.Uncompressible++
+		}
+	})
+}
+
+// identity aggregates a request whose body was not encoded.
+func (t *RatioTracker) identity(r *http.Request) {
+	t.add(r, func(rr *RouteRatios) {
+		rr.IdentityRequests++
+		if r.ContentLength > 0 {
+			rr.IdentityBytes += r.ContentLength
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package unpack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRatioTracker(t *testing.T) {
+	gzipped := func(p []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(p)
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	text := bytes.Repeat([]byte("hello, world "), 100)
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tracker := NewRatioTracker(func(r *http.Request) string { return r.URL.Path })
+	handler := New(requestBodyWriter{}, WithRatioTracker(tracker))
+	for _, tt := range []struct {
+		path     string
+		body     []byte
+		encoding string
+	}{
+		{path: "/text", body: gzipped(text), encoding: "gzip"},
+		{path: "/text", body: gzipped(text), encoding: "gzip"},
+		{path: "/text", body: text},
+		{path: "/random", body: gzipped(random), encoding: "gzip"},
+	} {
+		req := httptest.NewRequest("POST", tt.path, bytes.NewBuffer(tt.body))
+		if tt.encoding != "" {
+			req.Header.Set("Content-Encoding", tt.encoding)
+		}
+
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	routes := tracker.Routes()
+	if len(routes) != 2 {
+		t.Fatalf("want 2 routes, got %+v", routes)
+	}
+
+	if r := routes[0]; r.Route != "/random" || r.Requests != 1 || r.Uncompressible != 1 || r.DecodedBytes != 1000 {
+		t.Fatalf("unexpected aggregates: %+v", r)
+	}
+
+	r := routes[1]
+	if r.Route != "/text" || r.Requests != 2 || r.Uncompressible != 0 || r.IdentityRequests != 1 || r.IdentityBytes != int64(len(text)) {
+		t.Fatalf("unexpected aggregates: %+v", r)
+	}
+
+	if want := float64(len(text)) / float64(len(gzipped(text))); r.Ratio() != want {
+		t.Fatalf("wrong ratio: got %v want %v", r.Ratio(), want)
+	}
+
+	tracker.Reset()
+	if routes := tracker.Routes(); len(routes) != 0 {
+		t.Fatalf("unexpected aggregates after Reset: %+v", routes)
+	}
+}
@@ -0,0 +1,84 @@
+package unpack
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// slowWindow is the number of recent decodes the slowest ones are
+	// picked from, see WithSlowDecodes.
+	slowWindow = 1024
+
+	// slowRecompute is how many decodes there are between updates of
+	// the duration above which decodes are among the slowest.
+	slowRecompute = 64
+)
+
+// slowDecodes picks out slow decodes, see WithSlowDecodes.
+type slowDecodes struct {
+	threshold time.Duration
+	percent   float64
+	f         func(*http.Request, DecodeStats)
+
+	mu     sync.Mutex
+	recent []time.Duration // Ring of the durations of recent decodes.
+	next   int             // Index in recent of the next duration.
+	seen   int             // Decodes since the cutoff was updated.
+	cutoff time.Duration   // Zero until there are enough decodes.
+}
+
+// done passes a body which a Handler passed on to f if it was slow, see
+// WithOnDone.
+func (s *slowDecodes) done(r *http.Request, stats Stats) {
+	s.observe(r, decodeStats(stats))
+}
+
+// rejected passes a request which a Handler rejected to f if decoding its
+// body was slow, see WithOnError.
+func (s *slowDecodes) rejected(r *http.Request, info ErrorInfo) {
+	s.observe(r, rejectedStats(info))
+}
+
+// observe passes ds to f if the decode it describes was slow.
+func (s *slowDecodes) observe(r *http.Request, ds DecodeStats) {
+	if s.threshold > 0 && ds.Duration >= s.threshold || s.slowest(ds.Duration) {
+		s.f(r, ds)
+	}
+}
+
+// slowest records d and reports whether it is among the given percentage
+// of the slowest recent decodes.
+func (s *slowDecodes) slowest(d time.Duration) bool {
+	if s.percent <= 0 {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.recent) < slowWindow {
+		s.recent = append(s.recent, d)
+	} else {
+		s.recent[s.next] = d
+		s.next = (s.next + 1) % slowWindow
+	}
+
+	// Until there are enough decodes to tell which are the slowest, none
+	// of them are.
+	if s.seen++; s.seen >= slowRecompute {
+		s.seen = 0
+		sorted := append([]time.Duration(nil), s.recent...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		i := int(float64(len(sorted)) * (1 - s.percent/100))
+		if i >= len(sorted) {
+			i = len(sorted) - 1
+		}
+
+		s.cutoff = sorted[i]
+	}
+
+	return s.cutoff > 0 && d >= s.cutoff
+}
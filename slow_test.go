@@ -0,0 +1,69 @@
+package unpack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSlowDecodes(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var slow []DecodeStats
+	handler := New(errorBodyWriter{}, WithSlowDecodes(time.Nanosecond, 0, func(r *http.Request, s DecodeStats) {
+		slow = append(slow, s)
+	}))
+
+	for _, tt := range []struct {
+		body     []byte
+		encoding string
+	}{
+		{body: buf, encoding: "gzip"},
+		{body: []byte("hello"), encoding: "gzip"},
+		{body: []byte("hello")},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		if tt.encoding != "" {
+			req.Header.Set("Content-Encoding", tt.encoding)
+		}
+
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if len(slow) != 2 || slow[0].DecodedBytes != 5 || slow[1].Err == nil {
+		t.Fatalf("unexpected slow decodes: %+v", slow)
+	}
+}
+
+func TestSlowestDecodes(t *testing.T) {
+	s := &slowDecodes{percent: 10}
+
+	// Durations of 1 to 100ms, of which the slowest 10% are those of
+	// about 91ms or more.
+	var n int
+	for i := 0; i < 10*slowWindow; i++ {
+		d := time.Duration(i%100+1) * time.Millisecond
+		slow := s.slowest(d)
+		if i < slowRecompute-1 && slow {
+			t.Fatalf("%v picked out before the cutoff was known", d)
+		}
+
+		if i >= slowWindow && (d < 85*time.Millisecond && slow || d == 100*time.Millisecond && !slow) {
+			t.Fatalf("%v: slowest returned %v", d, slow)
+		}
+
+		if slow {
+			n++
+		}
+	}
+
+	if pct := float64(n) / float64(10*slowWindow) * 100; pct < 9 || pct > 12 {
+		t.Fatalf("%.1f%% of decodes picked out as the slowest, want about 10%%", pct)
+	}
+}
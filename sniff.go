@@ -0,0 +1,159 @@
+package unpack
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// sniffLen is the number of bytes of a body which are looked at to tell
+// its coding.
+const sniffLen = 4
+
+// gzipMagic starts gzip data which is compressed with DEFLATE, which is
+// the only method there is.
+const gzipMagic = "\x1f\x8b\x08"
+
+// magics are the bytes which data in the codings that can be sniffed
+// starts with. zlib data, which is sniffed as deflate, has a header with
+// a check sum instead, see isZlibHeader.
+var magics = []struct {
+	coding string
+	magic  string
+}{
+	{coding: EncodingGzip, magic: gzipMagic},
+	{coding: EncodingZstd, magic: "\x28\xb5\x2f\xfd"},
+}
+
+// A MismatchMode tells a Handler what to do with bodies which start like
+// data in another coding than the one their Content-Encoding header says
+// was applied last.
+type MismatchMode int
+
+const (
+	// MismatchIgnore decodes bodies according to their header, which
+	// fails for bodies whose header is wrong. It is the default.
+	MismatchIgnore MismatchMode = iota
+
+	// MismatchReject fails requests whose body does not match their
+	// header with HTTP 400 and a message naming both codings.
+	MismatchReject
+
+	// MismatchCorrect decodes bodies according to the coding they look
+	// like instead of the one their header says was applied last, as long
+	// as the Handler decodes that coding. Otherwise they are rejected.
+	MismatchCorrect
+)
+
+var mismatchModes = []string{"ignore", "reject", "correct"}
+
+func (m MismatchMode) String() string {
+	if m >= 0 && int(m) < len(mismatchModes) {
+		return mismatchModes[m]
+	}
+
+	return fmt.Sprintf("MismatchMode(%d)", int(m))
+}
+
+// MarshalText writes m as its name, e.g. "reject" for MismatchReject.
+func (m MismatchMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText reads a MismatchMode written by MarshalText.
+func (m *MismatchMode) UnmarshalText(text []byte) error {
+	for i, name := range mismatchModes {
+		if strings.EqualFold(string(text), name) {
+			*m = MismatchMode(i)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unpack: unknown mismatch mode %q", text)
+}
+
+// mismatchError is returned for bodies which start like data in another
+// coding than the one their header says was applied last.
+type mismatchError struct {
+	detected string
+}
+
+func (e *mismatchError) Error() string {
+	return fmt.Sprintf("body looks %s-encoded", e.detected)
+}
+
+// sniffCoding returns the coding of the data in br as told by the bytes it
+// starts with, or "" if it does not look like data in any coding which
+// can be sniffed.
+func sniffCoding(br *bufio.Reader) string {
+	hdr, _ := br.Peek(sniffLen)
+	for _, m := range magics {
+		if strings.HasPrefix(string(hdr), m.magic) {
+			return m.coding
+		}
+	}
+
+	if isZlibHeader(hdr) {
+		return EncodingDeflate
+	}
+
+	return ""
+}
+
+// peekBody replaces the body of r by one which can be peeked at and still
+// yields all of the data of the original one, and returns it.
+func peekBody(r *http.Request) *bufio.Reader {
+	br := bufio.NewReader(r.Body)
+	r.Body = readCloser{Reader: br, Closer: r.Body}
+	return br
+}
+
+// sniffCodings returns the coding of the body of r as told by the bytes it
+// starts with, or nil if it does not look encoded or h does not decode
+// its coding.
+func (h *Handler) sniffCodings(r *http.Request) []string {
+	coding := sniffCoding(peekBody(r))
+	if coding == "" || !h.supports(coding) {
+		return nil
+	}
+
+	return []string{coding}
+}
+
+// sniffable reports whether data in coding starts with bytes which tell
+// its coding, so that a body declared to be in it can be told apart from
+// one in another coding. Data in other codings, such as br or
+// aws-chunked, may well start like gzip, zlib or zstd data by chance.
+func sniffable(coding string) bool {
+	switch coding {
+	case EncodingGzip, EncodingDeflate, EncodingZstd:
+		return true
+	}
+
+	return false
+}
+
+// checkMismatch compares the coding the body of r looks like with the last
+// of codings, which is the one its header says was applied last. Unless
+// they match, it returns a *DecompressionError or, if h corrects such
+// bodies, codings with the last one replaced. Bodies declared to be in a
+// coding which cannot be sniffed are never taken to mismatch.
+func (h *Handler) checkMismatch(r *http.Request, codings []string) ([]string, error) {
+	declared := codings[len(codings)-1]
+	if !sniffable(declared) {
+		return codings, nil
+	}
+
+	detected := sniffCoding(peekBody(r))
+	if detected == "" || detected == declared {
+		return codings, nil
+	}
+
+	if h.mismatch == MismatchCorrect && h.supports(detected) {
+		corrected := append([]string(nil), codings[:len(codings)-1]...)
+		return append(corrected, detected), nil
+	}
+
+	return nil, &DecompressionError{Encoding: declared, Err: &mismatchError{detected: detected}}
+}
@@ -0,0 +1,138 @@
+package unpack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSniffing(t *testing.T) {
+	for _, tt := range []struct {
+		file    string
+		header  []string
+		opts    []Option
+		decoded bool
+	}{
+		{file: "testdata/hello.txt.gz", decoded: true},
+		{file: "testdata/hello.txt.zz", decoded: true},
+		{file: "testdata/hello.txt.zst", decoded: true},
+		{file: "testdata/hello.txt", decoded: false},
+		{file: "testdata/hello.txt.br", decoded: false},
+		{file: "testdata/hello.txt.gz", header: []string{"identity"}, decoded: false},
+		{file: "testdata/hello.txt.gz", header: []string{""}, decoded: false},
+		{file: "testdata/hello.txt.gz", opts: []Option{WithAllowedEncodings(EncodingZstd)}, decoded: false},
+		{file: "testdata/hello.txt.gz", opts: []Option{WithSniffing(false)}, decoded: false},
+		{file: "testdata/hello.txt.gz.zz", header: []string{"gzip, deflate"}, decoded: true},
+	} {
+		buf, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		for _, v := range tt.header {
+			req.Header.Add("Content-Encoding", v)
+		}
+
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, append([]Option{WithSniffing(true)}, tt.opts...)...).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s %q: handler returned wrong status code: got %v want %v", tt.file, tt.header, rr.Code, http.StatusOK)
+		}
+
+		want := string(buf)
+		if tt.decoded {
+			want = "hello"
+		}
+
+		if rr.Body.String() != want {
+			t.Fatalf("%s %q: handler returned unexpected body: got %q want %q", tt.file, tt.header, rr.Body.String(), want)
+		}
+	}
+}
+
+func TestMismatchMode(t *testing.T) {
+	for _, tt := range []struct {
+		file     string
+		encoding string
+		mode     MismatchMode
+		opts     []Option
+		code     int
+		content  string
+	}{
+		{file: "testdata/hello.txt.zst", encoding: "gzip", mode: MismatchIgnore, code: http.StatusBadRequest, content: "Content-Encoding: gzip set but unable to decompress body"},
+		{file: "testdata/hello.txt.zst", encoding: "gzip", mode: MismatchReject, code: http.StatusBadRequest, content: "Content-Encoding: gzip set but body is zstd-encoded"},
+		{file: "testdata/hello.txt.zst", encoding: "gzip", mode: MismatchCorrect, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.gz", encoding: "zstd", mode: MismatchCorrect, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.zz", encoding: "gzip", mode: MismatchCorrect, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.gz", encoding: "gzip", mode: MismatchReject, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.br", encoding: "br", mode: MismatchReject, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.gz.zz", encoding: "gzip, deflate", mode: MismatchReject, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.gz.zz", encoding: "gzip, zstd", mode: MismatchCorrect, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.zst", encoding: "gzip", mode: MismatchCorrect, opts: []Option{WithAllowedEncodings(EncodingGzip)}, code: http.StatusBadRequest, content: "Content-Encoding: gzip set but body is zstd-encoded"},
+	} {
+		buf, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, append([]Option{WithMismatchMode(tt.mode)}, tt.opts...)...).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s as %s, mode %d: handler returned wrong status code: got %v want %v", tt.file, tt.encoding, tt.mode, rr.Code, tt.code)
+		}
+
+		if body := strings.TrimSuffix(rr.Body.String(), "\n"); body != tt.content {
+			t.Fatalf("%s as %s, mode %d: handler returned unexpected body: got %q want %q", tt.file, tt.encoding, tt.mode, body, tt.content)
+		}
+	}
+}
+
+func TestMismatchUnsniffable(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 0x8000)
+
+	// An aws-chunked body whose first chunk is 0x8000 bytes long starts
+	// with "80", which is a valid zlib header.
+	aws := []byte("8000;chunk-signature=0\r\n")
+	aws = append(aws, data...)
+	aws = append(aws, "\r\n0;chunk-signature=0\r\n\r\n"...)
+
+	// A br stream starting with 0x78 0x9c, the most common zlib header,
+	// made of a single uncompressed meta-block. Its length takes six
+	// nibbles, the first three of which come from those two bytes.
+	const n = 0x1009c7 + 1
+	brData := bytes.Repeat([]byte("b"), n)
+	br := append([]byte{0x78, 0x9c, 0x00, 0x11}, brData...)
+	br = append(br, 0x03)
+
+	for _, tt := range []struct {
+		body     []byte
+		encoding string
+		want     []byte
+	}{
+		{body: aws, encoding: "aws-chunked", want: data},
+		{body: br, encoding: "br", want: brData},
+	} {
+		for _, mode := range []MismatchMode{MismatchReject, MismatchCorrect} {
+			req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+			req.Header.Set("Content-Encoding", tt.encoding)
+			rr := httptest.NewRecorder()
+			New(requestBodyWriter{}, WithMismatchMode(mode)).ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%s, mode %s: handler returned wrong status code: got %v want %v (%q)", tt.encoding, mode, rr.Code, http.StatusOK, rr.Body.String())
+			}
+
+			if !bytes.Equal(rr.Body.Bytes(), tt.want) {
+				t.Fatalf("%s, mode %s: handler returned unexpected body of %d bytes", tt.encoding, mode, rr.Body.Len())
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package unpack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// errSpill is returned when a body cannot be written to a temporary file,
+// see WithSpillToDisk.
+var errSpill = errors.New("unpack: unable to spill request body to disk")
+
+// spillFile is a temporary file holding a decoded body. It is removed once
+// it is closed.
+type spillFile struct {
+	*os.File
+}
+
+// Close closes and removes the file. Errors are ignored, since they say
+// nothing about the body, which has been read already.
+func (f spillFile) Close() error {
+	f.File.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// spillWriter writes to a spillFile, wrapping any errors in errSpill so
+// that they can be told apart from errors reading the body.
+type spillWriter struct {
+	f spillFile
+}
+
+func (w spillWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", errSpill, err)
+	}
+
+	return n, err
+}
+
+// spill writes buf, followed by the rest of r, to a temporary file in the
+// spill directory of h. It returns the file and its size.
+func (h *Handler) spill(buf []byte, r io.Reader) (spillFile, int64, error) {
+	tmp, err := ioutil.TempFile(h.spillDir, "unpack-")
+	if err != nil {
+		return spillFile{}, 0, fmt.Errorf("%w: %v", errSpill, err)
+	}
+
+	f := spillFile{tmp}
+	w := spillWriter{f}
+	if _, err := w.Write(buf); err != nil {
+		f.Close()
+		return spillFile{}, 0, err
+	}
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		f.Close()
+		return spillFile{}, 0, err
+	}
+
+	return f, int64(len(buf)) + n, nil
+}
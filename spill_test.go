@@ -0,0 +1,91 @@
+package unpack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpillToDisk(t *testing.T) {
+	decoded := bytes.Repeat([]byte("0123456789abcdef"), 4<<10)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(decoded)
+	zw.Close()
+
+	for _, tt := range []struct {
+		threshold int64
+		max       int64
+		code      int
+		spilled   bool
+	}{
+		{threshold: 1 << 20, max: 1 << 20, code: http.StatusOK},
+		{threshold: 1 << 10, max: 1 << 20, code: http.StatusOK, spilled: true},
+		{threshold: 1 << 10, max: int64(len(decoded)), code: http.StatusOK, spilled: true},
+		{threshold: 1 << 10, max: int64(len(decoded)) - 1, code: http.StatusRequestEntityTooLarge},
+	} {
+		dir := t.TempDir()
+		var spilled bool
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			files, _ := filepath.Glob(filepath.Join(dir, "*"))
+			spilled = len(files) > 0
+			if r.ContentLength != int64(len(decoded)) {
+				t.Fatalf("threshold %d: got ContentLength %d, want %d", tt.threshold, r.ContentLength, len(decoded))
+			}
+
+			s, ok := r.Body.(io.Seeker)
+			if !ok {
+				t.Fatalf("threshold %d: body is not an io.Seeker", tt.threshold)
+			}
+
+			if _, err := s.Seek(-16, io.SeekEnd); err != nil {
+				t.Fatal(err)
+			}
+
+			if p, err := ioutil.ReadAll(r.Body); err != nil || string(p) != "0123456789abcdef" {
+				t.Fatalf("threshold %d: read %q, %v after seeking", tt.threshold, p, err)
+			}
+
+			body, err := r.GetBody()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if p, err := ioutil.ReadAll(body); err != nil || !bytes.Equal(p, decoded) {
+				t.Fatalf("threshold %d: GetBody returned %d bytes, %v", tt.threshold, len(p), err)
+			}
+		})
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewReader(buf.Bytes()))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		New(inner, WithBuffering(tt.max), WithSpillToDisk(tt.threshold, dir)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("threshold %d, max %d: handler returned wrong status code: got %v want %v", tt.threshold, tt.max, rr.Code, tt.code)
+		}
+
+		if spilled != tt.spilled {
+			t.Fatalf("threshold %d, max %d: spilled %v, want %v", tt.threshold, tt.max, spilled, tt.spilled)
+		}
+
+		if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) > 0 {
+			t.Fatalf("threshold %d, max %d: temporary files left behind: %q", tt.threshold, tt.max, files)
+		}
+	}
+
+	// Bodies which cannot be spilled fail with HTTP 503.
+	req := httptest.NewRequest("POST", "/test", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	New(requestBodyWriter{}, WithBuffering(1<<20), WithSpillToDisk(1<<10, filepath.Join(t.TempDir(), "missing"))).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+}
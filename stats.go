@@ -0,0 +1,115 @@
+package unpack
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Stats describes how the body of a request was unpacked. They are kept up
+// to date while the body is being read, so they are only complete once the
+// handler has read the whole body.
+type Stats struct {
+	// Encoding lists the content codings the body was decoded from, in
+	// the order they were applied, e.g. "gzip" or "gzip, deflate".
+	Encoding string
+
+	// DoubleGzip is true if the body was gzipped once more than its
+	// header says, which the Handler made up for, see WithDoubleGzip.
+	DoubleGzip bool
+
+	// TrailingData is true if data was found after the end of the
+	// encoded data of the body, see WithRejectTrailingData. It is only
+	// checked for gzip, deflate, deflate-raw and zstd bodies.
+	TrailingData bool
+
+	// Raw is true if the body could not be decoded and was passed on as
+	// it was sent instead, see WithFailOpen. Err says why.
+	Raw bool
+
+	// DecodedBytes is the number of decoded bytes read from the body.
+	DecodedBytes int64
+
+	// EncodedBytes is the number of bytes of the body as sent by the
+	// client which have been read to decode it. Decoders read ahead, so
+	// it may be larger than what was needed for the decoded bytes read.
+	EncodedBytes int64
+
+	// DecodeDuration is the time spent decoding the body. It only
+	// counts time spent creating the decoders and reading from them, not
+	// time spent by the handler in between reads.
+	DecodeDuration time.Duration
+
+	// Err is the first error encountered while reading or closing the
+	// body, such as a *DecompressionError for corrupt data. A body which
+	// was not read to the end may be corrupt even if Err is nil.
+	Err error
+}
+
+// statsKey is the context key under which the Stats of a request are kept.
+type statsKey struct{}
+
+// StatsFromContext returns the Stats of the request with the given
+// context, as passed on to the next handler. The boolean is false if the
+// Handler did not decode the request body, or try to, see WithFailOpen.
+func StatsFromContext(ctx context.Context) (Stats, bool) {
+	s, ok := ctx.Value(statsKey{}).(*Stats)
+	if !ok {
+		return Stats{}, false
+	}
+
+	return *s, true
+}
+
+// DecodeStats describes what decoding the body of a request took, for
+// billing and accounting, see WithOnDecode.
+type DecodeStats struct {
+	// Encoding lists the content codings of the body, e.g. "gzip". For
+	// requests rejected because of their Content-Encoding header, it is
+	// the header as sent.
+	Encoding string
+
+	// EncodedBytes is the number of bytes of the body as sent by the
+	// client which were read to decode it.
+	EncodedBytes int64
+
+	// DecodedBytes is the number of decoded bytes produced.
+	DecodedBytes int64
+
+	// Duration is the time spent decoding the body.
+	Duration time.Duration
+
+	// LimitExceeded is true if the body exceeded a size or ratio limit,
+	// see ErrLimitExceeded, whether or not the request was rejected for
+	// it.
+	LimitExceeded bool
+
+	// Err is the first error encountered while decoding the body, or the
+	// reason the request was rejected, if any.
+	Err error
+}
+
+// decodeStats returns the DecodeStats of a body which a Handler passed on.
+func decodeStats(s Stats) DecodeStats {
+	return DecodeStats{
+		Encoding:      s.Encoding,
+		EncodedBytes:  s.EncodedBytes,
+		DecodedBytes:  s.DecodedBytes,
+		Duration:      s.DecodeDuration,
+		LimitExceeded: errors.Is(s.Err, ErrLimitExceeded),
+		Err:           s.Err,
+	}
+}
+
+// rejectedStats returns the DecodeStats of a request which a Handler
+// rejected.
+func rejectedStats(info ErrorInfo) DecodeStats {
+	return DecodeStats{
+		Encoding:      info.Encoding,
+		EncodedBytes:  info.EncodedBytes,
+		DecodedBytes:  info.DecodedBytes,
+		Duration:      info.Duration,
+		LimitExceeded: errors.Is(info.Err, ErrLimitExceeded),
+		Err:           info.Err,
+	}
+}
@@ -0,0 +1,96 @@
+package unpack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatsFromContext(t *testing.T) {
+	for _, ft := range []fileTest{
+		{file: "testdata/hello.txt.gz.zz", encoding: "gzip, deflate"},
+		{file: "testdata/hello.txt", encoding: "identity"},
+	} {
+		buf, err := ioutil.ReadFile(ft.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var stats Stats
+		var ok bool
+		handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+			stats, ok = StatsFromContext(r.Context())
+		}))
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", ft.encoding)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if decoded := ft.encoding != "identity"; ok != decoded {
+			t.Fatalf("%s: StatsFromContext returned ok %v", ft.encoding, ok)
+		}
+
+		if !ok {
+			if stats != (Stats{}) {
+				t.Fatalf("%s: got non-zero stats %+v", ft.encoding, stats)
+			}
+
+			continue
+		}
+
+		if stats.Encoding != ft.encoding || stats.DecodedBytes != 5 || stats.EncodedBytes != int64(len(buf)) || stats.DecodeDuration <= 0 {
+			t.Fatalf("%s: got unexpected stats %+v", ft.encoding, stats)
+		}
+	}
+}
+
+func TestOnDecode(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		body     []byte
+		encoding string
+		limit    int64
+		code     int
+		decoded  int64
+		exceeded bool
+		err      bool
+	}{
+		{body: buf, encoding: "gzip", code: http.StatusOK, decoded: 5},
+		{body: buf, encoding: "gzip", limit: 4, code: http.StatusRequestEntityTooLarge, decoded: 4, exceeded: true, err: true},
+		{body: []byte("hello"), encoding: "gzip", code: http.StatusBadRequest, err: true},
+		{body: buf, encoding: "gzip, made-up", code: http.StatusUnsupportedMediaType, err: true},
+	} {
+		var got []DecodeStats
+		opts := []Option{WithOnDecode(func(s DecodeStats) {
+			got = append(got, s)
+		})}
+		if tt.limit > 0 {
+			opts = append(opts, WithMaxDecodedBytes(tt.limit))
+		}
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		New(errorBodyWriter{}, opts...).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.encoding, rr.Code, tt.code)
+		}
+
+		if len(got) != 1 {
+			t.Fatalf("%s: got %d calls want 1", tt.encoding, len(got))
+		}
+
+		s := got[0]
+		if s.Encoding != tt.encoding || s.DecodedBytes != tt.decoded || s.LimitExceeded != tt.exceeded || (s.Err != nil) != tt.err {
+			t.Fatalf("%s: got unexpected stats %+v", tt.encoding, s)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package unpack
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrTrailingData is returned when reading from an unpacked request body
+// whose encoded data is followed by more data, if the Handler rejects such
+// bodies, see WithRejectTrailingData.
+var ErrTrailingData = errors.New("unpack: data after the end of the encoded body")
+
+// trailingData handles data after the end of the encoded data in the body
+// of req, which it records in the Stats of req. It returns the error with
+// which reading the decoded data ends, which is io.EOF unless h rejects
+// such bodies.
+func (h *Handler) trailingData(req *http.Request) error {
+	if s, ok := req.Context().Value(statsKey{}).(*Stats); ok {
+		s.TrailingData = true
+	}
+
+	if h.rejectTrailing {
+		return ErrTrailingData
+	}
+
+	return io.EOF
+}
+
+// trailingReader reads from a decoder which reads no further than the end
+// of the encoded data in r, and checks whether more data follows once the
+// decoder is done.
+type trailingReader struct {
+	io.ReadCloser
+	r        *bufio.Reader
+	trailing func() error
+}
+
+func (t *trailingReader) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+
+	if _, err := t.r.Peek(1); err != nil {
+		if err != io.EOF {
+			return n, err
+		}
+
+		return n, io.EOF
+	}
+
+	return n, t.trailing()
+}
+
+// zstdTrailingReader reads from a zstd decoder, which reads ahead and goes
+// on to the next frame after each one, failing with zstd.ErrMagicMismatch
+// if what follows a frame does not start like one. Bodies whose first
+// frame does not start like one are rejected when the decoder is created,
+// so such errors are caused by data after the last frame. Less than four
+// bytes of data after it cannot be told apart from a truncated frame.
+type zstdTrailingReader struct {
+	io.ReadCloser
+	trailing func() error
+}
+
+func (t *zstdTrailingReader) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if errors.Is(err, zstd.ErrMagicMismatch) {
+		err = t.trailing()
+	}
+
+	return n, err
+}
@@ -0,0 +1,72 @@
+package unpack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTrailingData(t *testing.T) {
+	for _, tt := range []struct {
+		file     string
+		encoding string
+		trailer  string
+		reject   bool
+		code     int
+		content  string
+		trailing bool
+	}{
+		{file: "testdata/hello.txt.gz", encoding: "gzip", trailer: "", reject: true, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.gz", encoding: "gzip", trailer: "garbage", reject: false, code: http.StatusOK, content: "hello", trailing: true},
+		{file: "testdata/hello.txt.gz", encoding: "gzip", trailer: "garbage", reject: true, code: http.StatusBadRequest, content: "Request body has data after the end of the encoded data", trailing: true},
+		{file: "testdata/hello.txt.gz", encoding: "gzip", trailer: "\x1f\x8bgarbage", reject: false, code: http.StatusBadRequest, content: "Content-Encoding: gzip set but unable to decompress body"},
+		{file: "testdata/hello.txt.zz", encoding: "deflate", trailer: "", reject: true, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.zz", encoding: "deflate", trailer: "garbage", reject: false, code: http.StatusOK, content: "hello", trailing: true},
+		{file: "testdata/hello.txt.zz", encoding: "deflate", trailer: "garbage", reject: true, code: http.StatusBadRequest, content: "Request body has data after the end of the encoded data", trailing: true},
+		{file: "testdata/hello.txt.deflate", encoding: "deflate", trailer: "garbage", reject: true, code: http.StatusBadRequest, content: "Request body has data after the end of the encoded data", trailing: true},
+		{file: "testdata/hello.txt.deflate", encoding: "deflate-raw", trailer: "", reject: true, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.deflate", encoding: "deflate-raw", trailer: "garbage", reject: false, code: http.StatusOK, content: "hello", trailing: true},
+		{file: "testdata/hello.txt.deflate", encoding: "deflate-raw", trailer: "garbage", reject: true, code: http.StatusBadRequest, content: "Request body has data after the end of the encoded data", trailing: true},
+		{file: "testdata/hello.txt.zst", encoding: "zstd", trailer: "", reject: true, code: http.StatusOK, content: "hello"},
+		{file: "testdata/hello.txt.zst", encoding: "zstd", trailer: "garbage", reject: false, code: http.StatusOK, content: "hello", trailing: true},
+		{file: "testdata/hello.txt.zst", encoding: "zstd", trailer: "garbage", reject: true, code: http.StatusBadRequest, content: "Request body has data after the end of the encoded data", trailing: true},
+	} {
+		buf, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The handler leaves it to the Handler to respond to errors found
+		// while reading the body.
+		var stats Stats
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			stats, _ = StatsFromContext(r.Context())
+			if err == nil {
+				w.Write(body)
+			}
+		})
+
+		rr := httptest.NewRecorder()
+		handler := New(inner, WithRejectTrailingData(tt.reject), WithVerifyChecksum(true))
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(append(buf, tt.trailer...)))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s with %q, reject %v: handler returned wrong status code: got %v want %v", tt.encoding, tt.trailer, tt.reject, rr.Code, tt.code)
+		}
+
+		if body := strings.TrimSuffix(rr.Body.String(), "\n"); body != tt.content {
+			t.Fatalf("%s with %q, reject %v: handler returned unexpected body: got '%v' want '%v'", tt.encoding, tt.trailer, tt.reject, body, tt.content)
+		}
+
+		if stats.TrailingData != tt.trailing {
+			t.Fatalf("%s with %q, reject %v: got TrailingData %v", tt.encoding, tt.trailer, tt.reject, stats.TrailingData)
+		}
+	}
+}
@@ -1,49 +1,723 @@
 package unpack
 
 import (
-	"compress/gzip"
-	"compress/zlib"
+	"bufio"
+	"context"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// Handler is an http.Handler which unpacks the body of each request
+// before passing the request on to the next handler. Use New to create one.
+//
+// Handlers may safely be stacked, e.g. with different options for
+// different routes: once a body has been decoded any further Handlers pass
+// the request on untouched.
+type Handler struct {
+	next            http.Handler
+	skipper         func(*http.Request) bool
+	methods         map[string]bool
+	pathMatchers    []func(path string) bool
+	setVary         bool
+	maxDecodedBytes int64
+	codingLimits    map[string]int64
+	maxEncodedBytes int64
+	maxRatio        float64
+	onRatio         func(*http.Request, Stats)
+	decodeTimeout   time.Duration
+	decodeTypes     map[string]bool
+	skipTypes       map[string]bool
+	fallbacks       []string
+	allowed         map[string]bool
+	denied          map[string]bool
+	errorHandler    func(http.ResponseWriter, *http.Request, error)
+	onError         []func(*http.Request, ErrorInfo)
+	onDone          []func(*http.Request, Stats)
+	retryAfter      time.Duration
+	captureBytes    int
+	capture         func(*http.Request, error, string)
+	statuses        map[ErrorClass]int
+	problemDetails  bool
+	encodingsDoc    bool
+	renderType      string
+	render          func(io.Writer, int, string, error)
+	headerMode      HeaderMode
+	bufferMax       int64
+	spillThreshold  int64
+	spillDir        string
+	lazy            bool
+	validateOnly    bool
+	failOpen        bool
+	warnUnknown     bool
+	onUnknown       func(*http.Request, string)
+	limitHeader     string
+	trusted         func(*http.Request) bool
+	limitResolver   func(*http.Request) Limits
+	verifyChecksum  bool
+
+	decodedSizeHeader string
+	serverTiming      bool
+	debugHeaders      bool
+	debugCounters     bool
+	vars              *expvar.Map // Live counters, see WithDebugCounters.
+	pprofLabels       bool
+	pprofRoute        func(*http.Request) string
+	ratios            *RatioTracker
+	breaker           *breaker
+	tee               func(*http.Request) io.Writer
+	sink              func(*http.Request) chan<- []byte
+	sinkChunk         int
+	strictDeflate     bool
+	zlibDict          []byte
+	inflight          *budget
+	snappyBlockMax    int64
+	rawBodyWrapper    func(io.ReadCloser) io.ReadCloser
+	xzDictMax         int64
+	noCompress        bool
+	aesgcmKeys        func(keyID string) ([]byte, error)
+	dictionaries      DictionaryStore
+	dcbDecode         BrotliDictionaryDecoder
+	zstdDicts         map[string][]byte
+	zstdDictHeader    string
+	base64            bool
+	gzipMaxMembers    int
+	maxCodings        int
+	strictHeader      bool
+	sniff             bool
+	mismatch          MismatchMode
+	doubleGzip        bool
+	rejectTrailing    bool
+	extraCodecs       map[string]Codec
+	codecs            map[string]Codec // By coding, built by New.
+}
+
+// New returns a Handler which unpacks request bodies before passing the
+// requests on to next, configured by the given options.
+func New(next http.Handler, opts ...Option) *Handler {
+	h := &Handler{next: next, maxCodings: defaultMaxCodings}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	h.codecs = h.newCodecs()
+
+	if h.debugCounters {
+		h.vars = new(expvar.Map).Init()
+		counters := countersIn(h.vars)
+		h.onDone = append(h.onDone, counters.done)
+		h.onError = append(h.onError, counters.rejected)
+	}
+
+	// The breaker is hooked up here rather than by its option, so that
+	// only the last WithDecodeBreaker counts.
+	if h.breaker != nil {
+		h.onDone = append(h.onDone, h.breaker.done)
+		h.onError = append(h.onError, h.breaker.rejected)
+	}
+
+	// Fallbacks without a codec would never be tried.
+	fallbacks := h.fallbacks[:0]
+	for _, coding := range h.fallbacks {
+		if _, ok := h.codecs[coding]; ok {
+			fallbacks = append(fallbacks, coding)
+		}
+	}
+
+	h.fallbacks = fallbacks
+	return h
+}
+
 // Middleware which handles unpacking of requests. It supports unpacking
-// Content-Encoding: gzip and Content-Encoding: deflate. Other encodings
-// are ignored and passed on to the next handler.
+// Content-Encoding: gzip, deflate, deflate-raw, br, zstd, lz4, snappy,
+// bzip2, compress and aws-chunked, as well as any combination of them
+// listed in the order they were applied, e.g. Content-Encoding: gzip,
+// deflate. Other encodings are ignored and passed on to the next handler,
+// unless a Codec for them was registered with RegisterCodec. Combinations
+// of supported and other encodings fail with HTTP 415.
 // If the client specifies a supported Content-Encoding but this function
 // fails to parse the body as such, it will fail the request with
-// HTTP 415 and a text/plain error.
+// HTTP 400 and a text/plain error. Decoded bodies are passed on with an
+// unknown length: the ContentLength of the request is set to -1 and its
+// Content-Length header is removed, unless the body is buffered, see
+// WithBuffering.
 func Middleware(next http.Handler) http.Handler {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		var err error
+	return New(next)
+}
+
+// NewMiddleware returns a middleware which behaves like Middleware
+// configured by the given options. It is handy for routers which accept
+// middleware as a func(http.Handler) http.Handler.
+func NewMiddleware(opts ...Option) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return New(next, opts...)
+	}
+}
+
+// ServeHTTP unpacks the body of r and passes it on to the next handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The connections of upgrade requests, such as WebSocket handshakes,
+	// are hijacked, so their bodies are none of our business.
+	if h.skipper != nil && h.skipper(r) || !h.matches(r) || isUpgrade(r) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	// The body was decoded by another Handler, which may have left the
+	// header as it was, see WithHeaderMode.
+	if _, ok := StatsFromContext(r.Context()); ok {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	// A list split across several header lines is the same as one line
+	// with the values joined by commas (RFC 9110 section 5.3).
+	header := strings.Join(r.Header.Values("Content-Encoding"), ",")
+	if h.strictHeader {
+		if _, err := ParseCodings(header); err != nil {
+			h.fail(w, r, err)
+			return
+		}
+	}
 
-		rc := r.Body
-		switch encoding := strings.ToLower(r.Header.Get("Content-Encoding")); encoding {
-		case "gzip":
-			rc, err = gzip.NewReader(r.Body)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Content-Encoding: %s set but unable to decompress body", encoding), http.StatusUnsupportedMediaType)
+	codings := parseCodings(header)
+	if _, ok := r.Header["Content-Encoding"]; !ok && h.sniff {
+		codings = h.sniffCodings(r)
+	}
+
+	if len(codings) == 0 {
+		// The body is not encoded even though the header is set, e.g. to
+		// identity or to nothing but whitespace. Set it to what it means.
+		if _, ok := r.Header["Content-Encoding"]; ok {
+			if h.strictHeader && strings.Trim(header, " \t,") == "" {
+				h.fail(w, r, errEmptyHeader)
+				return
+			}
+
+			h.rewriteHeader(r)
+		}
+
+		if h.ratios != nil && r.Body != nil && r.Body != http.NoBody {
+			h.ratios.identity(r)
+		}
+
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	if h.maxCodings > 0 && len(codings) > h.maxCodings {
+		h.fail(w, r, &DecompressionError{Encoding: strings.Join(codings, ", "), Err: errTooManyCodings})
+		return
+	}
+
+	if coding, ok := h.partlySupported(codings); ok {
+		h.fail(w, r, &DecompressionError{Encoding: coding, Err: errUnsupportedCoding})
+		return
+	}
+
+	for _, coding := range codings {
+		if !h.supports(coding) {
+			if _, ok := h.codecs[coding]; ok && h.strictHeader {
+				h.fail(w, r, &DecompressionError{Encoding: coding, Err: errDisallowedCoding})
 				return
 			}
 
-			r.Header.Set("Content-Encoding", "identity")
+			if h.warnUnknown {
+				w.Header().Add("Warning", fmt.Sprintf("299 - \"Content-Encoding: %s was not decoded\"", coding))
+				if h.onUnknown != nil {
+					h.onUnknown(r, coding)
+				}
+			}
+
+			h.next.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	if mt := mediaType(r); h.decodeTypes != nil && !h.decodeTypes[mt] || h.skipTypes[mt] {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	if h.breaker != nil {
+		if err := h.breaker.allow(r); err != nil {
+			h.fail(w, r, err)
+			return
+		}
+	}
+
+	// Nothing above reads the body, so clients which wait for a 100
+	// Continue response before sending it (RFC 9110 section 10.1.1) are
+	// spared sending bodies which are rejected anyway. Neither are bodies
+	// which are declared to be too large.
+	if h.maxEncodedBytes > 0 && r.ContentLength > h.maxEncodedBytes {
+		h.fail(w, r, &limitError{limit: h.maxEncodedBytes})
+		return
+	}
+
+	if h.mismatch != MismatchIgnore {
+		var err error
+		if codings, err = h.checkMismatch(r, codings); err != nil {
+			h.fail(w, r, err)
+			return
+		}
+	}
+
+	raw := r.Body
+	if h.rawBodyWrapper != nil {
+		raw = h.rawBodyWrapper(raw)
+	}
+
+	var src io.Reader = raw
+	if h.maxEncodedBytes > 0 {
+		src = &limitedReader{r: raw, max: h.maxEncodedBytes}
+	}
+
+	// Reads from the connection fail once the deadline has passed, unless
+	// w does not support deadlines, in which case the body can only fail
+	// once a read returns.
+	limits := h.requestLimits(r)
+	var deadline time.Time
+	var rc *http.ResponseController
+	if timeout := limits.decodeTimeout(h.decodeTimeout); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+		rc = http.NewResponseController(w)
+		if rc.SetReadDeadline(deadline) != nil {
+			rc = nil
+		}
+	}
+
+	b := &body{deadline: deadline, limits: limits}
+	if rc != nil {
+		b.clearDeadline = func() { rc.SetReadDeadline(time.Time{}) }
+	}
+
+	if h.pprofLabels {
+		labels := []string{"unpack.encoding", strings.Join(codings, ", ")}
+		if h.pprofRoute != nil {
+			if route := h.pprofRoute(r); route != "" {
+				labels = append(labels, "unpack.route", route)
+			}
+		}
+
+		b.ctx = r.Context()
+		b.labels = pprof.WithLabels(b.ctx, pprof.Labels(labels...))
+	}
+
+	// The wrapper may hold resources of its own, so it has to be closed
+	// along with the decoders.
+	if raw != r.Body {
+		b.closers = append(b.closers, raw)
+	}
+
+	if h.capture != nil {
+		src = h.capturePrefix(r, b, src)
+	}
+
+	var encoded *captureWriter
+	if h.validateOnly {
+		encoded = &captureWriter{h: h}
+		src = io.TeeReader(src, encoded)
+		b.closers = append(b.closers, encoded)
+	}
+
+	// Bodies which fail open are passed on as sent, including what the
+	// decoders read before they failed.
+	lazy := h.lazy && !h.validateOnly
+	var rec *recordingReader
+	if h.failOpen && !lazy {
+		rec = &recordingReader{r: src}
+		src = rec
+	}
+
+	own := len(b.closers)
+	open := func() error {
+		if len(h.fallbacks) > 0 {
+			return h.openFallbackBody(b, r, codings, src)
+		}
+
+		return h.openBody(b, r, codings, src)
+	}
+
+	if lazy {
+		b.stats.Encoding = strings.Join(codings, ", ")
+		b.open = open
+	} else if err := b.labeled(open); err != nil {
+		if b.timedOut() {
+			err = ErrDecodeTimeout
+		}
+
+		b.setErr(err)
+		if rec != nil && ClassifyError(err) == ClassMalformed {
+			h.serveRaw(w, r, b, own, rec, err)
+			return
+		}
+
+		b.Close()
+		h.fail(w, r.WithContext(context.WithValue(r.Context(), statsKey{}, &b.stats)), err)
+		return
+	}
+
+	if rec != nil {
+		rec.stop()
+	}
+
+	if h.validateOnly {
+		h.serveValidated(w, r, b, src, encoded)
+		return
+	}
+
+	if h.setVary {
+		w.Header().Add("Vary", "Content-Encoding")
+	}
+
+	ctx := context.WithValue(r.Context(), statsKey{}, &b.stats)
+	r = r.WithContext(context.WithValue(ctx, decodingKey{}, &decoding{h: h, b: b}))
+	h.rewriteHeader(r)
+	r.Body = b
+	if h.tee != nil {
+		b.tee = h.tee(r)
+	}
+
+	// The decoded size is not known until the body has been read, and the
+	// encoded size would mislead handlers which trust it.
+	r.ContentLength = -1
+	r.Header.Del("Content-Length")
+
+	if h.bufferMax > 0 {
+		sr, err := h.buffer(b, h.bufferMax)
+		if err != nil {
+			b.Close()
+			h.fail(w, r, err)
+			return
+		}
+
+		r.ContentLength = sr.Size()
+		r.Header.Set("Content-Length", strconv.FormatInt(sr.Size(), 10))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(io.NewSectionReader(sr, 0, sr.Size())), nil
+		}
+
+		r.Body = &seekableBody{body: b, s: sr}
+	}
+
+	if h.sink != nil {
+		if ch := h.sink(r); ch != nil {
+			if err := b.pump(r.Context(), ch, h.sinkChunk); err != nil {
+				b.Close()
+				if r.Context().Err() == nil {
+					h.fail(w, r, err)
+				}
 
-		case "deflate":
-			rc, err = zlib.NewReader(r.Body)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Content-Encoding: %s set but unable to decompress body", encoding), http.StatusUnsupportedMediaType)
 				return
 			}
 
-			r.Header.Set("Content-Encoding", "identity")
+			r.Body = http.NoBody
+			r.ContentLength = 0
 		}
+	}
+
+	var rw *responseWriter
+	if h.verifyChecksum || h.decodedSizeHeader != "" || h.serverTiming || h.debugHeaders {
+		rw = &responseWriter{ResponseWriter: w}
+		rw.beforeHeader = func() {
+			if h.decodedSizeHeader != "" && b.eof {
+				w.Header().Set(h.decodedSizeHeader, strconv.FormatInt(b.stats.DecodedBytes, 10))
+			}
+
+			if h.serverTiming {
+				addServerTiming(w.Header(), b.stats)
+			}
+
+			if h.debugHeaders {
+				setDebugHeaders(w.Header(), b.stats)
+			}
+		}
+
+		h.next.ServeHTTP(rw.wrapped(), r)
+	} else {
+		h.next.ServeHTTP(w, r)
+	}
 
-		r.Body = rc
-		next.ServeHTTP(w, r)
+	// Handlers such as JSON decoders often stop reading before the end of
+	// the body, which is where checksums are. If the handler has not sent
+	// a response yet we can still fail the request for a corrupt body.
+	if h.verifyChecksum {
+		if err := b.drain(); err != nil && !errors.Is(err, ErrLimitExceeded) && !rw.wroteHeader {
+			b.rejected = true
+			h.fail(w, r, err)
+		}
+	}
+
+	b.Close() // Make sure we close the gzip or zlib readers.
+	h.done(r, b)
+}
+
+// done passes the final Stats of b, the body of r, to the hooks set with
+// WithOnDone, unless the request was rejected after all.
+func (h *Handler) done(r *http.Request, b *body) {
+	if b.rejected {
+		return
+	}
+
+	for _, f := range h.onDone {
+		f(r, b.stats)
+	}
+}
+
+// isUpgrade reports whether r asks to upgrade its connection to another
+// protocol (RFC 9110 section 7.8).
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+
+	for _, v := range r.Header.Values("Connection") {
+		for _, option := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(option), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// rewriteHeader updates the Content-Encoding header of r, whose body is
+// not encoded, according to the header mode of h.
+func (h *Handler) rewriteHeader(r *http.Request) {
+	switch h.headerMode {
+	case HeaderIdentity:
+		r.Header.Set("Content-Encoding", EncodingIdentity)
+	case HeaderDelete:
+		r.Header.Del("Content-Encoding")
+	}
+}
+
+// matches reports whether the method and path of r are among those h
+// decodes the bodies of.
+func (h *Handler) matches(r *http.Request) bool {
+	if h.methods != nil && !h.methods[r.Method] {
+		return false
+	}
+
+	if h.pathMatchers == nil {
+		return true
+	}
+
+	for _, match := range h.pathMatchers {
+		if match(r.URL.Path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// supports reports whether h decodes bodies in the given content coding.
+func (h *Handler) supports(coding string) bool {
+	if _, ok := h.codecs[coding]; !ok {
+		return false
+	}
+
+	return (h.allowed == nil || h.allowed[coding]) && !h.denied[coding]
+}
+
+// supportedCodings returns the content codings h decodes bodies in, sorted
+// by name.
+func (h *Handler) supportedCodings() []string {
+	var codings []string
+	for coding := range h.codecs {
+		if h.supports(coding) {
+			codings = append(codings, coding)
+		}
+	}
+
+	sort.Strings(codings)
+	return codings
+}
+
+// partlySupported returns the first of codings which h has no codec for,
+// if it has one for any of the others. Such chains cannot be decoded, but
+// passing them on would hand the next handler a body which it is unlikely
+// to decode either, unlike a body in a single unknown coding.
+func (h *Handler) partlySupported(codings []string) (string, bool) {
+	unsupported, known := "", false
+	for _, coding := range codings {
+		if _, ok := h.codecs[coding]; ok {
+			known = true
+		} else if unsupported == "" {
+			unsupported = coding
+		}
+	}
+
+	return unsupported, known && unsupported != ""
+}
+
+// openBody sets up b to decode src according to codings. If it fails, the
+// decoders it set up are left for b to close. Decoders which panic fail
+// with errDecoderPanic, so that crafted bodies cannot take the request down.
+func (h *Handler) openBody(b *body, req *http.Request, codings []string, src io.Reader) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &DecompressionError{Encoding: strings.Join(codings, ", "), Err: fmt.Errorf("%w: %v", errDecoderPanic, v)}
+		}
+	}()
+
+	start := time.Now()
+	encoded := &countingReader{r: src}
+	b.r, b.encoded = encoded, encoded
+	b.stats.Encoding = strings.Join(codings, ", ")
+
+	// Decoders read headers when they are created, which is part of the
+	// work of decoding the body even if it turns out to be corrupt.
+	defer func() {
+		b.stats.DecodeDuration += time.Since(start)
+		b.stats.EncodedBytes = encoded.n
+	}()
+
+	// Decoders record what they find out about the body in its Stats.
+	req = req.WithContext(context.WithValue(req.Context(), statsKey{}, &b.stats))
+
+	// The last coding applied has to be undone first.
+	for i := len(codings) - 1; i >= 0; i-- {
+		dec, err := h.codecs[codings[i]].NewReader(req, b.r)
+		if err != nil {
+			return &DecompressionError{Encoding: codings[i], Err: err}
+		}
+
+		b.closers = append(b.closers, dec)
+		b.r = dec
+	}
+
+	if h.doubleGzip && codings[0] == EncodingGzip {
+		if err := h.peelGzip(req, b); err != nil {
+			return &DecompressionError{Encoding: EncodingGzip, Err: err}
+		}
+	}
+
+	if max := b.limits.maxDecodedBytes(h.decodedLimit(codings)); max > 0 {
+		b.r = &limitedReader{r: b.r, max: max}
+	}
+
+	if ratio := b.limits.maxRatio(h.maxRatio); ratio > 0 {
+		rr := &ratioReader{r: b.r, encoded: encoded, max: ratio}
+		if h.onRatio != nil && !b.trial {
+			rr.exceeded = func() {
+				stats := b.stats
+				stats.EncodedBytes, stats.DecodedBytes = encoded.n, rr.n
+				h.onRatio(req, stats)
+			}
+		}
+
+		b.r = rr
+	}
+
+	return nil
+}
+
+// requestLimits returns the limits set for r, see WithLimitResolver and
+// WithLimitOverride.
+func (h *Handler) requestLimits(r *http.Request) Limits {
+	var limits Limits
+	if h.limitResolver != nil {
+		limits = h.limitResolver(r)
+	}
+
+	if n, ok := h.limitOverride(r); ok {
+		if n <= 0 {
+			n = -1
+		}
+
+		limits.MaxDecodedBytes = n
+	}
+
+	return limits
+}
+
+// limitOverride returns the cap on the decoded size of the body of r set
+// by the limit header, if r is trusted to set one, see WithLimitOverride.
+// It removes the header from r either way.
+func (h *Handler) limitOverride(r *http.Request) (int64, bool) {
+	if h.limitHeader == "" {
+		return 0, false
+	}
+
+	v := r.Header.Get(h.limitHeader)
+	if v == "" {
+		return 0, false
+	}
+
+	trusted := h.trusted != nil && h.trusted(r)
+	r.Header.Del(h.limitHeader)
+	if !trusted {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// decodedLimit returns the cap on the size of bodies decoded according to
+// codings, which is the smallest of the caps for each of them, or zero if
+// there is none.
+func (h *Handler) decodedLimit(codings []string) int64 {
+	var limit int64
+	for _, coding := range codings {
+		max, ok := h.codingLimits[coding]
+		if !ok {
+			max = h.maxDecodedBytes
+		}
+
+		if max > 0 && (limit == 0 || max < limit) {
+			limit = max
+		}
+	}
+
+	return limit
+}
+
+// peelGzip adds another gzip decoder to b if the data it decodes still
+// starts like gzip data, as sent by clients which gzip their bodies twice.
+func (h *Handler) peelGzip(req *http.Request, b *body) error {
+	br := bufio.NewReader(b.r)
+	b.r = br
+	if hdr, _ := br.Peek(len(gzipMagic)); string(hdr) != gzipMagic {
+		return nil
+	}
+
+	dec, err := h.codecs[EncodingGzip].NewReader(req, br)
+	if err != nil {
+		return err
+	}
+
+	b.closers = append(b.closers, dec)
+	b.r = dec
+	b.stats.Encoding = EncodingGzip + ", " + b.stats.Encoding
+	b.stats.DoubleGzip = true
+	return nil
+}
 
-		rc.Close() // Make sure we close the gzip or zlib reader.
+// mediaType returns the lowercased media type of the body of r, without
+// any parameters, or "" if it has no valid Content-Type.
+func mediaType(r *http.Request) string {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
 	}
 
-	return http.HandlerFunc(fn)
+	return mt
 }
@@ -2,9 +2,13 @@ package unpack
 
 import (
 	"bytes"
+	"compress/gzip"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -19,9 +23,42 @@ type fileTest struct {
 var fileTests = []fileTest{
 	{file: "testdata/hello.txt", encoding: "identity", code: http.StatusOK, content: "hello"},
 	{file: "testdata/hello.txt.gz", encoding: "gzip", code: http.StatusOK, content: "hello"},
-	{file: "testdata/hello.txt", encoding: "gzip", code: http.StatusUnsupportedMediaType, content: "Content-Encoding: gzip set but unable to decompress body"},
+	{file: "testdata/hello.txt", encoding: "gzip", code: http.StatusBadRequest, content: "Content-Encoding: gzip set but unable to decompress body"},
 	{file: "testdata/hello.txt.zz", encoding: "deflate", code: http.StatusOK, content: "hello"},
-	{file: "testdata/hello.txt", encoding: "deflate", code: http.StatusUnsupportedMediaType, content: "Content-Encoding: deflate set but unable to decompress body"},
+	{file: "testdata/hello.txt", encoding: "deflate", code: http.StatusBadRequest, content: "Content-Encoding: deflate set but unable to decompress body"},
+	{file: "testdata/hello.txt.br", encoding: "br", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt", encoding: "br", code: http.StatusBadRequest, content: "Content-Encoding: br set but unable to decompress body"},
+	{file: "testdata/hello.txt.lz4", encoding: "lz4", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt", encoding: "lz4", code: http.StatusBadRequest, content: "Content-Encoding: lz4 set but unable to decompress body"},
+	{file: "testdata/hello.txt.sz", encoding: "snappy", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt", encoding: "snappy", code: http.StatusBadRequest, content: "Content-Encoding: snappy set but unable to decompress body"},
+	{file: "testdata/hello.txt.bz2", encoding: "bzip2", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt", encoding: "bzip2", code: http.StatusBadRequest, content: "Content-Encoding: bzip2 set but unable to decompress body"},
+	{file: "testdata/hello.txt.deflate", encoding: "deflate-raw", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt.zz", encoding: "deflate-raw", code: http.StatusBadRequest, content: "Content-Encoding: deflate-raw set but unable to decompress body"},
+	{file: "testdata/hello.txt.zst", encoding: "zstd", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt", encoding: "zstd", code: http.StatusBadRequest, content: "Content-Encoding: zstd set but unable to decompress body"},
+	{file: "testdata/hello.txt.Z", encoding: "compress", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt.aws", encoding: "aws-chunked", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt", encoding: "aws-chunked", code: http.StatusBadRequest, content: "Content-Encoding: aws-chunked set but unable to decompress body"},
+	{file: "testdata/hello.txt.Z", encoding: "x-compress", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt", encoding: "compress", code: http.StatusBadRequest, content: "Content-Encoding: compress set but unable to decompress body"},
+	{file: "testdata/hello.txt.gz", encoding: "GZip", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt.gz", encoding: "\tgzip", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt.gz", encoding: "x-gzip", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt.gz.zz", encoding: "gzip, deflate", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt.gz.zz", encoding: "Gzip, DEFLATE", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt.gz.zz", encoding: "x-gzip, deflate", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt.gz.zz", encoding: "X-GZIP,Deflate", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt.gz", encoding: "identity, gzip", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt.gz", encoding: "gzip, identity", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt.gz.zz", encoding: "gzip, Identity, deflate", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt", encoding: "identity, identity", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt.zz", encoding: "gzip, deflate", code: http.StatusBadRequest, content: "Content-Encoding: gzip set but unable to decompress body"},
+	{file: "testdata/hello.txt", encoding: "unknown", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt", encoding: "unknown, other", code: http.StatusOK, content: "hello"},
+	{file: "testdata/hello.txt.gz", encoding: "gzip, unknown", code: http.StatusUnsupportedMediaType, content: "Content-Encoding: unknown is not supported"},
+	{file: "testdata/hello.txt.gz", encoding: "unknown, gzip", code: http.StatusUnsupportedMediaType, content: "Content-Encoding: unknown is not supported"},
 }
 
 type requestBodyWriter struct{}
@@ -75,3 +112,452 @@ func TestUnpack(t *testing.T) {
 		}
 	}
 }
+
+func TestStackedMiddleware(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats Stats
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBodyWriter{}.ServeHTTP(w, r)
+		stats, _ = StatsFromContext(r.Context())
+	})
+
+	req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+	req.Header.Set("Content-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	Middleware(Middleware(inner)).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	if rr.Body.String() != "hello" {
+		t.Fatalf("handler returned unexpected body: got '%v' want 'hello'", rr.Body.String())
+	}
+
+	if stats.Encoding != "gzip" || stats.DecodedBytes != 5 {
+		t.Fatalf("got unexpected stats %+v", stats)
+	}
+}
+
+func TestMultipleHeaderLines(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz.zz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var encoding []string
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBodyWriter{}.ServeHTTP(w, r)
+		encoding = r.Header.Values("Content-Encoding")
+	})
+
+	req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+	req.Header.Add("Content-Encoding", "gzip")
+	req.Header.Add("Content-Encoding", "deflate")
+	rr := httptest.NewRecorder()
+	Middleware(inner).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	if rr.Body.String() != "hello" {
+		t.Fatalf("handler returned unexpected body: got '%v' want 'hello'", rr.Body.String())
+	}
+
+	if len(encoding) != 1 || encoding[0] != EncodingIdentity {
+		t.Fatalf("got Content-Encoding %q, want identity", encoding)
+	}
+}
+
+func TestHeaderMode(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		mode     HeaderMode
+		header   string
+		encoding []string
+	}{
+		{mode: HeaderIdentity, header: "x-gzip", encoding: []string{"identity"}},
+		{mode: HeaderKeep, header: "x-gzip", encoding: []string{"x-gzip"}},
+		{mode: HeaderDelete, header: "x-gzip", encoding: nil},
+		{mode: HeaderKeep, header: "identity, x-gzip", encoding: []string{"identity, x-gzip"}},
+	} {
+		var encoding []string
+		var stats Stats
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestBodyWriter{}.ServeHTTP(w, r)
+			encoding = r.Header.Values("Content-Encoding")
+			stats, _ = StatsFromContext(r.Context())
+		})
+
+		// Stacked Handlers must not decode the body twice, whatever the
+		// header says.
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", tt.header)
+		rr := httptest.NewRecorder()
+		New(New(inner), WithHeaderMode(tt.mode)).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK || rr.Body.String() != "hello" {
+			t.Fatalf("%v: handler returned %v '%v', want 200 'hello'", tt.mode, rr.Code, rr.Body.String())
+		}
+
+		if !reflect.DeepEqual(encoding, tt.encoding) {
+			t.Fatalf("%v: got Content-Encoding %q, want %q", tt.mode, encoding, tt.encoding)
+		}
+
+		if stats.Encoding != "gzip" || stats.EncodedBytes != int64(len(buf)) || stats.Err != nil {
+			t.Fatalf("%v: unexpected stats %+v", tt.mode, stats)
+		}
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		encoding string
+		length   int64
+		header   string
+	}{
+		{encoding: "gzip", length: -1, header: ""},
+		{encoding: "identity", length: int64(len(buf)), header: strconv.Itoa(len(buf))},
+		{encoding: "unknown", length: int64(len(buf)), header: strconv.Itoa(len(buf))},
+	} {
+		var length int64
+		var header string
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			length, header = r.ContentLength, r.Header.Get("Content-Length")
+		})
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		req.Header.Set("Content-Length", strconv.Itoa(len(buf)))
+		Middleware(inner).ServeHTTP(httptest.NewRecorder(), req)
+
+		if length != tt.length || header != tt.header {
+			t.Fatalf("%s: got ContentLength %d and header %q, want %d and %q", tt.encoding, length, header, tt.length, tt.header)
+		}
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		connection []string
+		upgrade    string
+		decoded    bool
+	}{
+		{connection: nil, upgrade: "", decoded: true},
+		{connection: []string{"Upgrade"}, upgrade: "websocket", decoded: false},
+		{connection: []string{"keep-alive, upgrade"}, upgrade: "h2c", decoded: false},
+		{connection: []string{"keep-alive", "Upgrade"}, upgrade: "websocket", decoded: false},
+		{connection: []string{"Upgrade"}, upgrade: "", decoded: true},
+		{connection: []string{"keep-alive"}, upgrade: "websocket", decoded: true},
+	} {
+		var body []byte
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = ioutil.ReadAll(r.Body)
+		})
+
+		req := httptest.NewRequest("GET", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", "gzip")
+		for _, v := range tt.connection {
+			req.Header.Add("Connection", v)
+		}
+
+		if tt.upgrade != "" {
+			req.Header.Set("Upgrade", tt.upgrade)
+		}
+
+		Middleware(inner).ServeHTTP(httptest.NewRecorder(), req)
+
+		if decoded := string(body) == "hello"; decoded != tt.decoded || !decoded && !bytes.Equal(body, buf) {
+			t.Fatalf("%q, %q: got body %q, want decoded %v", tt.connection, tt.upgrade, body, tt.decoded)
+		}
+	}
+}
+
+// unreadBody fails the test if it is read.
+type unreadBody struct {
+	t *testing.T
+}
+
+func (b unreadBody) Read(p []byte) (int, error) {
+	b.t.Fatal("body was read")
+	return 0, nil
+}
+
+func TestExpectContinue(t *testing.T) {
+	for _, tt := range []struct {
+		encoding string
+		length   int64
+		opts     []Option
+		code     int
+	}{
+		{encoding: "gzip", length: 1 << 20, opts: []Option{WithMaxEncodedBytes(1 << 10)}, code: http.StatusRequestEntityTooLarge},
+		{encoding: "gzip, unknown", length: 1 << 20, code: http.StatusUnsupportedMediaType},
+		{encoding: "gzip, gzip, gzip, gzip", length: 1 << 20, code: http.StatusUnsupportedMediaType},
+		{encoding: "deflate", length: 1 << 20, opts: []Option{WithDeniedEncodings(EncodingDeflate), WithStrictContentEncoding(true)}, code: http.StatusUnsupportedMediaType},
+		{encoding: "gzip;q=1", length: 1 << 20, opts: []Option{WithStrictContentEncoding(true)}, code: http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest("POST", "/test", unreadBody{t})
+		req.ContentLength = tt.length
+		req.Header.Set("Expect", "100-continue")
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		New(http.NotFoundHandler(), tt.opts...).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.encoding, rr.Code, tt.code)
+		}
+	}
+}
+
+func TestHeaderSyntax(t *testing.T) {
+	for _, tt := range []struct {
+		header   []string
+		strict   bool
+		code     int
+		encoding []string
+	}{
+		{header: nil, code: http.StatusOK, encoding: nil},
+		{header: []string{"identity"}, code: http.StatusOK, encoding: []string{"identity"}},
+		{header: []string{"Identity, identity"}, code: http.StatusOK, encoding: []string{"identity"}},
+		{header: []string{""}, code: http.StatusOK, encoding: []string{"identity"}},
+		{header: []string{" \t, "}, code: http.StatusOK, encoding: []string{"identity"}},
+		{header: []string{"identity", ""}, code: http.StatusOK, encoding: []string{"identity"}},
+		{header: nil, strict: true, code: http.StatusOK, encoding: nil},
+		{header: []string{"identity"}, strict: true, code: http.StatusOK, encoding: []string{"identity"}},
+		{header: []string{""}, strict: true, code: http.StatusBadRequest},
+		{header: []string{" \t, "}, strict: true, code: http.StatusBadRequest},
+		{header: []string{"", ""}, strict: true, code: http.StatusBadRequest},
+		{header: []string{"\xef\xbb\xbfidentity"}, code: http.StatusOK, encoding: []string{"identity"}},
+		{header: []string{"\xef\xbb\xbfidentity"}, strict: true, code: http.StatusBadRequest},
+		{header: []string{"g zip"}, code: http.StatusOK, encoding: []string{"g zip"}},
+		{header: []string{"g zip"}, strict: true, code: http.StatusBadRequest},
+		{header: []string{"identity", "gzip\x00"}, strict: true, code: http.StatusBadRequest},
+	} {
+		var encoding []string
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestBodyWriter{}.ServeHTTP(w, r)
+			encoding = r.Header.Values("Content-Encoding")
+		})
+
+		req := httptest.NewRequest("POST", "/test", strings.NewReader("hello"))
+		for _, v := range tt.header {
+			req.Header.Add("Content-Encoding", v)
+		}
+
+		rr := httptest.NewRecorder()
+		encoding = nil
+		New(inner, WithStrictContentEncoding(tt.strict)).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%q, strict %v: handler returned wrong status code: got %v want %v", tt.header, tt.strict, rr.Code, tt.code)
+		}
+
+		if !reflect.DeepEqual(encoding, tt.encoding) {
+			t.Fatalf("%q, strict %v: got Content-Encoding %q, want %q", tt.header, tt.strict, encoding, tt.encoding)
+		}
+	}
+}
+
+func TestAcceptEncoding(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		encoding string
+		opts     []Option
+		code     int
+		accept   string
+	}{
+		{encoding: "gzip", code: http.StatusOK},
+		{encoding: "gzip, unknown", opts: []Option{WithAllowedEncodings(EncodingGzip, EncodingZstd)}, code: http.StatusUnsupportedMediaType, accept: "gzip, zstd"},
+		{encoding: "gzip, gzip", opts: []Option{WithAllowedEncodings(EncodingGzip), WithMaxCodings(1)}, code: http.StatusUnsupportedMediaType, accept: "gzip"},
+		{encoding: "deflate", opts: []Option{WithAllowedEncodings(EncodingGzip, EncodingDeflate), WithDeniedEncodings(EncodingDeflate), WithStrictContentEncoding(true)}, code: http.StatusUnsupportedMediaType, accept: "gzip"},
+		{encoding: "gzip", opts: []Option{WithMaxDecodedBytes(1), WithVerifyChecksum(true)}, code: http.StatusInternalServerError},
+		{encoding: "deflate", opts: []Option{WithAllowedEncodings(EncodingGzip, EncodingDeflate)}, code: http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		New(requestBodyWriter{}, tt.opts...).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.encoding, rr.Code, tt.code)
+		}
+
+		if accept := rr.Header().Get("Accept-Encoding"); accept != tt.accept {
+			t.Fatalf("%s: handler returned wrong Accept-Encoding: got %q want %q", tt.encoding, accept, tt.accept)
+		}
+	}
+}
+
+// errorBodyWriter is like requestBodyWriter, but responds to errors with
+// Error where it can.
+type errorBodyWriter struct{}
+
+func (ebw errorBodyWriter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if Error(w, r, err) {
+		return
+	}
+
+	if err != nil {
+		http.Error(w, "unable to read r.Body", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(body)
+}
+
+func TestError(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		body     []byte
+		encoding string
+		opts     []Option
+		code     int
+		close    bool
+	}{
+		{name: "ok", body: buf, encoding: "gzip", code: http.StatusOK},
+		{name: "identity", body: buf, encoding: "identity", code: http.StatusOK},
+		{name: "too large", body: buf, encoding: "gzip", opts: []Option{WithMaxDecodedBytes(1)}, code: http.StatusRequestEntityTooLarge, close: true},
+		{name: "truncated", body: buf[:len(buf)-4], encoding: "gzip", code: http.StatusBadRequest},
+		{name: "status mapping", body: buf, encoding: "gzip", opts: []Option{WithMaxDecodedBytes(1), WithStatusMapping(map[ErrorClass]int{ClassTooLarge: http.StatusUnprocessableEntity})}, code: http.StatusUnprocessableEntity, close: true},
+		{name: "fail open", body: buf[:len(buf)-4], encoding: "gzip", opts: []Option{WithFailOpen(true)}, code: http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rr := httptest.NewRecorder()
+		New(errorBodyWriter{}, tt.opts...).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.code)
+		}
+
+		if close := rr.Header().Get("Connection") == "close"; close != tt.close {
+			t.Fatalf("%s: handler returned wrong Connection header: got %q", tt.name, rr.Header().Get("Connection"))
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/test", nil)
+	if Error(httptest.NewRecorder(), req, ErrLimitExceeded) {
+		t.Fatal("Error handled an error of a request not decoded by a Handler")
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sentinels := []error{ErrUnsupportedEncoding, ErrMalformedBody, ErrLimitExceeded, ErrDecodeTimeout}
+	for _, tt := range []struct {
+		name     string
+		body     []byte
+		encoding string
+		opts     []Option
+		want     error
+	}{
+		{name: "corrupt", body: []byte("hello"), encoding: "gzip", want: ErrMalformedBody},
+		{name: "truncated", body: buf[:len(buf)-4], encoding: "gzip", want: ErrMalformedBody},
+		{name: "trailing data", body: append(append([]byte{}, buf...), "junk"...), encoding: "gzip", opts: []Option{WithRejectTrailingData(true)}, want: ErrMalformedBody},
+		{name: "unsupported", body: buf, encoding: "gzip, unknown", want: ErrUnsupportedEncoding},
+		{name: "too many codings", body: buf, encoding: "gzip, gzip", opts: []Option{WithMaxCodings(1)}, want: ErrUnsupportedEncoding},
+		{name: "disallowed", body: buf, encoding: "gzip", opts: []Option{WithDeniedEncodings(EncodingGzip), WithStrictContentEncoding(true)}, want: ErrUnsupportedEncoding},
+		{name: "too large", body: buf, encoding: "gzip", opts: []Option{WithMaxDecodedBytes(1)}, want: ErrLimitExceeded},
+	} {
+		var gotErr error
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, gotErr = ioutil.ReadAll(r.Body)
+		})
+
+		opts := append([]Option{WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+			gotErr = err
+		})}, tt.opts...)
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		New(inner, opts...).ServeHTTP(httptest.NewRecorder(), req)
+
+		for _, sentinel := range sentinels {
+			if is := errors.Is(gotErr, sentinel); is != (sentinel == tt.want) {
+				t.Fatalf("%s: errors.Is(%v, %v) = %v", tt.name, gotErr, sentinel, is)
+			}
+		}
+	}
+}
+
+func TestDoubleGzip(t *testing.T) {
+	once, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(once)
+	zw.Close()
+	twice := buf.Bytes()
+
+	for _, tt := range []struct {
+		name     string
+		body     []byte
+		enabled  bool
+		content  string
+		double   bool
+		encoding string
+	}{
+		{name: "twice", body: twice, enabled: true, content: "hello", double: true, encoding: "gzip, gzip"},
+		{name: "once", body: once, enabled: true, content: "hello", encoding: "gzip"},
+		{name: "twice, disabled", body: twice, enabled: false, content: string(once), encoding: "gzip"},
+	} {
+		var stats Stats
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestBodyWriter{}.ServeHTTP(w, r)
+			stats, _ = StatsFromContext(r.Context())
+		})
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		New(inner, WithDoubleGzip(tt.enabled)).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, http.StatusOK)
+		}
+
+		if rr.Body.String() != tt.content {
+			t.Fatalf("%s: handler returned unexpected body: got %q want %q", tt.name, rr.Body.String(), tt.content)
+		}
+
+		if stats.DoubleGzip != tt.double || stats.Encoding != tt.encoding {
+			t.Fatalf("%s: got unexpected stats %+v", tt.name, stats)
+		}
+	}
+}
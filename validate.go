@@ -0,0 +1,56 @@
+package unpack
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// captureWriter keeps what is written to it in memory, reserving it from
+// the in-flight budget of h until it is closed.
+type captureWriter struct {
+	h   *Handler
+	buf []byte
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	if !c.h.inflight.reserve(int64(len(p))) {
+		return 0, errOverloaded
+	}
+
+	c.buf = append(c.buf, p...)
+	return len(p), nil
+}
+
+// Close releases the memory kept by c.
+func (c *captureWriter) Close() error {
+	c.h.inflight.release(int64(len(c.buf)))
+	c.buf = nil
+	return nil
+}
+
+// serveValidated decodes all of b, whose encoded data is read from src and
+// kept by encoded, and passes r on with the encoded data as its body, or
+// fails the request if the body cannot be decoded, see WithValidateOnly.
+func (h *Handler) serveValidated(w http.ResponseWriter, r *http.Request, b *body, src io.Reader, encoded *captureWriter) {
+	defer b.Close()
+
+	_, err := io.Copy(ioutil.Discard, b)
+	if err == nil {
+		// Decoders need not read the encoded data to its end, e.g. if it
+		// has trailing data, but the next handler gets all of it.
+		_, err = io.Copy(ioutil.Discard, src)
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), statsKey{}, &b.stats))
+	if err != nil {
+		h.fail(w, r, err)
+		return
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(encoded.buf))
+	h.next.ServeHTTP(w, r)
+	h.done(r, b)
+}
@@ -0,0 +1,60 @@
+package unpack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateOnly(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trailing := append(append([]byte{}, buf...), "garbage"...)
+	for _, tt := range []struct {
+		name string
+		body []byte
+		opts []Option
+		code int
+	}{
+		{name: "valid", body: buf, code: http.StatusOK},
+		{name: "trailing data", body: trailing, code: http.StatusOK},
+		{name: "truncated", body: buf[:len(buf)-4], code: http.StatusBadRequest},
+		{name: "too large", body: buf, opts: []Option{WithMaxDecodedBytes(4)}, code: http.StatusRequestEntityTooLarge},
+		{name: "overloaded", body: buf, opts: []Option{WithMaxInflightBytes(8)}, code: http.StatusServiceUnavailable},
+	} {
+		var got []byte
+		var stats Stats
+		var encoding string
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = ioutil.ReadAll(r.Body)
+			stats, _ = StatsFromContext(r.Context())
+			encoding = r.Header.Get("Content-Encoding")
+		})
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(tt.body))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		New(inner, append(tt.opts, WithValidateOnly(true))...).ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.code)
+		}
+
+		if tt.code != http.StatusOK {
+			continue
+		}
+
+		if !bytes.Equal(got, tt.body) || encoding != "gzip" {
+			t.Fatalf("%s: got %q with Content-Encoding %q, want the body as sent", tt.name, got, encoding)
+		}
+
+		if stats.DecodedBytes != 5 || stats.EncodedBytes == 0 {
+			t.Fatalf("%s: unexpected stats %+v", tt.name, stats)
+		}
+	}
+}
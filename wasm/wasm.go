@@ -0,0 +1,170 @@
+// Package wasm adapts decoders compiled to WebAssembly to unpack.Codec, so
+// that gateways can load decoders, e.g. for tenant-specific content
+// codings, at run time. Modules are run with wazero. Each body is decoded
+// by a fresh instance of the module, with capped memory, so bodies cannot
+// affect each other.
+//
+// A module has to export its memory as well as two functions:
+//
+//	alloc(size i32) -> i32
+//	decode(ptr i32, size i32) -> i64
+//
+// alloc returns the address of size bytes of memory, which the encoded
+// body is copied to. decode decodes the body at that address and returns
+// the address of the decoded data in the upper 32 bits of its result and
+// its size in the lower 32 bits, or a negative number if the body cannot
+// be decoded. Modules may import WASI, and an exported _initialize
+// function is called once each instance is created.
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/njern/unpack"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// ErrDecode is returned for bodies which a module fails to decode.
+var ErrDecode = errors.New("wasm: module failed to decode body")
+
+var (
+	errABI    = errors.New("wasm: module does not export memory, alloc and decode")
+	errMemory = errors.New("wasm: module returned an address out of bounds")
+)
+
+// Codec is an unpack.Codec which decodes bodies with a WebAssembly module.
+type Codec struct {
+	rt       wazero.Runtime
+	module   wazero.CompiledModule
+	maxInput int64
+}
+
+// An Option configures a Codec created by New.
+type Option func(*config)
+
+type config struct {
+	memoryPages uint32
+	maxInput    int64
+}
+
+// WithMemoryLimitPages caps the memory of each instance of the module at
+// the given number of 64KB pages. The default is 256 pages, i.e. 16MB.
+func WithMemoryLimitPages(pages uint32) Option {
+	return func(c *config) {
+		c.memoryPages = pages
+	}
+}
+
+// WithMaxInputBytes caps the size of the encoded bodies the module is
+// given at n bytes, since bodies are copied to the memory of the module as
+// a whole. Larger bodies fail with unpack.ErrLimitExceeded. The default is
+// 8MB.
+func WithMaxInputBytes(n int64) Option {
+	return func(c *config) {
+		c.maxInput = n
+	}
+}
+
+// New compiles the WebAssembly module in binary and returns a Codec which
+// decodes bodies with it. Close the Codec once it is no longer used.
+func New(ctx context.Context, binary []byte, opts ...Option) (*Codec, error) {
+	cfg := config{memoryPages: 256, maxInput: 8 << 20}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	// Closing instances once the context of their request is done stops
+	// modules which take too long.
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(cfg.memoryPages).
+		WithCloseOnContextDone(true))
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, rt); err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+
+	module, err := rt.CompileModule(ctx, binary)
+	if err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+
+	return &Codec{rt: rt, module: module, maxInput: cfg.maxInput}, nil
+}
+
+// NewReader decodes body, the body of r, with a new instance of the module.
+// The body is decoded as a whole before NewReader returns.
+func (c *Codec) NewReader(r *http.Request, body io.Reader) (io.ReadCloser, error) {
+	in, err := ioutil.ReadAll(io.LimitReader(body, c.maxInput+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(in)) > c.maxInput {
+		return nil, unpack.ErrLimitExceeded
+	}
+
+	ctx := r.Context()
+	mod, err := c.rt.InstantiateModule(ctx, c.module, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, err
+	}
+	defer mod.Close(ctx)
+
+	out, err := decode(ctx, mod, in)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(out)), nil
+}
+
+// decode decodes in with mod according to the ABI described in the package
+// documentation and returns a copy of the decoded data.
+func decode(ctx context.Context, mod api.Module, in []byte) ([]byte, error) {
+	alloc, dec, mem := mod.ExportedFunction("alloc"), mod.ExportedFunction("decode"), mod.Memory()
+	if alloc == nil || dec == nil || mem == nil {
+		return nil, errABI
+	}
+
+	res, err := alloc.Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, err
+	}
+
+	ptr := uint32(res[0])
+	if !mem.Write(ptr, in) {
+		return nil, errMemory
+	}
+
+	res, err = dec.Call(ctx, uint64(ptr), uint64(len(in)))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(res[0]) < 0 {
+		return nil, ErrDecode
+	}
+
+	out, ok := mem.Read(uint32(res[0]>>32), uint32(res[0]))
+	if !ok {
+		return nil, errMemory
+	}
+
+	return append([]byte(nil), out...), nil
+}
+
+// Close releases the compiled module and the runtime it runs in.
+func (c *Codec) Close(ctx context.Context) error {
+	return c.rt.Close(ctx)
+}
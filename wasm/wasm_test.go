@@ -0,0 +1,67 @@
+package wasm
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/njern/unpack"
+)
+
+// identityModule is a module which passes bodies on as they are, unless
+// they start with an exclamation mark, which it fails to decode. Its alloc
+// always returns address 1024.
+var identityModule = []byte("\x00\x61\x73\x6d\x01\x00\x00\x00\x01\x0c\x02\x60\x01\x7f\x01\x7f\x60\x02\x7f\x7f\x01\x7e\x03\x03\x02\x00\x01\x05\x03\x01\x00\x01\x07\x1b\x03\x06\x6d\x65\x6d\x6f\x72\x79\x02\x00\x05\x61\x6c\x6c\x6f\x63\x00\x00\x06\x64\x65\x63\x6f\x64\x65\x00\x01\x0a\x22\x02\x05\x00\x41\x80\x08\x0b\x1a\x00\x20\x00\x2d\x00\x00\x41\x21\x46\x04\x7e\x42\x7f\x05\x20\x00\xad\x42\x20\x86\x20\x01\xad\x84\x0b\x0b")
+
+// echo writes the body of each request back to the client.
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	var buf strings.Builder
+	if _, err := io.Copy(&buf, r.Body); err != nil {
+		http.Error(w, "unable to read r.Body", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte(buf.String()))
+})
+
+func TestCodec(t *testing.T) {
+	ctx := context.Background()
+	codec, err := New(ctx, identityModule, WithMaxInputBytes(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer codec.Close(ctx)
+
+	h := unpack.New(echo, unpack.WithCodec("x-tenant", codec))
+	for _, tt := range []struct {
+		body    string
+		code    int
+		content string
+	}{
+		{body: "hello", code: http.StatusOK, content: "hello"},
+		{body: "!hello", code: http.StatusBadRequest, content: "Content-Encoding: x-tenant set but unable to decompress body"},
+		{body: strings.Repeat("a", 17), code: http.StatusRequestEntityTooLarge, content: "Request body too large"},
+	} {
+		req := httptest.NewRequest("POST", "/test", strings.NewReader(tt.body))
+		req.Header.Set("Content-Encoding", "x-tenant")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != tt.code {
+			t.Fatalf("%q: handler returned wrong status code: got %v want %v", tt.body, rr.Code, tt.code)
+		}
+
+		if body := strings.TrimSuffix(rr.Body.String(), "\n"); body != tt.content {
+			t.Fatalf("%q: handler returned unexpected body: got '%v' want '%v'", tt.body, body, tt.content)
+		}
+	}
+}
+
+func TestCodecInvalidModule(t *testing.T) {
+	if _, err := New(context.Background(), []byte("not wasm")); err == nil {
+		t.Fatal("expected an error for an invalid module")
+	}
+}
@@ -0,0 +1,158 @@
+package unpack
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// responseWriter wraps the http.ResponseWriter passed on to the next
+// handler to keep track of whether it has started writing a response.
+type responseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+
+	// beforeHeader, if not nil, is called right before the header of
+	// the response is written, while it can still be changed.
+	beforeHeader func()
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	w.writingHeader()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.writingHeader()
+	return w.ResponseWriter.Write(p)
+}
+
+// wrapped returns w as an http.ResponseWriter which also implements those
+// of http.Flusher, http.Hijacker and io.ReaderFrom that the wrapped writer
+// does, and no others, so that handlers which check for them are told the
+// truth.
+func (w *responseWriter) wrapped() http.ResponseWriter {
+	_, canFlush := w.ResponseWriter.(http.Flusher)
+	_, canHijack := w.ResponseWriter.(http.Hijacker)
+	_, canReadFrom := w.ResponseWriter.(io.ReaderFrom)
+
+	f, h, r := flusher{w}, hijacker{w}, readerFrom{w}
+	switch {
+	case canFlush && canHijack && canReadFrom:
+		return struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{w, f, h, r}
+	case canFlush && canHijack:
+		return struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+		}{w, f, h}
+	case canFlush && canReadFrom:
+		return struct {
+			*responseWriter
+			http.Flusher
+			io.ReaderFrom
+		}{w, f, r}
+	case canHijack && canReadFrom:
+		return struct {
+			*responseWriter
+			http.Hijacker
+			io.ReaderFrom
+		}{w, h, r}
+	case canFlush:
+		return struct {
+			*responseWriter
+			http.Flusher
+		}{w, f}
+	case canHijack:
+		return struct {
+			*responseWriter
+			http.Hijacker
+		}{w, h}
+	case canReadFrom:
+		return struct {
+			*responseWriter
+			io.ReaderFrom
+		}{w, r}
+	}
+
+	return w
+}
+
+// flusher implements http.Flusher for a responseWriter whose wrapped
+// writer does.
+type flusher struct{ w *responseWriter }
+
+func (f flusher) Flush() {
+	f.w.writingHeader()
+	f.w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// hijacker implements http.Hijacker for a responseWriter whose wrapped
+// writer does. Once the connection is taken over, no response may be
+// written, so it counts as written.
+type hijacker struct{ w *responseWriter }
+
+func (h hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := h.w.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		h.w.wroteHeader = true
+	}
+
+	return conn, rw, err
+}
+
+// readerFrom implements io.ReaderFrom for a responseWriter whose wrapped
+// writer does, which lets it send files without copying them.
+type readerFrom struct{ w *responseWriter }
+
+func (r readerFrom) ReadFrom(src io.Reader) (int64, error) {
+	r.w.writingHeader()
+	return r.w.ResponseWriter.(io.ReaderFrom).ReadFrom(src)
+}
+
+// writingHeader is called whenever the header may be about to be written.
+func (w *responseWriter) writingHeader() {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+	if w.beforeHeader != nil {
+		w.beforeHeader()
+	}
+}
+
+// Unwrap returns the wrapped writer, for use by http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// addServerTiming adds a Server-Timing metric named unpack with the decode
+// duration and encoding of s to header, unless it has one already.
+func addServerTiming(header http.Header, s Stats) {
+	for _, v := range header.Values("Server-Timing") {
+		if strings.HasPrefix(v, "unpack;") {
+			return
+		}
+	}
+
+	ms := strconv.FormatFloat(float64(s.DecodeDuration)/1e6, 'f', 3, 64)
+	desc := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s.Encoding)
+	header.Add("Server-Timing", "unpack;dur="+ms+`;desc="`+desc+`"`)
+}
+
+// setDebugHeaders sets headers describing the body of a request, as
+// described by s, in header, see WithDebugHeaders.
+func setDebugHeaders(header http.Header, s Stats) {
+	header.Set("X-Unpack-Encoding", s.Encoding)
+	header.Set("X-Unpack-Compressed-Bytes", strconv.FormatInt(s.EncodedBytes, 10))
+	header.Set("X-Unpack-Decoded-Bytes", strconv.FormatInt(s.DecodedBytes, 10))
+}
@@ -0,0 +1,95 @@
+package unpack
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// plainWriter is an http.ResponseWriter which implements no optional
+// interfaces.
+type plainWriter struct {
+	rec *httptest.ResponseRecorder
+}
+
+func (w plainWriter) Header() http.Header         { return w.rec.Header() }
+func (w plainWriter) Write(p []byte) (int, error) { return w.rec.Write(p) }
+func (w plainWriter) WriteHeader(code int)        { w.rec.WriteHeader(code) }
+
+// fullWriter is a plainWriter which implements http.Flusher, http.Hijacker
+// and io.ReaderFrom.
+type fullWriter struct {
+	plainWriter
+	flushedHeader http.Header // The header as it was when flushed.
+}
+
+func (w *fullWriter) Flush() {
+	w.flushedHeader = w.rec.Header().Clone()
+	w.rec.Flush()
+}
+
+func (w *fullWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("not supported")
+}
+
+func (w *fullWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(w.rec, r)
+}
+
+func TestResponseWriterInterfaces(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		w        http.ResponseWriter
+		flush    bool
+		hijack   bool
+		readFrom bool
+	}{
+		{name: "plain", w: plainWriter{rec: httptest.NewRecorder()}},
+		{name: "recorder", w: httptest.NewRecorder(), flush: true},
+		{name: "full", w: &fullWriter{plainWriter: plainWriter{rec: httptest.NewRecorder()}}, flush: true, hijack: true, readFrom: true},
+	} {
+		handler := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			f, flush := w.(http.Flusher)
+			_, hijack := w.(http.Hijacker)
+			rf, readFrom := w.(io.ReaderFrom)
+			if flush != tt.flush || hijack != tt.hijack || readFrom != tt.readFrom {
+				t.Fatalf("%s: got Flusher %v, Hijacker %v, ReaderFrom %v, want %v, %v, %v", tt.name, flush, hijack, readFrom, tt.flush, tt.hijack, tt.readFrom)
+			}
+
+			if readFrom {
+				rf.ReadFrom(strings.NewReader("hello"))
+			}
+
+			if flush {
+				f.Flush()
+			}
+		}), WithServerTiming(true))
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer(buf))
+		req.Header.Set("Content-Encoding", "gzip")
+		handler.ServeHTTP(tt.w, req)
+
+		// The header has to be complete by the time it is flushed.
+		if fw, ok := tt.w.(*fullWriter); ok {
+			if fw.flushedHeader.Get("Server-Timing") == "" {
+				t.Fatalf("%s: flushed the header without Server-Timing", tt.name)
+			}
+
+			if body := fw.rec.Body.String(); body != "hello" {
+				t.Fatalf("%s: got body %q want %q", tt.name, body, "hello")
+			}
+		}
+	}
+}
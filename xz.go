@@ -0,0 +1,258 @@
+package unpack
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"math"
+)
+
+// The xz format is specified at https://tukaani.org/xz/xz-file-format.txt.
+const (
+	xzMagic        = "\xfd7zXZ\x00"
+	xzHeaderLen    = 12   // Length of the stream header.
+	xzBlockHdrMax  = 1024 // Length of the largest possible block header.
+	xzFilterLZMA2  = 0x21
+	xzMinDictSize  = 4 << 10 // Smallest dictionary the decoder allocates.
+	xzMaxDictSize  = 1<<32 - 1
+	xzMaxDictProps = 40 // Dictionary size property for xzMaxDictSize.
+)
+
+// xzCheckLen is the length of the check at the end of each block by the
+// check ID in the stream flags.
+var xzCheckLen = [16]int{0, 4, 4, 4, 8, 8, 8, 16, 16, 16, 32, 32, 32, 64, 64, 64}
+
+var errXZHeader = errors.New("xz: invalid stream or block header")
+
+// The parts of an xz stream which an xzDictLimiter looks at in turn.
+const (
+	xzStreamHeader = iota
+	xzBlockHeader  // Or the index, which ends the blocks.
+	xzChunk        // The LZMA2 chunks which make up the data of a block.
+	xzBlockEnd     // The padding and the check at the end of a block.
+	xzIndex        // The index and the stream footer, which are not checked.
+)
+
+// An xzDictLimiter passes an xz stream through, checking the header of
+// each block before the decoder reads it and failing with a *limitError
+// if the block declares a larger dictionary than max. The decoder
+// allocates a dictionary of the size each block declares, so checking the
+// first one only is not enough. The LZMA2 chunks in between are skipped
+// by their headers, without being decoded. Only the first stream is
+// checked, so the decoder has to reject any data after it.
+type xzDictLimiter struct {
+	r        *bufio.Reader
+	max      int64
+	part     int
+	n        int64 // Bytes left to pass before the next part.
+	check    int   // Length of the check at the end of each block.
+	blockLen int64 // Bytes of the current block passed so far.
+	err      error
+}
+
+func newXZDictLimiter(br *bufio.Reader, max int64) *xzDictLimiter {
+	return &xzDictLimiter{r: br, max: max}
+}
+
+func (z *xzDictLimiter) Read(p []byte) (int, error) {
+	for z.n == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+
+		z.err = z.next()
+	}
+
+	if int64(len(p)) > z.n {
+		p = p[:z.n]
+	}
+
+	n, err := z.r.Read(p)
+	z.n -= int64(n)
+	z.blockLen += int64(n)
+	if err != nil {
+		// Streams may only end after the index.
+		if z.part != xzIndex {
+			err = unexpected(err)
+		}
+
+		z.n = 0
+		z.err = err
+	}
+
+	return n, nil
+}
+
+// next checks the part of the stream which is up next, sets how many
+// bytes of it to pass on and moves on to the part after it.
+func (z *xzDictLimiter) next() error {
+	switch z.part {
+	case xzStreamHeader:
+		hdr, err := z.r.Peek(xzHeaderLen)
+		if err != nil {
+			return unexpected(err)
+		}
+
+		if !bytes.HasPrefix(hdr, []byte(xzMagic)) || hdr[6] != 0 {
+			return errXZHeader
+		}
+
+		z.check = xzCheckLen[hdr[7]&0x0f]
+		z.n, z.part = xzHeaderLen, xzBlockHeader
+	case xzBlockHeader:
+		b, err := z.r.Peek(1)
+		if err != nil {
+			return unexpected(err)
+		}
+
+		// The index, rather than a block header, starts with a zero byte.
+		if b[0] == 0 {
+			z.n, z.part = math.MaxInt64, xzIndex
+			return nil
+		}
+
+		hdr, err := z.r.Peek((int(b[0]) + 1) * 4)
+		if err != nil {
+			return unexpected(err)
+		}
+
+		dict, err := xzDictSize(hdr)
+		if err != nil {
+			return unexpected(err)
+		}
+
+		if dict > z.max || int64(int(dict)) != dict {
+			return &limitError{limit: z.max}
+		}
+
+		z.n, z.part, z.blockLen = int64(len(hdr)), xzChunk, 0
+	case xzChunk:
+		n, err := z.chunkLen()
+		if err != nil {
+			return unexpected(err)
+		}
+
+		z.n = n
+		if n == 1 {
+			z.part = xzBlockEnd
+		}
+	case xzBlockEnd:
+		// The check may be empty and the block already padded.
+		z.n, z.part = (4-z.blockLen%4)%4+int64(z.check), xzBlockHeader
+		if z.n == 0 {
+			return z.next()
+		}
+	default:
+		z.n = math.MaxInt64
+	}
+
+	return nil
+}
+
+// chunkLen returns the length of the LZMA2 chunk which is up next,
+// including its header, as told by the header. The chunk which ends the
+// data of a block is a single zero byte.
+func (z *xzDictLimiter) chunkLen() (int64, error) {
+	hdr, err := z.r.Peek(1)
+	if err != nil {
+		return 0, unexpected(err)
+	}
+
+	switch control := hdr[0]; {
+	case control == 0:
+		return 1, nil
+	case control <= 2:
+		// An uncompressed chunk, whose size minus one follows.
+		if hdr, err = z.r.Peek(3); err != nil {
+			return 0, unexpected(err)
+		}
+
+		return 3 + (int64(hdr[1])<<8 | int64(hdr[2])) + 1, nil
+	case control >= 0x80:
+		// An LZMA chunk, whose header holds the sizes minus one of its
+		// uncompressed and compressed data, followed by new properties
+		// if the control byte asks for a state reset.
+		n := 5
+		if control >= 0xc0 {
+			n = 6
+		}
+
+		if hdr, err = z.r.Peek(5); err != nil {
+			return 0, unexpected(err)
+		}
+
+		return int64(n) + (int64(hdr[3])<<8 | int64(hdr[4])) + 1, nil
+	}
+
+	return 0, errXZHeader
+}
+
+// xzDictSize returns the size of the LZMA2 dictionary which the block
+// header hdr declares, which is how much memory the decoder allocates for
+// the block.
+func xzDictSize(hdr []byte) (int64, error) {
+	// Skip the size and the CRC32 at the end, which the decoder checks.
+	block := hdr[1 : len(hdr)-4]
+	flags := block[0]
+	block = block[1:]
+	if flags&0x3c != 0 {
+		return 0, errXZHeader
+	}
+
+	// Skip the compressed and uncompressed sizes, if present.
+	var err error
+	for _, bit := range []byte{0x40, 0x80} {
+		if flags&bit != 0 {
+			if _, block, err = xzUvarint(block); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	for i := 0; i <= int(flags&0x03); i++ {
+		var id, n uint64
+		if id, block, err = xzUvarint(block); err != nil {
+			return 0, err
+		}
+
+		if n, block, err = xzUvarint(block); err != nil {
+			return 0, err
+		}
+
+		if n > uint64(len(block)) {
+			return 0, errXZHeader
+		}
+
+		props := block[:n]
+		block = block[n:]
+		if id != xzFilterLZMA2 {
+			continue
+		}
+
+		if len(props) != 1 || props[0] > xzMaxDictProps {
+			return 0, errXZHeader
+		}
+
+		if props[0] == xzMaxDictProps {
+			return xzMaxDictSize, nil
+		}
+
+		return int64(2|props[0]&1) << (props[0]/2 + 11), nil
+	}
+
+	return 0, errXZHeader
+}
+
+// xzUvarint reads a variable length integer of up to 9 bytes from b and
+// returns it along with the rest of b.
+func xzUvarint(b []byte) (uint64, []byte, error) {
+	var x uint64
+	for i := 0; i < len(b) && i < 9; i++ {
+		x |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i]&0x80 == 0 {
+			return x, b[i+1:], nil
+		}
+	}
+
+	return 0, nil, errXZHeader
+}
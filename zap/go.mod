@@ -0,0 +1,19 @@
+module github.com/njern/unpack/zap
+
+go 1.22
+
+require (
+	github.com/njern/unpack v0.0.0-20261016170640-d234ddb6f3a0
+	go.uber.org/zap v1.27.0
+)
+
+require (
+	github.com/andybalholm/brotli v1.2.0 // indirect
+	github.com/golang/snappy v1.0.0 // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
+	github.com/ulikunitz/xz v0.5.15 // indirect
+	go.uber.org/multierr v1.10.0 // indirect
+)
+
+replace github.com/njern/unpack => ../
@@ -0,0 +1,57 @@
+// Package zap adapts zap loggers to unpack.Logger, for services which log
+// with go.uber.org/zap rather than log/slog:
+//
+//	handler := unpack.New(next, unpack.WithLogger(zap.New(logger)))
+package zap
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/njern/unpack"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// logger is an unpack.Logger logging to a *zap.Logger.
+type logger struct {
+	l *zap.Logger
+}
+
+// New returns an unpack.Logger which logs to l. Attributes become fields
+// of the same names.
+func New(l *zap.Logger) unpack.Logger {
+	return logger{l: l}
+}
+
+func (l logger) Enabled(ctx context.Context, level slog.Level) bool {
+	return l.l.Core().Enabled(zapLevel(level))
+}
+
+func (l logger) LogAttrs(ctx context.Context, level slog.Level, msg string, attrs ...slog.Attr) {
+	ce := l.l.Check(zapLevel(level), msg)
+	if ce == nil {
+		return
+	}
+
+	fields := make([]zap.Field, len(attrs))
+	for i, a := range attrs {
+		fields[i] = zap.Any(a.Key, a.Value.Any())
+	}
+
+	ce.Write(fields...)
+}
+
+// zapLevel returns the zap level of the slog level level.
+func zapLevel(level slog.Level) zapcore.Level {
+	switch {
+	case level < slog.LevelInfo:
+		return zapcore.DebugLevel
+	case level < slog.LevelWarn:
+		return zapcore.InfoLevel
+	case level < slog.LevelError:
+		return zapcore.WarnLevel
+	default:
+		return zapcore.ErrorLevel
+	}
+}
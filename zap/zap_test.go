@@ -0,0 +1,82 @@
+package zap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/njern/unpack"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// drain reads the body of each request.
+var drain = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+})
+
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestLogger(t *testing.T) {
+	for _, tt := range []struct {
+		body    []byte
+		level   zapcore.Level
+		want    zapcore.Level
+		message string
+		class   string
+	}{
+		{body: gzipped(t, "hello"), level: zapcore.DebugLevel, want: zapcore.DebugLevel, message: "unpack: decoded request body"},
+		{body: gzipped(t, "hello"), level: zapcore.InfoLevel},
+		{body: []byte("hello"), level: zapcore.InfoLevel, want: zapcore.WarnLevel, message: "unpack: rejected request", class: "malformed"},
+	} {
+		core, logs := observer.New(tt.level)
+		handler := unpack.New(drain, unpack.WithLogger(New(zap.New(core))))
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewReader(tt.body))
+		req.Header.Set("Content-Encoding", "gzip")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		entries := logs.All()
+		if tt.message == "" {
+			if len(entries) != 0 {
+				t.Fatalf("unexpected entries: %v", entries)
+			}
+
+			continue
+		}
+
+		if len(entries) != 1 {
+			t.Fatalf("%s: got %d entries want 1", tt.message, len(entries))
+		}
+
+		e := entries[0]
+		if e.Level != tt.want || e.Message != tt.message {
+			t.Fatalf("wrong entry: got %v %q want %v %q", e.Level, e.Message, tt.want, tt.message)
+		}
+
+		fields := e.ContextMap()
+		if fields["encoding"] != "gzip" {
+			t.Fatalf("%s: wrong encoding: got %v want gzip", tt.message, fields["encoding"])
+		}
+
+		if tt.class != "" && fields["error_class"] != tt.class {
+			t.Fatalf("%s: wrong error class: got %v want %s", tt.message, fields["error_class"], tt.class)
+		}
+	}
+}